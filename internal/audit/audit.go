@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// Entry records a single mutating operation
+	Entry struct {
+		Time        time.Time `json:"time"`
+		User        string    `json:"user"`
+		Bind        string    `json:"bind,omitempty"`
+		Via         string    `json:"via,omitempty"`
+		Method      string    `json:"method"`
+		Path        string    `json:"path"`
+		Destination string    `json:"destination,omitempty"`
+		Size        int64     `json:"size"`
+		Status      int       `json:"status"`
+	}
+
+	// Log is an append-only JSON-lines file, one Entry per line
+	Log struct {
+		mu   sync.Mutex
+		file *os.File
+	}
+
+	entryKey struct{}
+)
+
+const (
+	// FileName is the name of the audit log, relative to the state directory
+	// of config.DB (see config.DB.StatePath)
+	FileName = "audit.jsonl"
+)
+
+// Open the log at the given path, creating it if needed
+func Open(file string) (*Log, error) {
+	fd, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log: %w", err)
+	}
+	return &Log{file: fd}, nil
+}
+
+// Record appends e to the log, failures are logged but not returned
+// since the operation already happened.
+func (l *Log) Record(e Entry) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	buf, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Unable to encode audit entry", "entry", e, "error", err)
+		return
+	}
+	buf = append(buf, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(buf); err != nil {
+		slog.Error("Unable to write audit entry", "entry", e, "error", err)
+	}
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// WithEntry returns a context which carries e, allowing handlers
+// to fill details only they know about (see FromContext)
+func WithEntry(ctx context.Context, e *Entry) context.Context {
+	return context.WithValue(ctx, entryKey{}, e)
+}
+
+// FromContext returns the entry which will be recorded for the current request,
+// if the request is not audited, a throw-away entry is returned.
+func FromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(entryKey{}).(*Entry)
+	if e == nil {
+		return &Entry{}
+	}
+	return e
+}
@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+type (
+	// Filter selects entries from the log, zero values match everything
+	Filter struct {
+		User       string
+		Bind       string
+		Method     string
+		PathPrefix string
+		Since      time.Time
+		Until      time.Time
+		// MinStatus and MaxStatus select entries by their result code (inclusive)
+		MinStatus int
+		MaxStatus int
+	}
+)
+
+// Match returns true if e is selected by f
+func (f Filter) Match(e Entry) bool {
+	switch {
+	case f.User != "" && e.User != f.User:
+		return false
+	case f.Bind != "" && strings.Trim(f.Bind, "/") != e.Bind:
+		return false
+	case f.Method != "" && !strings.EqualFold(f.Method, e.Method):
+		return false
+	case f.PathPrefix != "" && !hasPathPrefix(e.Path, f.PathPrefix) && !hasPathPrefix(e.Destination, f.PathPrefix):
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && e.Time.After(f.Until):
+		return false
+	case f.MinStatus > 0 && e.Status < f.MinStatus:
+		return false
+	case f.MaxStatus > 0 && e.Status > f.MaxStatus:
+		return false
+	}
+	return true
+}
+
+func hasPathPrefix(p, prefix string) bool {
+	if p == "" {
+		return false
+	}
+	prefix = path.Clean("/" + prefix)
+	return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// Query calls fn for every entry in the log file which matches f, in the order they were recorded
+func Query(file string, f Filter, fn func(Entry) error) error {
+	fd, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fd.Close()
+	_, err = scan(fd, f, fn)
+	return err
+}
+
+// Tail returns the last n entries which match f
+func Tail(file string, n int, f Filter) ([]Entry, error) {
+	var entries []Entry
+	err := Query(file, f, func(e Entry) error {
+		entries = append(entries, e)
+		if len(entries) > n {
+			entries = entries[1:]
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Follow waits for new entries to be appended to the log file and
+// calls fn for the ones which match f, until ctx is cancelled.
+func Follow(ctx context.Context, file string, f Filter, interval time.Duration, fn func(Entry) error) error {
+	fd, err := os.OpenFile(file, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	offset, err := fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		read, err := scan(fd, f, fn)
+		if err != nil {
+			return err
+		}
+		offset += read
+	}
+}
+
+// scan reads complete lines from r and returns how many bytes were consumed,
+// a partial line at the end (an entry still being written) is left for the next call
+func scan(r io.Reader, f Filter, fn func(Entry) error) (int64, error) {
+	var consumed int64
+	rd := bufio.NewReader(r)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return consumed, nil
+		} else if err != nil {
+			return consumed, err
+		}
+		consumed += int64(len(line))
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			slog.Warn("Ignoring invalid audit entry", "offset", consumed-int64(len(line)), "error", err)
+			continue
+		}
+		if !f.Match(e) {
+			continue
+		}
+		if err := fn(e); err != nil {
+			return consumed, err
+		}
+	}
+}
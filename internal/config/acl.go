@@ -0,0 +1,228 @@
+package config
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+type (
+	// Verb is an operation which can be granted (or denied) by a Permission
+	Verb string
+)
+
+const (
+	VerbRead      = Verb("read")
+	VerbList      = Verb("list")
+	VerbCreate    = Verb("create")
+	VerbOverwrite = Verb("overwrite")
+	VerbDelete    = Verb("delete")
+	VerbMove      = Verb("move")
+	VerbLock      = Verb("lock")
+	VerbPropSet   = Verb("propset")
+
+	// VerbAll matches any verb
+	VerbAll = Verb("*")
+)
+
+var (
+	// AllVerbs contains every verb, except VerbAll
+	AllVerbs = []Verb{VerbRead, VerbList, VerbCreate, VerbOverwrite, VerbDelete, VerbMove, VerbLock, VerbPropSet}
+
+	// ReadVerbs are granted to users with read-only access
+	ReadVerbs = []Verb{VerbRead, VerbList}
+	// WriteVerbs are granted to users with write access
+	WriteVerbs = []Verb{VerbCreate, VerbOverwrite, VerbDelete, VerbMove, VerbLock, VerbPropSet}
+)
+
+// ValidVerb returns true if v is a known verb
+func ValidVerb(v Verb) bool {
+	return v == VerbAll || slices.Contains(AllVerbs, v)
+}
+
+// Can returns true if the user permissions (including the ones inherited
+// from groups) allow verb on the given path
+func (u *User) Can(verb Verb, p string) bool {
+	return Allowed(u.EffectivePermissions(), verb, p)
+}
+
+// CanAny returns true if any of the verbs is allowed on the given path
+func (u *User) CanAny(p string, verbs ...Verb) bool {
+	return AllowedAny(u.EffectivePermissions(), p, verbs...)
+}
+
+// Reaches returns true if the user can list or read p, or any path under it
+// (eg.: a user allowed on /binds/docs/public reaches /binds/docs)
+func (u *User) Reaches(p string) bool {
+	if u.CanAny(p, VerbList, VerbRead) {
+		return true
+	}
+	depth := len(segments(p))
+	for _, perm := range u.EffectivePermissions() {
+		if perm.Deny || !(perm.hasVerb(VerbList) || perm.hasVerb(VerbRead)) {
+			continue
+		}
+		if len(segments(perm.Prefix)) > depth && perm.reaches(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// EffectivePermissions returns the union of the user and group permissions
+func (u *User) EffectivePermissions() []Permission {
+	if len(u.groupPermissions) == 0 {
+		return u.Permissions
+	}
+	return append(slices.Clone(u.Permissions), u.groupPermissions...)
+}
+
+// Allowed evaluates perms for the given verb and path.
+//
+// Only permissions which match the path and mention the verb are considered,
+// from those, the most specific one (longest prefix) wins. If a deny and an allow
+// rule are equally specific, deny wins. If no permission applies, access is denied.
+func Allowed(perms []Permission, verb Verb, p string) bool {
+	p = path.Clean("/" + p)
+	var best *Permission
+	bestScore := [2]int{-1, -1}
+	for i := range perms {
+		perm := &perms[i]
+		if !perm.hasVerb(verb) {
+			continue
+		}
+		score, ok := perm.match(p)
+		if !ok {
+			continue
+		}
+		if score[0] > bestScore[0] ||
+			(score[0] == bestScore[0] && score[1] > bestScore[1]) ||
+			(score == bestScore && perm.Deny) {
+			best, bestScore = perm, score
+		}
+	}
+	return best != nil && !best.Deny
+}
+
+// AllowedAny returns true if any of the verbs is allowed
+func AllowedAny(perms []Permission, p string, verbs ...Verb) bool {
+	for _, v := range verbs {
+		if Allowed(perms, v, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Permission) hasVerb(verb Verb) bool {
+	return slices.Contains(p.Verbs, verb) || slices.Contains(p.Verbs, VerbAll)
+}
+
+// match checks if the permission prefix matches the given path,
+// each segment of the prefix can be a glob pattern (see path.Match),
+// which matches exactly one segment of the path.
+//
+// The score is the number of segments in the prefix and the number of
+// literal (non glob) segments, used to pick the most specific permission.
+func (p *Permission) match(fullpath string) ([2]int, bool) {
+	var score [2]int
+	prefixSegments := segments(p.Prefix)
+	targetSegments := segments(fullpath)
+	if len(targetSegments) < len(prefixSegments) {
+		return score, false
+	}
+	for i, ps := range prefixSegments {
+		matched, err := path.Match(ps, targetSegments[i])
+		if err != nil || !matched {
+			return score, false
+		}
+		score[0]++
+		if !strings.ContainsAny(ps, "*?[\\") {
+			score[1]++
+		}
+	}
+	return score, true
+}
+
+// reaches returns true if the permission applies to target or to any path under it
+func (p *Permission) reaches(target string) bool {
+	prefixSegments := segments(p.Prefix)
+	targetSegments := segments(target)
+	for i := range min(len(prefixSegments), len(targetSegments)) {
+		matched, err := path.Match(prefixSegments[i], targetSegments[i])
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// segments splits the clean path p, the root has no segments
+func segments(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// migrate converts the legacy Reader/Writer/Execute flags to verbs,
+// returns true if the permission was changed
+func (p *Permission) migrate() bool {
+	if !p.Reader && !p.Writer && !p.Execute {
+		return false
+	}
+	if p.Reader && p.Writer && p.Execute {
+		p.Verbs = appendVerbs(p.Verbs, VerbAll)
+	} else {
+		if p.Reader {
+			p.Verbs = appendVerbs(p.Verbs, ReadVerbs...)
+		}
+		if p.Writer {
+			p.Verbs = appendVerbs(p.Verbs, WriteVerbs...)
+		}
+	}
+	p.Reader, p.Writer, p.Execute = false, false, false
+	return true
+}
+
+func appendVerbs(verbs []Verb, extra ...Verb) []Verb {
+	for _, v := range extra {
+		if !slices.Contains(verbs, v) {
+			verbs = append(verbs, v)
+		}
+	}
+	return verbs
+}
+
+// MigratePermissions rewrites all user records which still use
+// the legacy Reader/Writer/Execute flags. Returns the names of the users
+// which were updated.
+func (db *DB) MigratePermissions() ([]string, error) {
+	var migrated []string
+	err := db.update(func() error {
+		names, err := db.listKeys("users")
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			var u User
+			if err := db.loadJSON(&u, "users", name); err != nil {
+				return err
+			}
+			changed := false
+			for i := range u.Permissions {
+				changed = u.Permissions[i].migrate() || changed
+			}
+			if !changed {
+				continue
+			}
+			if err := db.storeJSON(&u, "users", name); err != nil {
+				return err
+			}
+			migrated = append(migrated, name)
+		}
+		return nil
+	})
+	return migrated, err
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func allow(prefix string, verbs ...Verb) Permission {
+	return Permission{Prefix: prefix, Verbs: verbs}
+}
+
+func deny(prefix string, verbs ...Verb) Permission {
+	return Permission{Prefix: prefix, Verbs: verbs, Deny: true}
+}
+
+func TestAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		perms []Permission
+		verb  Verb
+		path  string
+		want  bool
+	}{
+		{"no permissions", nil, VerbRead, "/binds/a", false},
+		{"root prefix", []Permission{allow("/", VerbRead)}, VerbRead, "/binds/a/b", true},
+		{"prefix", []Permission{allow("/binds/a", VerbRead)}, VerbRead, "/binds/a/b", true},
+		{"prefix itself", []Permission{allow("/binds/a", VerbRead)}, VerbRead, "/binds/a", true},
+		{"parent of prefix", []Permission{allow("/binds/a", VerbRead)}, VerbRead, "/binds", false},
+		{"segments are not string prefixes", []Permission{allow("/binds/a", VerbRead)}, VerbRead, "/binds/ab", false},
+		{"other verb", []Permission{allow("/binds/a", VerbRead)}, VerbDelete, "/binds/a/b", false},
+		{"all verbs", []Permission{allow("/binds/a", VerbAll)}, VerbDelete, "/binds/a/b", true},
+		{"path is cleaned", []Permission{allow("/binds/a", VerbRead)}, VerbRead, "binds/x/../a//b", true},
+		{"dot segments do not escape", []Permission{allow("/binds/a", VerbRead)}, VerbRead, "/binds/a/../b", false},
+
+		{"longer prefix denies", []Permission{allow("/binds", VerbAll), deny("/binds/a/secret", VerbAll)}, VerbRead, "/binds/a/secret/f", false},
+		{"longer prefix denies its parent only", []Permission{allow("/binds", VerbAll), deny("/binds/a/secret", VerbAll)}, VerbRead, "/binds/a/f", true},
+		{"longer prefix allows", []Permission{deny("/binds", VerbAll), allow("/binds/a/public", VerbRead)}, VerbRead, "/binds/a/public/f", true},
+		{"order does not matter", []Permission{allow("/binds/a/public", VerbRead), deny("/binds", VerbAll)}, VerbRead, "/binds/a/public/f", true},
+		{"rules without the verb are ignored", []Permission{allow("/binds", VerbAll), deny("/binds/a", VerbDelete)}, VerbRead, "/binds/a/f", true},
+		{"deny of a verb", []Permission{allow("/binds", VerbAll), deny("/binds/a", VerbDelete)}, VerbDelete, "/binds/a/f", false},
+
+		{"glob segment", []Permission{allow("/binds/*/public", VerbRead)}, VerbRead, "/binds/x/public/f", true},
+		{"glob matches one segment", []Permission{allow("/binds/*/public", VerbRead)}, VerbRead, "/binds/x/y/public", false},
+		{"glob pattern", []Permission{allow("/binds/*.d", VerbRead)}, VerbRead, "/binds/x.d/f", true},
+		{"literal wins over glob", []Permission{deny("/binds/*/public", VerbRead), allow("/binds/x/public", VerbRead)}, VerbRead, "/binds/x/public", true},
+		{"literal denies over glob", []Permission{allow("/binds/*/public", VerbRead), deny("/binds/x/public", VerbRead)}, VerbRead, "/binds/x/public", false},
+		{"longer glob wins over shorter literal", []Permission{deny("/binds/x", VerbRead), allow("/binds/x/*", VerbRead)}, VerbRead, "/binds/x/f", true},
+		{"invalid pattern does not match", []Permission{allow("/binds/[", VerbRead)}, VerbRead, "/binds/[", false},
+
+		{"deny wins ties", []Permission{allow("/binds/a", VerbRead), deny("/binds/a", VerbRead)}, VerbRead, "/binds/a/f", false},
+		{"deny wins ties in any order", []Permission{deny("/binds/a", VerbRead), allow("/binds/a", VerbRead)}, VerbRead, "/binds/a/f", false},
+		{"deny wins glob ties", []Permission{allow("/binds/*", VerbRead), deny("/binds/?", VerbRead)}, VerbRead, "/binds/a", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Allowed(tc.perms, tc.verb, tc.path); got != tc.want {
+				t.Fatalf("Allowed(%v, %q) = %v, expected %v", tc.verb, tc.path, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAllowedAny(t *testing.T) {
+	perms := []Permission{allow("/binds", VerbList), deny("/binds/a", VerbList)}
+	if !AllowedAny(perms, "/binds/b", VerbRead, VerbList) {
+		t.Fatal("expected list to be allowed")
+	}
+	if AllowedAny(perms, "/binds/a", VerbRead, VerbList) {
+		t.Fatal("expected read and list to be denied")
+	}
+}
+
+func TestUserCan(t *testing.T) {
+	u := &User{
+		Permissions:      []Permission{allow("/binds/team", VerbAll)},
+		groupPermissions: []Permission{allow("/binds/shared", ReadVerbs...), deny("/binds/team/private", VerbAll)},
+	}
+	for _, tc := range []struct {
+		verb Verb
+		path string
+		want bool
+	}{
+		{VerbDelete, "/binds/team/f", true},
+		{VerbRead, "/binds/shared/f", true},
+		{VerbCreate, "/binds/shared/f", false},
+		{VerbRead, "/binds/team/private/f", false},
+	} {
+		if got := u.Can(tc.verb, tc.path); got != tc.want {
+			t.Errorf("Can(%v, %q) = %v, expected %v", tc.verb, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestReaches(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		perms []Permission
+		path  string
+		want  bool
+	}{
+		{"allowed path", []Permission{allow("/binds/docs", VerbList)}, "/binds/docs/a", true},
+		{"parent of allowed path", []Permission{allow("/binds/docs/public", VerbRead)}, "/binds/docs", true},
+		{"root", []Permission{allow("/binds/docs/public", VerbRead)}, "/", true},
+		{"sibling", []Permission{allow("/binds/docs/public", VerbRead)}, "/binds/other", false},
+		{"through glob", []Permission{allow("/binds/*/public", VerbRead)}, "/binds/x", true},
+		{"other verbs", []Permission{allow("/binds/docs/upload", VerbCreate)}, "/binds/docs", false},
+		{"deny rules do not reach", []Permission{deny("/binds/docs/public", VerbRead)}, "/binds/docs", false},
+		{"denied path", []Permission{allow("/binds", VerbAll), deny("/binds/docs", VerbAll)}, "/binds/docs/a", false},
+		{"allowed below a denied path", []Permission{deny("/binds/docs", VerbAll), allow("/binds/docs/a/b", VerbRead)}, "/binds/docs/a", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &User{Permissions: tc.perms}
+			if got := u.Reaches(tc.path); got != tc.want {
+				t.Fatalf("Reaches(%q) = %v, expected %v", tc.path, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		perm    Permission
+		verbs   []Verb
+		changed bool
+	}{
+		{"no flags", Permission{Verbs: []Verb{VerbRead}}, []Verb{VerbRead}, false},
+		{"reader", Permission{Reader: true}, ReadVerbs, true},
+		{"writer", Permission{Writer: true}, WriteVerbs, true},
+		{"reader and writer", Permission{Reader: true, Writer: true}, append(slices.Clone(ReadVerbs), WriteVerbs...), true},
+		{"all flags", Permission{Reader: true, Writer: true, Execute: true}, []Verb{VerbAll}, true},
+		{"execute only", Permission{Execute: true}, nil, true},
+		{"keeps verbs", Permission{Verbs: []Verb{VerbRead, VerbLock}, Writer: true}, append([]Verb{VerbRead}, WriteVerbs...), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := tc.perm
+			if changed := p.migrate(); changed != tc.changed {
+				t.Fatalf("migrate returned %v, expected %v", changed, tc.changed)
+			}
+			slices.Sort(p.Verbs)
+			want := slices.Clone(tc.verbs)
+			slices.Sort(want)
+			if !slices.Equal(p.Verbs, want) {
+				t.Fatalf("verbs are %v, expected %v", p.Verbs, want)
+			}
+			if p.Reader || p.Writer || p.Execute {
+				t.Fatal("legacy flags were kept")
+			}
+		})
+	}
+}
+
+func TestMigratePermissions(t *testing.T) {
+	t.Setenv("DAVD_SEED_KEY", strings.Repeat("ab", 32))
+	db, err := Open(context.Background(), t.TempDir(), os.Getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := User{Name: "legacy", Active: true, Permissions: []Permission{
+		{Prefix: "/binds/docs/", Reader: true},
+		{Prefix: "/home/legacy/", Reader: true, Writer: true, Execute: true},
+	}}
+	current := User{Name: "current", Active: true, Permissions: []Permission{allow("/binds/docs/", VerbRead)}}
+	for _, u := range []User{legacy, current} {
+		if err := db.storeJSON(&u, "users", u.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrated, err := db.MigratePermissions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(migrated, []string{"legacy"}) {
+		t.Fatalf("migrated %v, expected only legacy", migrated)
+	}
+	var stored User
+	if err := db.loadJSON(&stored, "users", "legacy"); err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Can(VerbList, "/binds/docs/a") || stored.Can(VerbCreate, "/binds/docs/a") {
+		t.Fatalf("reader was not migrated to read verbs: %+v", stored.Permissions)
+	}
+	if !stored.Can(VerbDelete, "/home/legacy/a") {
+		t.Fatalf("all flags were not migrated to every verb: %+v", stored.Permissions)
+	}
+	if migrated, err := db.MigratePermissions(); err != nil || len(migrated) != 0 {
+		t.Fatalf("second migration changed %v: %v", migrated, err)
+	}
+}
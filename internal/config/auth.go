@@ -3,15 +3,68 @@ package config
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"path"
 	"slices"
 	"strings"
 	"time"
 
+	"github.com/andrebq/davd/internal/reserved"
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
+type (
+	apiKeyRecord struct {
+		Token     []byte    `json:"token"`
+		Username  string    `json:"username"`
+		Subject   string    `json:"subject,omitempty"`
+		IssuedAt  time.Time `json:"issued_at,omitempty"`
+		ExpiresAt time.Time `json:"expires_at,omitempty"`
+		Revoked   bool      `json:"revoked,omitempty"`
+		RevokedAt time.Time `json:"revoked_at,omitempty"`
+	}
+
+	staticToken struct {
+		Username string `json:"username"`
+	}
+
+	// APIKey contains the public information about an API key,
+	// the key itself is never stored by the server.
+	APIKey struct {
+		ID        string    `json:"id"`
+		Username  string    `json:"username"`
+		Subject   string    `json:"subject"`
+		IssuedAt  time.Time `json:"issued_at,omitempty"`
+		ExpiresAt time.Time `json:"expires_at,omitempty"`
+		Revoked   bool      `json:"revoked"`
+	}
+)
+
+const (
+	apiKeyPrefix   = "davd_"
+	apiKeyIDLength = 16
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrInactiveUser       = errors.New("user is not active")
+	ErrRevokedAPIKey      = errors.New("api key was revoked")
+	ErrInvalidUsername    = errors.New("invalid username")
+)
+
+// FormatAPIKey returns the textual representation of an API key,
+// which is what users should provide as their password.
+func FormatAPIKey(key []byte) string {
+	return apiKeyPrefix + hex.EncodeToString(key)
+}
+
+// IsAPIKey returns true if secret looks like an API key generated by FormatAPIKey
+func IsAPIKey(secret string) bool {
+	return strings.HasPrefix(secret, apiKeyPrefix)
+}
+
 func (db *DB) verifyToken(info *TokenInfo) error {
 	token, err := jwt.ParseWithClaims(info.raw, &info.claims, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -31,7 +84,7 @@ func (db *DB) verifyToken(info *TokenInfo) error {
 
 func (db *DB) generateToken(subject string, id []byte, ttl time.Duration) TokenInfo {
 	if len(id) == 0 {
-		id := make([]byte, 16)
+		id = make([]byte, 16)
 		_, err := rand.Read(id)
 		if err != nil {
 			panic("FATAL RUNTIME ERROR: unable to read from crypto/rand")
@@ -67,47 +120,132 @@ func (db *DB) generateToken(subject string, id []byte, ttl time.Duration) TokenI
 // This is mostly useful to allow users to login to the server with a password rather than
 // by using Bearer tokens. If apiKey is empty, a random one will be generated
 func (db *DB) CreateAPIKey(username string, ttl time.Duration) ([]byte, TokenInfo, error) {
+	if _, err := db.FindUser(username); err != nil {
+		return nil, TokenInfo{}, err
+	}
 	const (
-		idLength  = 16
 		keyLength = 32
 
-		apiKeyLength = keyLength + idLength
+		apiKeyLength = keyLength + apiKeyIDLength
 	)
 	var apiKey [apiKeyLength]byte
 	_, err := rand.Read(apiKey[:])
 	if err != nil {
 		return nil, TokenInfo{}, err
 	}
-	id := apiKey[:idLength]
-	key := apiKey[idLength:]
+	id := apiKey[:apiKeyIDLength]
+	key := apiKey[apiKeyIDLength:]
 	token := db.generateToken(fmt.Sprintf("api_key:%s", username), id, ttl)
 
 	tokenSealKey := deriveKey(db.tokenEncryptionKey[:], []byte("api_key"), key)
-	keydata := struct {
-		Token    []byte `json:"token"`
-		Username string `json:"username"`
-	}{
-		Token:    encryptBuffer(&tokenSealKey, []byte(token.raw)),
-		Username: username,
+	keydata := apiKeyRecord{
+		Token:     encryptBuffer(&tokenSealKey, []byte(token.raw)),
+		Username:  username,
+		Subject:   token.Subject(),
+		IssuedAt:  token.claims.IssuedAt.Time,
+		ExpiresAt: token.ExpiresAt(),
 	}
-	err = db.storeJSON(keydata, "api_keys", hex.EncodeToString(id))
+	err = db.update(func() error {
+		return db.storeJSON(keydata, "api_keys", hex.EncodeToString(id))
+	})
 	return apiKey[:], token, err
 }
 
 func (d *DB) UpsertUser(username, password string) error {
-	if found, _ := d.FindUser(username); found == nil {
-		if err := d.CreateUser(username, false); err != nil {
-			return nil
+	return d.update(func() error {
+		if found, _ := d.FindUser(username); found == nil {
+			if err := d.createUser(username, false); err != nil {
+				return err
+			}
 		}
+		err := d.updatePassword(username, password)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// UpdatePassword replaces the password of the given user,
+// any pending credential rotation (see RegisterToken) is considered done.
+func (db *DB) UpdatePassword(username, password string) error {
+	return db.update(func() error {
+		return db.updatePassword(username, password)
+	})
+}
+
+func (db *DB) updatePassword(username, password string) error {
+	err := db.storePassword(username, password)
+	if err != nil {
+		return err
 	}
-	err := d.UpdatePassword(username, password)
+	return db.completeRotation(username)
+}
+
+// RegisterToken registers token as the initial credential for username.
+//
+// The token is accepted as the user password (Basic auth) or as a Bearer token,
+// but the user must rotate their credentials (via UpdatePassword) before accessing
+// any other resource.
+func (db *DB) RegisterToken(username, token string) error {
+	return db.update(func() error {
+		return db.registerToken(username, token)
+	})
+}
+
+func (db *DB) registerToken(username, token string) error {
+	if token == "" {
+		return ErrInvalidCredentials
+	}
+	user, err := db.FindUser(username)
+	if err != nil {
+		return err
+	}
+	err = db.storePassword(username, token)
+	if err != nil {
+		return err
+	}
+	err = db.storeJSON(&staticToken{Username: username}, "static_tokens", db.staticTokenID(token))
 	if err != nil {
 		return err
 	}
-	return nil
+	user.RotateCredentials = true
+	return db.storeJSON(user, "users", username)
 }
 
-func (db *DB) UpdatePassword(username, password string) error {
+func (db *DB) completeRotation(username string) error {
+	user, err := db.FindUser(username)
+	if err != nil {
+		return err
+	}
+	ids, err := db.listKeys("static_tokens")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		var st staticToken
+		if err := db.loadJSON(&st, "static_tokens", id); err != nil {
+			return err
+		}
+		if st.Username == username {
+			if err := db.removeKey("static_tokens", id); err != nil {
+				return err
+			}
+		}
+	}
+	if !user.RotateCredentials {
+		return nil
+	}
+	user.RotateCredentials = false
+	return db.storeJSON(user, "users", username)
+}
+
+func (db *DB) staticTokenID(token string) string {
+	id := deriveKey(db.tokenSignKey[:], []byte("static-token"), []byte(token))
+	return hex.EncodeToString(id[:])
+}
+
+func (db *DB) storePassword(username, password string) error {
 	bcryptHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
@@ -147,34 +285,224 @@ func (db *DB) PasswordLogin(username, password string) (TokenInfo, *User, error)
 	if err != nil {
 		return tokenInfo, nil, err
 	}
-	user, err := db.FindUser(username)
+	user, err := db.activeUser(username)
 	if err != nil {
 		return tokenInfo, nil, err
 	}
 	return tokenInfo, user, err
 }
 
-func (db *DB) UpdatePermissions(username string, permissions []Permission) error {
+// APIKeyLogin authenticates username using an API key previously returned by CreateAPIKey
+// (in the format produced by FormatAPIKey).
+func (db *DB) APIKeyLogin(username, apiKey string) (TokenInfo, *User, error) {
+	var tokenInfo TokenInfo
+	key, err := hex.DecodeString(strings.TrimPrefix(apiKey, apiKeyPrefix))
+	if err != nil || len(key) <= apiKeyIDLength {
+		return tokenInfo, nil, ErrInvalidCredentials
+	}
+	id, secret := key[:apiKeyIDLength], key[apiKeyIDLength:]
+	var record apiKeyRecord
+	err = db.loadJSON(&record, "api_keys", hex.EncodeToString(id))
+	if errors.Is(err, ErrNoSuchKey) {
+		return tokenInfo, nil, ErrInvalidCredentials
+	} else if err != nil {
+		return tokenInfo, nil, err
+	}
+	if record.Username != username {
+		return tokenInfo, nil, ErrInvalidCredentials
+	}
+	if record.Revoked {
+		return tokenInfo, nil, ErrRevokedAPIKey
+	}
+	tokenSealKey := deriveKey(db.tokenEncryptionKey[:], []byte("api_key"), secret)
+	decryptedTokenBytes, err := decryptBuffer(&tokenSealKey, record.Token)
+	if err != nil {
+		return tokenInfo, nil, ErrInvalidCredentials
+	}
+	tokenInfo.raw = string(decryptedTokenBytes)
+	err = db.verifyToken(&tokenInfo)
+	if err != nil {
+		return tokenInfo, nil, err
+	}
+	if tokenInfo.Subject() != fmt.Sprintf("api_key:%s", username) {
+		return tokenInfo, nil, ErrInvalidCredentials
+	}
+	user, err := db.activeUser(username)
+	if err != nil {
+		return tokenInfo, nil, err
+	}
+	return tokenInfo, user, nil
+}
+
+// TokenLogin authenticates a user from a token (usually received as a Bearer token).
+//
+// Tokens registered via RegisterToken are accepted as-is, otherwise only signed tokens
+// minted for API keys are accepted, and the matching entry under api_keys
+// must still exist.
+func (db *DB) TokenLogin(raw string) (TokenInfo, *User, error) {
+	tokenInfo := TokenInfo{raw: raw}
+	var st staticToken
+	err := db.loadJSON(&st, "static_tokens", db.staticTokenID(raw))
+	if err == nil {
+		user, err := db.activeUser(st.Username)
+		return tokenInfo, user, err
+	} else if !errors.Is(err, ErrNoSuchKey) {
+		return tokenInfo, nil, err
+	}
+	err = db.verifyToken(&tokenInfo)
+	if err != nil {
+		return tokenInfo, nil, err
+	}
+	kind, username, found := strings.Cut(tokenInfo.Subject(), ":")
+	if !found || kind != "api_key" || tokenInfo.ID() == "" {
+		return tokenInfo, nil, ErrInvalidCredentials
+	}
+	var record apiKeyRecord
+	err = db.loadJSON(&record, "api_keys", tokenInfo.ID())
+	if errors.Is(err, ErrNoSuchKey) {
+		return tokenInfo, nil, ErrInvalidCredentials
+	} else if err != nil {
+		return tokenInfo, nil, err
+	}
+	if record.Username != username {
+		return tokenInfo, nil, ErrInvalidCredentials
+	}
+	if record.Revoked {
+		return tokenInfo, nil, ErrRevokedAPIKey
+	}
+	user, err := db.activeUser(username)
+	if err != nil {
+		return tokenInfo, nil, err
+	}
+	return tokenInfo, user, nil
+}
+
+// ListAPIKeys returns all API keys issued to username,
+// if username is empty, keys from all users are returned.
+func (db *DB) ListAPIKeys(username string) ([]APIKey, error) {
+	ids, err := db.listKeys("api_keys")
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	for _, id := range ids {
+		var record apiKeyRecord
+		err := db.loadJSON(&record, "api_keys", id)
+		if err != nil {
+			return nil, err
+		}
+		if username != "" && record.Username != username {
+			continue
+		}
+		keys = append(keys, APIKey{
+			ID:        id,
+			Username:  record.Username,
+			Subject:   record.Subject,
+			IssuedAt:  record.IssuedAt,
+			ExpiresAt: record.ExpiresAt,
+			Revoked:   record.Revoked,
+		})
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey marks the key as revoked, if purge is true, the key is removed
+// from the database instead.
+//
+// Either way, the key cannot be used to login anymore.
+func (db *DB) RevokeAPIKey(id string, purge bool) error {
+	return db.update(func() error {
+		if _, err := hex.DecodeString(id); err != nil || len(id) != apiKeyIDLength*2 {
+			return fmt.Errorf("invalid api key id: %q", id)
+		}
+		var record apiKeyRecord
+		err := db.loadJSON(&record, "api_keys", id)
+		if err != nil {
+			return err
+		}
+		if purge {
+			return db.removeKey("api_keys", id)
+		}
+		record.Revoked = true
+		record.RevokedAt = time.Now()
+		return db.storeJSON(&record, "api_keys", id)
+	})
+}
+
+func (db *DB) activeUser(username string) (*User, error) {
 	user, err := db.FindUser(username)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	user.Permissions = append(user.Permissions, permissions...)
-	// TODO: should perform a smarter deduplication in case a prefix already
-	slices.SortFunc(user.Permissions, func(a, b Permission) int {
-		return strings.Compare(a.Prefix, b.Prefix)
+	if !user.Active {
+		return nil, ErrInactiveUser
+	}
+	if err := db.loadGroupPermissions(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// UpdatePermissions adds permissions to the given user,
+// permissions with the same prefix (and deny flag) are merged.
+func (db *DB) UpdatePermissions(username string, permissions []Permission) error {
+	return db.update(func() error {
+		user, err := db.FindUser(username)
+		if err != nil {
+			return err
+		}
+		user.Permissions = mergePermissions(user.Permissions, permissions)
+		return db.storeJSON(&user, "users", username)
 	})
-	var dedup []Permission
-	for i, v := range user.Permissions {
-		if i == 0 || v.Prefix != user.Permissions[i-1].Prefix {
-			dedup = append(dedup, v)
+}
+
+func mergePermissions(current []Permission, extra []Permission) []Permission {
+	var merged []Permission
+	for _, p := range append(slices.Clone(current), extra...) {
+		p.migrate()
+		p.Prefix = normalizePrefix(p.Prefix)
+		idx := slices.IndexFunc(merged, func(m Permission) bool {
+			return m.Prefix == p.Prefix && m.Deny == p.Deny
+		})
+		if idx < 0 {
+			merged = append(merged, p)
+			continue
 		}
+		merged[idx].Verbs = appendVerbs(merged[idx].Verbs, p.Verbs...)
+	}
+	slices.SortStableFunc(merged, func(a, b Permission) int {
+		return strings.Compare(a.Prefix, b.Prefix)
+	})
+	return merged
+}
+
+func normalizePrefix(prefix string) string {
+	prefix = path.Clean("/" + prefix)
+	if prefix == "/" {
+		return prefix
 	}
-	user.Permissions = dedup
-	return db.storeJSON(&user, "users", username)
+	return prefix + "/"
+}
+
+// ValidUsername returns true if name can be safely used as a path segment
+// (usernames are used to name the user home directory), the same rules
+// apply to group names. The name of storage.HiddenDir is reserved,
+// since that home directory would be hidden by the home bind.
+func ValidUsername(name string) bool {
+	return name != "" && name != "." && name != ".." && name != reserved.HiddenName &&
+		!strings.ContainsAny(name, "/\\:") && strings.TrimSpace(name) == name
 }
 
 func (db *DB) CreateUser(name string, admin bool) error {
+	return db.update(func() error {
+		return db.createUser(name, admin)
+	})
+}
+
+func (db *DB) createUser(name string, admin bool) error {
+	if !ValidUsername(name) {
+		return ErrInvalidUsername
+	}
 	u := User{
 		Name:        name,
 		Admin:       admin,
@@ -184,17 +512,13 @@ func (db *DB) CreateUser(name string, admin bool) error {
 
 	if admin {
 		u.Permissions = append(u.Permissions, Permission{
-			Prefix:  "/",
-			Reader:  true,
-			Writer:  true,
-			Execute: true,
+			Prefix: "/",
+			Verbs:  []Verb{VerbAll},
 		})
 	} else {
 		u.Permissions = append(u.Permissions, Permission{
-			Prefix:  "/home/" + name + "/",
-			Reader:  true,
-			Writer:  true,
-			Execute: false,
+			Prefix: "/home/" + name + "/",
+			Verbs:  AllVerbs,
 		})
 	}
 
@@ -207,5 +531,8 @@ func (db *DB) FindUser(name string) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	for i := range u.Permissions {
+		u.Permissions[i].migrate()
+	}
 	return &u, nil
 }
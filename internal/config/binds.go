@@ -0,0 +1,364 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/andrebq/davd/internal/storage"
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// BindMode restricts the operations allowed on a bind,
+	// regardless of user permissions
+	BindMode string
+
+	// BindEncryption defines what is encrypted before reaching the storage of the bind
+	BindEncryption string
+
+	// Bind exposes a storage location (see storage.Open) under /binds/<name>/
+	Bind struct {
+		Name        string         `json:"name"`
+		Path        string         `json:"path"`
+		Mode        BindMode       `json:"mode,omitempty"`
+		Encryption  BindEncryption `json:"encryption,omitempty"`
+		Owner       string         `json:"owner,omitempty"`
+		Description string         `json:"description,omitempty"`
+
+		// KeepVersions is how many previous versions of overwritten files are kept
+		// and VersionsWindow for how long, versioning is enabled if any is set
+		KeepVersions   int      `json:"keep_versions,omitempty"`
+		VersionsWindow Duration `json:"versions_window,omitempty"`
+	}
+
+	// BindAccess is a permission (from a user or one of their groups)
+	// which reaches a bind, either because its prefix contains the bind
+	// or because it is a path inside the bind
+	BindAccess struct {
+		User       string     `json:"user"`
+		Group      string     `json:"group,omitempty"`
+		Permission Permission `json:"permission"`
+	}
+
+	// BindsFile is the content of the binds file (see DB.BindsFile)
+	BindsFile struct {
+		Version int    `json:"version"`
+		Binds   []Bind `json:"binds"`
+	}
+)
+
+const (
+	// BindModeNormal allows everything permitted to the user
+	BindModeNormal = BindMode("normal")
+	// BindModeReadOnly refuses any change
+	BindModeReadOnly = BindMode("read-only")
+	// BindModeWriteOnce allows new files and directories, but existing ones
+	// cannot be overwritten, moved or removed. Empty files can be overwritten,
+	// since some clients create them before uploading the content.
+	BindModeWriteOnce = BindMode("write-once")
+
+	// BindEncryptionNone stores files as they are
+	BindEncryptionNone = BindEncryption("none")
+	// BindEncryptionContent encrypts the content of the files,
+	// names and the directory structure are visible in the storage
+	BindEncryptionContent = BindEncryption("content")
+	// BindEncryptionNames encrypts the content and the names of files and directories
+	BindEncryptionNames = BindEncryption("names")
+
+	// BindsVersion is the latest version of the binds file format
+	BindsVersion = 1
+)
+
+var (
+	ErrInvalidBind = errors.New("invalid bind")
+	ErrNoSuchBind  = errors.New("no such bind")
+
+	bindNameRE = regexp.MustCompile("^[a-z0-9][a-z0-9_.-]*$")
+)
+
+// ValidBindName returns true if name can be used as a bind name
+func ValidBindName(name string) bool {
+	return len(name) <= 64 && bindNameRE.MatchString(name)
+}
+
+// BindsFile returns the path to the file where binds are stored,
+// the server watches it for changes
+func (db *DB) BindsFile() string {
+	return db.pathToKey("binds")
+}
+
+// LoadBinds returns all binds, an empty list is returned if the
+// binds file does not exist
+func (db *DB) LoadBinds() ([]Bind, error) {
+	var f BindsFile
+	err := db.loadJSON(&f, "binds")
+	if errors.Is(err, ErrNoSuchKey) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read binds file: %w", err)
+	}
+	if f.Version > BindsVersion {
+		return nil, fmt.Errorf("%w: binds file version %v is not supported (expected %v or older)", ErrInvalidBind, f.Version, BindsVersion)
+	}
+	seen := map[string]bool{}
+	for _, b := range f.Binds {
+		if err := b.Validate(); err != nil {
+			return nil, err
+		}
+		if seen[b.Name] {
+			return nil, fmt.Errorf("%w: %v is defined more than once", ErrInvalidBind, b.Name)
+		}
+		seen[b.Name] = true
+	}
+	return f.Binds, nil
+}
+
+// Valid returns true if m is a known mode, empty is the same as BindModeNormal
+func (m BindMode) Valid() bool {
+	switch m {
+	case "", BindModeNormal, BindModeReadOnly, BindModeWriteOnce:
+		return true
+	}
+	return false
+}
+
+// Allows returns true if verb can be performed on a bind using this mode
+func (m BindMode) Allows(verb Verb) bool {
+	switch m {
+	case BindModeReadOnly:
+		return verb == VerbRead || verb == VerbList || verb == VerbLock
+	case BindModeWriteOnce:
+		return verb == VerbRead || verb == VerbList || verb == VerbLock || verb == VerbCreate
+	}
+	return true
+}
+
+// Valid returns true if e is a known encryption, empty is the same as BindEncryptionNone
+func (e BindEncryption) Valid() bool {
+	switch e {
+	case "", BindEncryptionNone, BindEncryptionContent, BindEncryptionNames:
+		return true
+	}
+	return false
+}
+
+// Enabled returns true if the content of the files is encrypted
+func (e BindEncryption) Enabled() bool {
+	return e == BindEncryptionContent || e == BindEncryptionNames
+}
+
+// Validate checks that the bind has a valid name, mode, encryption and storage location (see storage.Validate)
+func (b Bind) Validate() error {
+	if !ValidBindName(b.Name) {
+		return fmt.Errorf("%w: name %q must contain only lowercase letters, digits, '.', '_' or '-'", ErrInvalidBind, b.Name)
+	}
+	if !b.Mode.Valid() {
+		return fmt.Errorf("%w: mode %q of %v must be one of %v, %v or %v", ErrInvalidBind, b.Mode, b.Name, BindModeNormal, BindModeReadOnly, BindModeWriteOnce)
+	}
+	if !b.Encryption.Valid() {
+		return fmt.Errorf("%w: encryption %q of %v must be one of %v, %v or %v", ErrInvalidBind, b.Encryption, b.Name, BindEncryptionNone, BindEncryptionContent, BindEncryptionNames)
+	}
+	if b.KeepVersions < 0 || b.VersionsWindow < 0 {
+		return fmt.Errorf("%w: versions of %v cannot be negative", ErrInvalidBind, b.Name)
+	}
+	if err := storage.Validate(b.Path); err != nil {
+		return fmt.Errorf("%w: path of %v: %v", ErrInvalidBind, b.Name, err)
+	}
+	return nil
+}
+
+func (db *DB) FindBind(name string) (*Bind, error) {
+	binds, err := db.LoadBinds()
+	if err != nil {
+		return nil, err
+	}
+	idx := slices.IndexFunc(binds, func(b Bind) bool { return b.Name == name })
+	if idx < 0 {
+		return nil, fmt.Errorf("%w: %v", ErrNoSuchBind, name)
+	}
+	return &binds[idx], nil
+}
+
+// AddBind stores a new bind, a local path must be an existing directory
+// and the owner (if any) must be an existing user.
+//
+// Running servers pick up the change without a restart.
+func (db *DB) AddBind(b Bind) error {
+	return db.update(func() error {
+		var err error
+		if !strings.Contains(b.Path, "://") {
+			b.Path, err = filepath.Abs(b.Path)
+			if err != nil {
+				return err
+			}
+		}
+		if err := b.Validate(); err != nil {
+			return err
+		}
+		if local, ok := storage.LocalPath(b.Path); ok {
+			st, err := os.Stat(local)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidBind, err)
+			} else if !st.IsDir() {
+				return fmt.Errorf("%w: %v is not a directory", ErrInvalidBind, local)
+			}
+			if b.Encryption.Enabled() {
+				// existing files would not be readable
+				entries, err := os.ReadDir(local)
+				if err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidBind, err)
+				} else if len(entries) > 0 {
+					return fmt.Errorf("%w: %v must be empty to be used by an encrypted bind", ErrInvalidBind, local)
+				}
+			}
+		}
+		if b.Owner != "" {
+			if _, err := db.FindUser(b.Owner); err != nil {
+				return fmt.Errorf("unable to find owner %v: %w", b.Owner, err)
+			}
+		}
+		binds, err := db.LoadBinds()
+		if err != nil {
+			return err
+		}
+		if slices.ContainsFunc(binds, func(old Bind) bool { return old.Name == b.Name }) {
+			return fmt.Errorf("%w: %v already exists", ErrInvalidBind, b.Name)
+		}
+		return db.storeBinds(append(binds, b))
+	})
+}
+
+// SetBindMode changes the mode of an existing bind
+func (db *DB) SetBindMode(name string, mode BindMode) error {
+	return db.update(func() error {
+		if !mode.Valid() {
+			return fmt.Errorf("%w: unknown mode %q", ErrInvalidBind, mode)
+		}
+		binds, err := db.LoadBinds()
+		if err != nil {
+			return err
+		}
+		idx := slices.IndexFunc(binds, func(b Bind) bool { return b.Name == name })
+		if idx < 0 {
+			return fmt.Errorf("%w: %v", ErrNoSuchBind, name)
+		}
+		binds[idx].Mode = mode
+		return db.storeBinds(binds)
+	})
+}
+
+// BindEncryptionKey returns the key used to encrypt the files of the bind,
+// derived from the storage key and the bind name, so renaming a bind
+// makes its files unreadable
+func (db *DB) BindEncryptionKey(name string) [32]byte {
+	return deriveKey(db.storageEncryptionKey[:], []byte("bind_content"), []byte(name))
+}
+
+// Versioned returns true if previous versions of overwritten files are kept
+func (b Bind) Versioned() bool {
+	return b.KeepVersions > 0 || b.VersionsWindow > 0
+}
+
+// SetBindVersions changes how many versions (and for how long) are kept,
+// zero for both disables versioning. Existing versions are kept until pruned.
+func (db *DB) SetBindVersions(name string, keep int, window time.Duration) error {
+	return db.update(func() error {
+		binds, err := db.LoadBinds()
+		if err != nil {
+			return err
+		}
+		idx := slices.IndexFunc(binds, func(b Bind) bool { return b.Name == name })
+		if idx < 0 {
+			return fmt.Errorf("%w: %v", ErrNoSuchBind, name)
+		}
+		binds[idx].KeepVersions = keep
+		binds[idx].VersionsWindow = Duration(window)
+		if err := binds[idx].Validate(); err != nil {
+			return err
+		}
+		return db.storeBinds(binds)
+	})
+}
+
+// OpenBindStorage returns the complete storage of the bind (including storage.HiddenDir),
+// files are decrypted if the bind is encrypted
+func (db *DB) OpenBindStorage(b Bind) (webdav.FileSystem, error) {
+	fsys, err := storage.Open(b.Path)
+	if err != nil {
+		return nil, err
+	}
+	if b.Encryption.Enabled() {
+		fsys = storage.Encrypt(fsys, db.BindEncryptionKey(b.Name), b.Encryption == BindEncryptionNames)
+	}
+	return fsys, nil
+}
+
+// RemoveBind removes the bind, the files in its local path are kept
+func (db *DB) RemoveBind(name string) error {
+	return db.update(func() error {
+		binds, err := db.LoadBinds()
+		if err != nil {
+			return err
+		}
+		idx := slices.IndexFunc(binds, func(b Bind) bool { return b.Name == name })
+		if idx < 0 {
+			return fmt.Errorf("%w: %v", ErrNoSuchBind, name)
+		}
+		return db.storeBinds(slices.Delete(binds, idx, idx+1))
+	})
+}
+
+func (db *DB) storeBinds(binds []Bind) error {
+	if binds == nil {
+		binds = []Bind{}
+	}
+	return db.storeJSON(&BindsFile{Version: BindsVersion, Binds: binds}, "binds")
+}
+
+// BindAccess returns all permissions, from users and their groups,
+// which reach the bind (including deny rules)
+func (db *DB) BindAccess(name string) ([]BindAccess, error) {
+	target := path.Join("/", "binds", name)
+	usernames, err := db.listKeys("users")
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string]*Group{}
+	var access []BindAccess
+	for _, username := range usernames {
+		user, err := db.FindUser(username)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range user.Permissions {
+			if p.reaches(target) {
+				access = append(access, BindAccess{User: username, Permission: p})
+			}
+		}
+		for _, gname := range user.Groups {
+			g, found := groups[gname]
+			if !found {
+				g, err = db.FindGroup(gname)
+				if errors.Is(err, ErrNoSuchKey) {
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+				groups[gname] = g
+			}
+			for _, p := range g.Permissions {
+				if p.reaches(target) {
+					access = append(access, BindAccess{User: username, Group: gname, Permission: p})
+				}
+			}
+		}
+	}
+	return access, nil
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type (
+	// Problem is a record which can not be read (eg.: truncated by a crash while
+	// it was written) or a temporary file left behind by an interrupted write
+	Problem struct {
+		Key      string `json:"key"`
+		Error    string `json:"error"`
+		Repaired bool   `json:"repaired"`
+		// MovedTo is where the record was moved by the repair
+		MovedTo string `json:"moved_to,omitempty"`
+	}
+)
+
+// Check reads every record and returns the ones which are corrupted.
+//
+// With repair, temporary files are removed and corrupted records are renamed
+// (to <key>.json.corrupt-<time>), they are treated as missing afterwards and
+// must be created again (eg.: a corrupted password is reset with auth user add).
+func (db *DB) Check(repair bool) ([]Problem, error) {
+	var problems []Problem
+	err := db.update(func() error {
+		return filepath.WalkDir(db.abs, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(db.abs, p)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			switch {
+			case d.IsDir() && rel == "state":
+				// managed outside of DB (see StatePath)
+				return filepath.SkipDir
+			case d.IsDir():
+				return nil
+			case strings.HasPrefix(d.Name(), ".") && strings.HasSuffix(d.Name(), tempSuffix):
+				pb := Problem{Key: rel, Error: "temporary file left by an interrupted write"}
+				if repair {
+					if err := os.Remove(p); err != nil {
+						return err
+					}
+					pb.Repaired = true
+				}
+				problems = append(problems, pb)
+				return nil
+			case !strings.HasSuffix(d.Name(), ".json"):
+				return nil
+			}
+			err = db.checkKey(strings.TrimSuffix(rel, ".json"))
+			if err == nil {
+				return nil
+			}
+			pb := Problem{Key: rel, Error: err.Error()}
+			if repair {
+				pb.MovedTo = rel + ".corrupt-" + time.Now().UTC().Format("20060102T150405")
+				if err := os.Rename(p, filepath.Join(db.abs, filepath.FromSlash(pb.MovedTo))); err != nil {
+					return err
+				}
+				pb.Repaired = true
+			}
+			problems = append(problems, pb)
+			return nil
+		})
+	})
+	return problems, err
+}
+
+// checkKey returns an error if the key is not valid JSON,
+// passwords are decrypted before they are checked
+func (db *DB) checkKey(key string) error {
+	var raw json.RawMessage
+	if username, found := strings.CutPrefix(key, "passwords/"); found {
+		return db.loadEncryptedJSON(&raw, append([]byte("passwords:"), []byte(username)...), key)
+	}
+	return db.loadJSON(&raw, key)
+}
@@ -11,4 +11,13 @@ func UserFromContext(ctx context.Context) *User {
 	return user
 }
 
+// UserNameFromContext returns the name of the user in ctx,
+// empty if there is none (eg.: background tasks or commands)
+func UserNameFromContext(ctx context.Context) string {
+	if user := UserFromContext(ctx); user != nil {
+		return user.Name
+	}
+	return ""
+}
+
 type userContextKey struct{}
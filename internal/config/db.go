@@ -35,13 +35,30 @@ type (
 		Admin       bool         `json:"admin"`
 		Active      bool         `json:"active"`
 		Permissions []Permission `json:"permissions,omitempty"`
+		Groups      []string     `json:"groups,omitempty"`
+		// Quota limits the content of the user home directory
+		Quota *Quota `json:"quota,omitempty"`
+
+		// groupPermissions are inherited from Groups, populated during login
+		groupPermissions []Permission
+
+		// RotateCredentials is set when the user logged in with an initial
+		// credential which must be replaced before any other access is allowed
+		RotateCredentials bool `json:"rotate_credentials,omitempty"`
 	}
 
+	// Permission grants (or denies) a set of verbs to all paths under Prefix,
+	// see Allowed for how permissions are evaluated.
 	Permission struct {
-		Prefix  string `json:"prefix"`
-		Reader  bool   `json:"reader"`
-		Writer  bool   `json:"writer"`
-		Execute bool   `json:"execute"`
+		Prefix string `json:"prefix"`
+		Verbs  []Verb `json:"verbs,omitempty"`
+		Deny   bool   `json:"deny,omitempty"`
+
+		// Deprecated: legacy flags, converted to Verbs when the user is loaded
+		// (see MigratePermissions)
+		Reader  bool `json:"reader,omitempty"`
+		Writer  bool `json:"writer,omitempty"`
+		Execute bool `json:"execute,omitempty"`
 	}
 )
 
@@ -86,27 +103,40 @@ func Open(ctx context.Context,
 	return db, nil
 }
 
-func (db *DB) InitialSetup() (bool, error) {
-	var is initialSetup
-	err := db.loadJSON(&is, "initial_setup")
-	if errors.Is(err, ErrNoSuchKey) {
-		err = nil
-	} else if err != nil {
-		return false, err
-	}
-	if is.Done {
-		slog.Warn("Initial setup already completed. Ignoring admin token")
-		return false, nil
-	}
-	if err := db.CreateUser("admin", true); err != nil {
-		return false, err
-	}
-	// if err := db.RegisterToken("admin", adminToken); err != nil {
-	// 	return err
-	// }
-	is.Done = true
-	db.storeJSON(&is, "initial_setup")
-	return is.Done, db.storeJSON("initial_setup")
+// InitialSetup creates the admin user and registers adminToken as its
+// initial credential (see RegisterToken). Returns true if the admin user was created.
+//
+// If the setup was already completed, adminToken is ignored.
+func (db *DB) InitialSetup(adminToken string) (bool, error) {
+	var created bool
+	err := db.update(func() error {
+		var is initialSetup
+		err := db.loadJSON(&is, "initial_setup")
+		if errors.Is(err, ErrNoSuchKey) {
+			err = nil
+		} else if err != nil {
+			return err
+		}
+		if is.Done {
+			slog.Warn("Initial setup already completed. Ignoring admin token")
+			return nil
+		}
+		if err := db.createUser("admin", true); err != nil {
+			return err
+		}
+		if adminToken == "" {
+			slog.Warn("No admin token provided, admin user has no credentials. Use 'auth user add --name admin' to set a password")
+		} else {
+			if err := db.registerToken("admin", adminToken); err != nil {
+				return err
+			}
+			slog.Info("Admin token registered as the initial admin credential, it must be rotated on first use")
+		}
+		is.Done = true
+		created = true
+		return db.storeJSON(&is, "initial_setup")
+	})
+	return created && err == nil, err
 }
 
 func deriveKey(seed, info, secret_salt []byte) [32]byte {
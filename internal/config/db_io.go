@@ -12,6 +12,11 @@ import (
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
+const (
+	lockFileName = "db.lock"
+	tempSuffix   = ".tmp"
+)
+
 var (
 	ErrNoSuchKey = fmt.Errorf("no such key")
 )
@@ -22,49 +27,116 @@ func (db *DB) pathToKey(parts ...string) string {
 	return fmt.Sprintf("%s.json", path)
 }
 
+// StatePath returns the local path for a file managed outside of DB
+// (eg.: lock state), parent directories are created if needed.
+func (db *DB) StatePath(parts ...string) (string, error) {
+	p := filepath.Join(db.abs, "state", filepath.FromSlash(path.Clean(path.Join(parts...))))
+	return p, os.MkdirAll(filepath.Dir(p), 0755)
+}
+
 func (db *DB) loadJSON(v interface{}, parts ...string) error {
 	path := db.pathToKey(parts...)
 	return loadJSONFile(v, path)
 }
 
-func (db *DB) storeJSON(v interface{}, parts ...string) error {
-	// storeJSON is not atomic... fix this eventually!
-	// could use a temp file with O_EXCL and then rename
-	path := db.pathToKey(parts...)
-	err := os.MkdirAll(filepath.Dir(path), 0755)
+// listKeys returns the name of all keys stored directly under the given parts
+func (db *DB) listKeys(parts ...string) ([]string, error) {
+	dir := strings.TrimSuffix(db.pathToKey(parts...), ".json")
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		keys = append(keys, strings.TrimSuffix(e.Name(), ".json"))
+	}
+	return keys, nil
+}
+
+// update runs fn while holding a lock file shared by every process using the
+// same directory (eg.: the server and the CLI), so concurrent read-modify-write
+// sequences do not overwrite each other. Keys must only be changed by fn.
+//
+// The lock is not reentrant, mutators which reuse each other call the
+// unexported variants (eg.: CreateUser and createUser) inside fn.
+func (db *DB) update(fn func() error) error {
+	unlock, err := lockFile(db.lockPath())
 	if err != nil {
 		return err
 	}
-	fd, err := os.Create(path)
+	defer unlock()
+	return fn()
+}
+
+func (db *DB) removeKey(parts ...string) error {
+	err := os.Remove(db.pathToKey(parts...))
+	if os.IsNotExist(err) {
+		return ErrNoSuchKey
+	}
+	return err
+}
+
+func (db *DB) storeJSON(v interface{}, parts ...string) error {
+	data, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		return err
 	}
-	defer fd.Close()
-	enc := json.NewEncoder(fd)
-	enc.SetIndent("", "  ")
-	return enc.Encode(v)
+	return db.writeKey(append(data, '\n'), parts...)
 }
 
 func (db *DB) storeEncryptedJSON(v interface{}, key []byte, parts ...string) error {
-	// storeEncryptedJSON is not atomic... fix this eventually!
 	extended := deriveKey(db.storageEncryptionKey[:], []byte("encrypted_json"), key)
 	jsonData, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
-	encData := encryptBuffer(&extended, jsonData)
-	path := db.pathToKey(parts...)
-	err = os.MkdirAll(filepath.Dir(path), 0755)
+	return db.writeKey(encryptBuffer(&extended, jsonData), parts...)
+}
+
+// writeKey replaces the content of the key, the caller must hold the lock (see update)
+func (db *DB) writeKey(data []byte, parts ...string) error {
+	return writeFileAtomic(db.pathToKey(parts...), data)
+}
+
+func (db *DB) lockPath() string {
+	return filepath.Join(db.abs, lockFileName)
+}
+
+// writeFileAtomic writes data to a temporary file which replaces path once
+// it is synced to disk, so a crash never leaves a partially written file
+// (see DB.Check for the temporary files left behind)
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*"+tempSuffix)
 	if err != nil {
 		return err
 	}
-	fd, err := os.Create(path)
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return err
 	}
-	defer fd.Close()
-	_, err = fd.Write(encData)
-	return err
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
 }
 
 func (db *DB) loadEncryptedJSON(v interface{}, key []byte, parts ...string) error {
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package config
+
+import "sync"
+
+// fileLock only serialises the writers of this process,
+// other processes are not aware of it
+var fileLock sync.Mutex
+
+func lockFile(path string) (func(), error) {
+	fileLock.Lock()
+	return fileLock.Unlock, nil
+}
+
+// syncDir is a no-op, directories can not be synced on every platform
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	t.Setenv("DAVD_SEED_KEY", strings.Repeat("ab", 32))
+	db, err := Open(context.Background(), t.TempDir(), os.Getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestCheckRepair(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.CreateUser("alice", false); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"users/bob.json":                `{"name": "bob"`,
+		"passwords/carol.json":          "not encrypted",
+		"users/.alice.json.123.tmp":     `{"name": "alice"}`,
+		"state/locks.json":              "not checked",
+		"state/.locks.json.123.tmp":     "not checked",
+		"quotas/binds/scratch.json.bak": "not a record",
+	}
+	for name, content := range files {
+		p := filepath.Join(db.abs, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := db.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]Problem{}
+	for _, pb := range problems {
+		found[pb.Key] = pb
+	}
+	if len(found) != 3 || found["users/bob.json"].Repaired || found["passwords/carol.json"].Key == "" || found["users/.alice.json.123.tmp"].Key == "" {
+		t.Fatalf("unexpected problems: %+v", problems)
+	}
+	for name := range files {
+		if _, err := os.Stat(filepath.Join(db.abs, filepath.FromSlash(name))); err != nil {
+			t.Fatalf("check without repair changed %v: %v", name, err)
+		}
+	}
+
+	problems, err = db.Check(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pb := range problems {
+		if !pb.Repaired {
+			t.Fatalf("%v was not repaired", pb.Key)
+		}
+		if strings.HasSuffix(pb.Key, ".json") && !strings.HasPrefix(pb.MovedTo, pb.Key+".corrupt-") {
+			t.Fatalf("%v moved to %v", pb.Key, pb.MovedTo)
+		}
+		if pb.MovedTo != "" {
+			if _, err := os.Stat(filepath.Join(db.abs, filepath.FromSlash(pb.MovedTo))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(db.abs, filepath.FromSlash(pb.Key))); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%v was not removed: %v", pb.Key, err)
+		}
+	}
+	if _, err := db.FindUser("bob"); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatalf("corrupted user is still found: %v", err)
+	}
+	if _, err := db.FindUser("alice"); err != nil {
+		t.Fatalf("valid user was changed: %v", err)
+	}
+	if problems, err := db.Check(false); err != nil || len(problems) != 0 {
+		t.Fatalf("problems left after repair: %+v, %v", problems, err)
+	}
+}
+
+func TestUpdateSerializes(t *testing.T) {
+	db := openTestDB(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for range cap(errs) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- db.update(func() error {
+				var counter int
+				if err := db.loadJSON(&counter, "test", "counter"); err != nil && !errors.Is(err, ErrNoSuchKey) {
+					return err
+				}
+				return db.storeJSON(counter+1, "test", "counter")
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var counter int
+	if err := db.loadJSON(&counter, "test", "counter"); err != nil {
+		t.Fatal(err)
+	}
+	if counter != cap(errs) {
+		t.Fatalf("counter is %v, expected %v", counter, cap(errs))
+	}
+	entries, err := os.ReadDir(filepath.Join(db.abs, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("temporary files left behind: %v", entries)
+	}
+}
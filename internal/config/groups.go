@@ -0,0 +1,168 @@
+package config
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+)
+
+type (
+	// Group grants its permissions to all of its members
+	Group struct {
+		Name        string       `json:"name"`
+		Description string       `json:"description,omitempty"`
+		Permissions []Permission `json:"permissions,omitempty"`
+	}
+)
+
+var (
+	ErrInvalidGroupName = errors.New("invalid group name")
+)
+
+func (db *DB) CreateGroup(name, description string) error {
+	return db.update(func() error {
+		if !ValidUsername(name) {
+			return ErrInvalidGroupName
+		}
+		if _, err := db.FindGroup(name); err == nil {
+			return errors.New("group already exists")
+		}
+		g := Group{
+			Name:        name,
+			Description: description,
+			Permissions: []Permission{},
+		}
+		return db.storeJSON(&g, "groups", name)
+	})
+}
+
+func (db *DB) FindGroup(name string) (*Group, error) {
+	var g Group
+	err := db.loadJSON(&g, "groups", name)
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (db *DB) ListGroups() ([]string, error) {
+	return db.listKeys("groups")
+}
+
+// DeleteGroup removes the group and its membership from all users
+func (db *DB) DeleteGroup(name string) error {
+	return db.update(func() error {
+		members, err := db.GroupMembers(name)
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if err := db.removeGroupMember(name, m); err != nil {
+				return err
+			}
+		}
+		return db.removeKey("groups", name)
+	})
+}
+
+// UpdateGroupPermissions adds permissions to the given group,
+// using the same merge rules as UpdatePermissions
+func (db *DB) UpdateGroupPermissions(name string, permissions []Permission) error {
+	return db.update(func() error {
+		g, err := db.FindGroup(name)
+		if err != nil {
+			return err
+		}
+		g.Permissions = mergePermissions(g.Permissions, permissions)
+		return db.storeJSON(g, "groups", name)
+	})
+}
+
+func (db *DB) AddGroupMember(group, username string) error {
+	return db.update(func() error {
+		if _, err := db.FindGroup(group); err != nil {
+			return err
+		}
+		user, err := db.FindUser(username)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(user.Groups, group) {
+			return nil
+		}
+		user.Groups = append(user.Groups, group)
+		slices.Sort(user.Groups)
+		return db.storeJSON(user, "users", username)
+	})
+}
+
+func (db *DB) RemoveGroupMember(group, username string) error {
+	return db.update(func() error {
+		return db.removeGroupMember(group, username)
+	})
+}
+
+func (db *DB) removeGroupMember(group, username string) error {
+	user, err := db.FindUser(username)
+	if err != nil {
+		return err
+	}
+	idx := slices.Index(user.Groups, group)
+	if idx < 0 {
+		return nil
+	}
+	user.Groups = slices.Delete(user.Groups, idx, idx+1)
+	return db.storeJSON(user, "users", username)
+}
+
+// GroupMembers returns the name of all users in the group
+func (db *DB) GroupMembers(group string) ([]string, error) {
+	if _, err := db.FindGroup(group); err != nil {
+		return nil, err
+	}
+	names, err := db.listKeys("users")
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	for _, n := range names {
+		user, err := db.FindUser(n)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(user.Groups, group) {
+			members = append(members, n)
+		}
+	}
+	return members, nil
+}
+
+// FindEffectiveUser returns the user along with the permissions
+// inherited from its groups (see User.EffectivePermissions)
+func (db *DB) FindEffectiveUser(name string) (*User, error) {
+	user, err := db.FindUser(name)
+	if err != nil {
+		return nil, err
+	}
+	return user, db.loadGroupPermissions(user)
+}
+
+// loadGroupPermissions populates the permissions the user inherits
+// from its groups, missing groups are ignored
+func (db *DB) loadGroupPermissions(user *User) error {
+	user.groupPermissions = nil
+	for _, name := range user.Groups {
+		g, err := db.FindGroup(name)
+		if errors.Is(err, ErrNoSuchKey) {
+			slog.Warn("User is member of a group which does not exist", "user", user.Name, "group", name)
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, p := range g.Permissions {
+			p.migrate()
+			user.groupPermissions = append(user.groupPermissions, p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+type (
+	// Quota limits how much data can be stored, zero means unlimited
+	Quota struct {
+		MaxBytes int64 `json:"max_bytes,omitempty"`
+		MaxFiles int64 `json:"max_files,omitempty"`
+	}
+)
+
+var (
+	ErrInvalidBindName = errors.New("invalid bind name")
+)
+
+// Unlimited returns true if q does not impose any limit
+func (q Quota) Unlimited() bool {
+	return q.MaxBytes <= 0 && q.MaxFiles <= 0
+}
+
+// UserQuota returns the quota for the user home directory
+func (db *DB) UserQuota(username string) (Quota, error) {
+	user, err := db.FindUser(username)
+	if err != nil {
+		return Quota{}, err
+	}
+	if user.Quota == nil {
+		return Quota{}, nil
+	}
+	return *user.Quota, nil
+}
+
+func (db *DB) SetUserQuota(username string, q Quota) error {
+	return db.update(func() error {
+		user, err := db.FindUser(username)
+		if err != nil {
+			return err
+		}
+		user.Quota = &q
+		if q.Unlimited() {
+			user.Quota = nil
+		}
+		return db.storeJSON(user, "users", username)
+	})
+}
+
+// BindQuota returns the quota for the bind, identified by its URL prefix
+// (eg.: binds/scratch or home)
+func (db *DB) BindQuota(bind string) (Quota, error) {
+	bind, err := cleanBindName(bind)
+	if err != nil {
+		return Quota{}, err
+	}
+	var q Quota
+	err = db.loadJSON(&q, "quotas", bind)
+	if errors.Is(err, ErrNoSuchKey) {
+		return Quota{}, nil
+	}
+	return q, err
+}
+
+func (db *DB) SetBindQuota(bind string, q Quota) error {
+	return db.update(func() error {
+		bind, err := cleanBindName(bind)
+		if err != nil {
+			return err
+		}
+		if q.Unlimited() {
+			err := db.removeKey("quotas", bind)
+			if errors.Is(err, ErrNoSuchKey) {
+				return nil
+			}
+			return err
+		}
+		return db.storeJSON(&q, "quotas", bind)
+	})
+}
+
+func cleanBindName(bind string) (string, error) {
+	bind = strings.Trim(path.Clean("/"+bind), "/")
+	if bind == "" {
+		return "", ErrInvalidBindName
+	}
+	return bind, nil
+}
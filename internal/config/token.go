@@ -2,6 +2,7 @@ package config
 
 import (
 	"errors"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -17,3 +18,23 @@ type (
 func (db *DB) decodeToken(info *TokenInfo) error {
 	return errors.ErrUnsupported
 }
+
+// Raw returns the signed token as it should be sent in a Bearer header
+func (t TokenInfo) Raw() string {
+	return t.raw
+}
+
+func (t TokenInfo) Subject() string {
+	return t.claims.Subject
+}
+
+func (t TokenInfo) ID() string {
+	return t.claims.ID
+}
+
+func (t TokenInfo) ExpiresAt() time.Time {
+	if t.claims.ExpiresAt == nil {
+		return time.Time{}
+	}
+	return t.claims.ExpiresAt.Time
+}
@@ -0,0 +1,276 @@
+package drive
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/andrebq/davd/internal/audit"
+	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/storage"
+	"github.com/andrebq/davd/internal/trash"
+)
+
+type (
+	// selection is an entry of the directory selected for an action,
+	// src and dst are relative to the bind
+	selection struct {
+		src, dst string
+		info     os.FileInfo
+	}
+
+	confirmData struct {
+		Action      string
+		Bind        string
+		Dir         string
+		URL         string
+		Names       []string
+		Destination string
+		Trash       bool
+	}
+)
+
+// handleAction deletes, moves or copies the entries selected in the directory,
+// nothing is changed until the request is confirmed (see page/confirm)
+func (h *handler) handleAction(bind, action string, w http.ResponseWriter, r *http.Request) {
+	b := h.bindings[bind]
+	dir := path.Clean("/" + r.URL.Path)
+	entry := audit.FromContext(r.Context())
+	entry.Path = path.Join("/", bind, dir)
+
+	if st, err := b.FS.Stat(r.Context(), dir); err != nil || !st.IsDir() {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+	var names []string
+	for _, n := range r.Form["name"] {
+		n = path.Base(path.Clean("/" + n))
+		if n == "/" {
+			continue
+		}
+		names = append(names, n)
+	}
+	if len(names) == 0 {
+		http.Error(w, "No files selected", http.StatusBadRequest)
+		return
+	}
+	var dstDir string
+	switch action {
+	case "delete":
+	case "move", "copy":
+		if d := strings.TrimSpace(r.FormValue("destination")); d != "" {
+			dstDir = path.Clean("/" + d)
+			entry.Destination = path.Join("/", bind, dstDir)
+		}
+	default:
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("confirm") != "yes" || (action != "delete" && dstDir == "") {
+		h.renderConfirm(confirmData{
+			Action:      action,
+			Bind:        bind,
+			Dir:         dir,
+			URL:         path.Join("/drive", bind, dir) + "/",
+			Names:       names,
+			Destination: dstDir,
+			Trash:       b.Trash != nil,
+		}, w)
+		return
+	}
+	if action != "delete" {
+		if st, err := b.FS.Stat(r.Context(), dstDir); err != nil || !st.IsDir() {
+			http.Error(w, fmt.Sprintf("Destination %v is not a directory", dstDir), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var selected []selection
+	for _, n := range names {
+		s := selection{src: path.Join(dir, n)}
+		if dstDir != "" {
+			s.dst = path.Join(dstDir, n)
+		}
+		var err error
+		s.info, err = b.FS.Stat(r.Context(), s.src)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%v not found", s.src), http.StatusNotFound)
+			return
+		}
+		if !h.checkAction(bind, action, s, w, r) {
+			return
+		}
+		selected = append(selected, s)
+	}
+
+	for _, s := range selected {
+		if !h.applyAction(bind, action, s, w, r) {
+			return
+		}
+	}
+	http.Redirect(w, r, path.Join("/drive", bind, dir)+"/", http.StatusSeeOther)
+}
+
+// checkAction verifies permissions, bind mode and conflicts of s
+// before anything is changed
+func (h *handler) checkAction(bind, action string, s selection, w http.ResponseWriter, r *http.Request) bool {
+	b := h.bindings[bind]
+	var ok bool
+	var verb config.Verb
+	switch action {
+	case "delete":
+		verb = config.VerbDelete
+		ok = allowedTree(r, b, bind, s, config.VerbDelete, "")
+	case "move":
+		verb = config.VerbMove
+		ok = allowedTree(r, b, bind, s, config.VerbMove, config.VerbCreate)
+	case "copy":
+		verb = config.VerbCreate
+		ok = allowedTree(r, b, bind, s, config.VerbRead, config.VerbCreate)
+	}
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	if !checkMode(w, b.Mode, verb, path.Join("/", bind, s.src)) {
+		return false
+	}
+	if s.dst == "" {
+		return true
+	}
+	if s.dst == s.src || strings.HasPrefix(s.dst, s.src+"/") {
+		http.Error(w, fmt.Sprintf("Cannot %v %v into itself", action, s.src), http.StatusBadRequest)
+		return false
+	}
+	if _, err := b.FS.Stat(r.Context(), s.dst); err == nil {
+		http.Error(w, fmt.Sprintf("%v already exists", s.dst), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+func (h *handler) applyAction(bind, action string, s selection, w http.ResponseWriter, r *http.Request) bool {
+	b := h.bindings[bind]
+	ctx := r.Context()
+	src, dst := path.Join("/", bind, s.src), path.Join("/", bind, s.dst)
+	lockSrc, lockDst := s.src, s.dst
+	if action == "copy" {
+		// the source is only read
+		lockSrc, lockDst = s.dst, ""
+	}
+	release, err := h.confirmLocks(bind, r, lockSrc, lockDst)
+	if err != nil {
+		writeLockError(w, err)
+		return false
+	}
+	defer release()
+
+	switch action {
+	case "delete":
+		defer h.quotas.Invalidate(src)
+		if b.Trash != nil {
+			_, err = b.Trash.Put(ctx, s.src, trash.ReasonDelete)
+		} else {
+			slog.Info("Removing", "bind", bind, "path", s.src, "user", config.UserNameFromContext(ctx))
+			err = b.FS.RemoveAll(ctx, s.src)
+		}
+	case "move":
+		bytes, files := usage(ctx, b, s)
+		if !quotaAllows(w, dst, h.quotas.CheckTransfer(config.UserNameFromContext(ctx), src, dst, bytes, files)) {
+			return false
+		}
+		defer h.quotas.Invalidate(src)
+		defer h.quotas.Invalidate(dst)
+		// the destination does not exist (see checkAction)
+		defer h.quotas.Charge(config.UserNameFromContext(ctx), dst)
+		slog.Info("Moving", "bind", bind, "from", s.src, "to", s.dst, "user", config.UserNameFromContext(ctx))
+		err = b.FS.Rename(ctx, s.src, s.dst)
+	case "copy":
+		bytes, files := usage(ctx, b, s)
+		if !h.checkQuota(w, r, dst, bytes, files) {
+			return false
+		}
+		defer h.quotas.Invalidate(dst)
+		defer h.quotas.Charge(config.UserNameFromContext(ctx), dst)
+		slog.Info("Copying", "bind", bind, "from", s.src, "to", s.dst, "user", config.UserNameFromContext(ctx))
+		err = copyTree(ctx, b, s.src, s.dst)
+	}
+	if err != nil {
+		slog.Error("Failed to "+action, "bind", bind, "path", s.src, "destination", s.dst, "error", err)
+		http.Error(w, fmt.Sprintf("Unable to %v %v: %v", action, s.src, err), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// allowedTree checks srcVerb on s.src and every entry under it, and dstVerb
+// on where each entry ends up (if dstVerb is not empty), so a rule denying
+// access to an entry is not bypassed by selecting one of its parents
+func allowedTree(r *http.Request, b Bind, bind string, s selection, srcVerb, dstVerb config.Verb) bool {
+	check := func(name string) bool {
+		if !allowed(r, bind, srcVerb, name) {
+			return false
+		}
+		return dstVerb == "" || allowed(r, bind, dstVerb, path.Join(s.dst, strings.TrimPrefix(name, s.src)))
+	}
+	if !check(s.src) {
+		return false
+	}
+	if s.info == nil || !s.info.IsDir() {
+		return true
+	}
+	err := storage.Walk(r.Context(), b.FS, s.src, func(name string, _ os.FileInfo) error {
+		if !check(name) {
+			slog.Warn("Action refused, entry not allowed", "bind", bind, "path", name, "verb", srcVerb, "user", config.UserNameFromContext(r.Context()))
+			return os.ErrPermission
+		}
+		return nil
+	})
+	return err == nil
+}
+
+// usage returns the bytes and files under s
+func usage(ctx context.Context, b Bind, s selection) (bytes, files int64) {
+	if !s.info.IsDir() {
+		return s.info.Size(), 1
+	}
+	storage.Walk(ctx, b.FS, s.src, func(_ string, fi os.FileInfo) error {
+		if !fi.IsDir() {
+			bytes += fi.Size()
+		}
+		files++
+		return nil
+	})
+	return bytes, files
+}
+
+// copyTree copies src (a file or directory) to dst, which must not exist
+func copyTree(ctx context.Context, b Bind, src, dst string) error {
+	return storage.Walk(ctx, b.FS, src, func(name string, fi os.FileInfo) error {
+		target := path.Join(dst, strings.TrimPrefix(name, src))
+		if fi.IsDir() {
+			return b.FS.Mkdir(ctx, target, 0755)
+		}
+		return storage.CopyFile(ctx, b.FS, name, target)
+	})
+}
+
+func (h *handler) renderConfirm(cd confirmData, w http.ResponseWriter) {
+	buf := &strings.Builder{}
+	err := templates.ExecuteTemplate(buf, "page/confirm", cd)
+	if err != nil {
+		slog.Error("Failed to render template", "bind", cd.Bind, "error", err)
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", buf.Len()))
+	_, err = w.Write([]byte(buf.String()))
+	if err != nil {
+		slog.Error("Failed to write response", "bind", cd.Bind, "error", err)
+	}
+}
@@ -0,0 +1,202 @@
+(function () {
+  // Client for the drive upload session API (see drive.handleUpload).
+  //
+  // Sessions are remembered in localStorage, so an upload interrupted by
+  // a reload (or a closed tab) resumes from the chunks already received.
+
+  const chunkSize = 8 << 20;
+
+  class DriveUpload {
+    constructor(params) {
+      this.endpoint = params.endpoint;
+      this.file = params.file;
+      this.retries = params.retries || 5;
+      this.delayBeforeRetry = params.delayBeforeRetry || 2;
+      this.paused = false;
+      this._key =
+        "davd-upload:" +
+        this.endpoint +
+        ":" +
+        this.file.size +
+        ":" +
+        this.file.lastModified;
+      this._eventTarget = new EventTarget();
+      this._resume = null;
+      this._run().catch((err) => this._emit("error", err));
+    }
+
+    on(name, fn) {
+      this._eventTarget.addEventListener(name, fn);
+    }
+
+    togglePause() {
+      this.paused = !this.paused;
+      if (!this.paused && this._resume) {
+        const resume = this._resume;
+        this._resume = null;
+        resume();
+      }
+    }
+
+    _emit(name, detail) {
+      this._eventTarget.dispatchEvent(new CustomEvent(name, { detail }));
+    }
+
+    async _run() {
+      let session = await this._session();
+      const missing = [];
+      for (let n = 0; n < Math.ceil(session.size / session.chunk_size); n++) {
+        if (!session.received.includes(n)) missing.push(n);
+      }
+      let done = session.received.length;
+      const total = done + missing.length;
+      for (const n of missing) {
+        if (this.paused) await new Promise((r) => (this._resume = r));
+        await this._retry(() => this._putChunk(session, n), n);
+        done++;
+        this._emit("progress", Math.floor((done / total) * 100));
+      }
+      const res = await fetch(this._url(session.id, "complete"), {
+        method: "POST",
+      });
+      if (!res.ok) throw new Error(await res.text());
+      localStorage.removeItem(this._key);
+      this._emit("finish", await res.json());
+    }
+
+    // _session resumes the previous session of the same file or creates a new one
+    async _session() {
+      const id = localStorage.getItem(this._key);
+      if (id) {
+        const res = await fetch(this._url(id));
+        if (res.ok) return res.json();
+        localStorage.removeItem(this._key);
+      }
+      const res = await fetch(this.endpoint + "?uploads", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ size: this.file.size, chunk_size: chunkSize }),
+      });
+      if (!res.ok) throw new Error(await res.text());
+      const session = await res.json();
+      localStorage.setItem(this._key, session.id);
+      return session;
+    }
+
+    async _putChunk(session, n) {
+      const start = n * session.chunk_size;
+      const data = await this.file
+        .slice(start, start + session.chunk_size)
+        .arrayBuffer();
+      const res = await fetch(this._url(session.id) + "&chunk=" + n, {
+        method: "PUT",
+        headers: { "X-Chunk-SHA256": await sha256(data) },
+        body: data,
+      });
+      if (!res.ok) throw new Error(await res.text());
+    }
+
+    async _retry(fn, n) {
+      for (let left = this.retries; ; left--) {
+        try {
+          return await fn();
+        } catch (err) {
+          if (left <= 0) throw err;
+          this._emit("fileRetry", { chunk: n, retriesLeft: left });
+          await new Promise((r) => setTimeout(r, this.delayBeforeRetry * 1000));
+        }
+      }
+    }
+
+    _url(id, op) {
+      return (
+        this.endpoint +
+        "?upload=" +
+        encodeURIComponent(id) +
+        (op ? "&" + op : "")
+      );
+    }
+  }
+
+  async function sha256(data) {
+    const bytes = new Uint8Array(
+      window.crypto && crypto.subtle
+        ? await crypto.subtle.digest("SHA-256", data)
+        : sha256Fallback(new Uint8Array(data)),
+    );
+    return Array.from(bytes, (b) => b.toString(16).padStart(2, "0")).join("");
+  }
+
+  // crypto.subtle is only available in secure contexts (https or localhost)
+  function sha256Fallback(msg) {
+    const K = new Uint32Array([
+      0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1,
+      0x923f82a4, 0xab1c5ed5, 0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3,
+      0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174, 0xe49b69c1, 0xefbe4786,
+      0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+      0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147,
+      0x06ca6351, 0x14292967, 0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13,
+      0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85, 0xa2bfe8a1, 0xa81a664b,
+      0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+      0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a,
+      0x5b9cca4f, 0x682e6ff3, 0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208,
+      0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+    ]);
+    const H = new Uint32Array([
+      0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c,
+      0x1f83d9ab, 0x5be0cd19,
+    ]);
+    const len = Math.ceil((msg.length + 9) / 64) * 64;
+    const buf = new Uint8Array(len);
+    buf.set(msg);
+    buf[msg.length] = 0x80;
+    const view = new DataView(buf.buffer);
+    view.setUint32(len - 8, Math.floor(msg.length / 0x20000000));
+    view.setUint32(len - 4, msg.length * 8);
+    const w = new Uint32Array(64);
+    const rotr = (x, n) => (x >>> n) | (x << (32 - n));
+    for (let off = 0; off < len; off += 64) {
+      for (let i = 0; i < 16; i++) w[i] = view.getUint32(off + i * 4);
+      for (let i = 16; i < 64; i++) {
+        const s0 = rotr(w[i - 15], 7) ^ rotr(w[i - 15], 18) ^ (w[i - 15] >>> 3);
+        const s1 = rotr(w[i - 2], 17) ^ rotr(w[i - 2], 19) ^ (w[i - 2] >>> 10);
+        w[i] = w[i - 16] + s0 + w[i - 7] + s1;
+      }
+      let [a, b, c, d, e, f, g, h] = H;
+      for (let i = 0; i < 64; i++) {
+        const t1 =
+          (h +
+            (rotr(e, 6) ^ rotr(e, 11) ^ rotr(e, 25)) +
+            ((e & f) ^ (~e & g)) +
+            K[i] +
+            w[i]) >>>
+          0;
+        const t2 =
+          ((rotr(a, 2) ^ rotr(a, 13) ^ rotr(a, 22)) +
+            ((a & b) ^ (a & c) ^ (b & c))) >>>
+          0;
+        h = g;
+        g = f;
+        f = e;
+        e = (d + t1) >>> 0;
+        d = c;
+        c = b;
+        b = a;
+        a = (t1 + t2) >>> 0;
+      }
+      H[0] += a;
+      H[1] += b;
+      H[2] += c;
+      H[3] += d;
+      H[4] += e;
+      H[5] += f;
+      H[6] += g;
+      H[7] += h;
+    }
+    const out = new DataView(new ArrayBuffer(32));
+    H.forEach((v, i) => out.setUint32(i * 4, v));
+    return out.buffer;
+  }
+
+  window.DriveUpload = DriveUpload;
+})();
@@ -8,24 +8,79 @@ import (
 	"net/http"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
+
+	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/locks"
+	"github.com/andrebq/davd/internal/quota"
+	"github.com/andrebq/davd/internal/trash"
+	"github.com/andrebq/davd/internal/uploads"
+	"github.com/andrebq/davd/internal/versions"
+	"golang.org/x/net/webdav"
 )
 
 type (
-	Bindings map[string]string
+	// Bindings are keyed by the URL prefix of the bind (eg.: binds/scratch),
+	// the same key is used as the lock namespace, so WebDAV and drive share their locks.
+	Bindings map[string]Bind
+
+	Bind struct {
+		FS   webdav.FileSystem
+		Mode config.BindMode
+		// Trash receives deleted and overwritten files, nil if the bind has no trash
+		Trash *trash.Bin
+		// Versions keeps overwritten files instead of the trash, nil if the bind is not versioned
+		Versions *versions.Store
+		// Uploads stages resumable uploads, nil if not supported
+		Uploads *uploads.Store
+		// PerUser binds contain one directory per user (eg.: home),
+		// links to the bind point to the directory of the current user
+		PerUser     bool
+		Description string
+	}
+
+	// Options contains the services shared with the WebDAV handlers
+	Options struct {
+		Locks  *locks.System
+		Quotas *quota.Manager
+		// MaxMemory limits the size of the forms parsed in memory, zero removes the limit
+		MaxMemory int64
+	}
 
 	handler struct {
-		muxer    *http.ServeMux
-		bindings Bindings
+		muxer     *http.ServeMux
+		bindings  Bindings
+		locks     *locks.System
+		quotas    *quota.Manager
+		maxMemory int64
 	}
 
 	dirData struct {
-		Path      string
-		Localpath string
-		Basename  string
-		Files     []string
-		Dirs      []string
+		Path     string
+		Basename string
+		Entries  []entry
+		Listing  listing
+		Quota    *quota.Status
+		Mode     config.BindMode
+		Trash    bool
+		Crumbs   crumbs
+	}
+
+	fileData struct {
+		os.FileInfo
+		Versioned bool
+		Versions  []versions.Version
+		Mode      config.BindMode
+		Crumbs    crumbs
+	}
+
+	trashData struct {
+		Bind string
+		// Location is the bind and directory whose trash is listed
+		Location string
+		Items    []trash.Item
+		Mode     config.BindMode
+		Crumbs   crumbs
 	}
 )
 
@@ -40,20 +95,20 @@ func AssetsHandler() http.Handler {
 	return http.FileServer(http.FS(sub))
 }
 
-func NewHandler(bindings Bindings) (http.Handler, error) {
+func NewHandler(bindings Bindings, opts Options) (http.Handler, error) {
 	muxer := http.NewServeMux()
 	h := handler{
-		muxer:    muxer,
-		bindings: bindings,
-	}
-	for bind, localPath := range bindings {
-		fn, err := h.serveBind(bind)
-		if err != nil {
-			return nil, fmt.Errorf("unable to setup handler for bind %v (%v): %w", bind, bindings[bind], err)
-		}
-		muxer.Handle(fmt.Sprintf("POST /%v/", bind), http.StripPrefix(fmt.Sprintf("/%v", bind), h.handlePost(bind, localPath)))
-		muxer.Handle(fmt.Sprintf("PUT /%v/", bind), http.StripPrefix(fmt.Sprintf("/%v", bind), h.handlePut(bind, localPath)))
-		muxer.HandleFunc(fmt.Sprintf("GET /%v/", bind), fn)
+		muxer:     muxer,
+		bindings:  bindings,
+		locks:     opts.Locks,
+		quotas:    opts.Quotas,
+		maxMemory: opts.MaxMemory,
+	}
+	muxer.HandleFunc("GET /{$}", h.renderBinds)
+	for bind := range bindings {
+		muxer.Handle(fmt.Sprintf("POST /%v/", bind), http.StripPrefix(fmt.Sprintf("/%v", bind), h.handlePost(bind)))
+		muxer.Handle(fmt.Sprintf("PUT /%v/", bind), http.StripPrefix(fmt.Sprintf("/%v", bind), h.handlePut(bind)))
+		muxer.HandleFunc(fmt.Sprintf("GET /%v/", bind), h.serveBind(bind))
 	}
 
 	return muxer, nil
@@ -63,70 +118,75 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.muxer.ServeHTTP(w, r)
 }
 
-func (h *handler) serveBind(bind string) (func(w http.ResponseWriter, r *http.Request), error) {
-	localPath := h.bindings[bind]
-	var err error
-	localPath, err = filepath.Abs(localPath)
-	if err != nil {
-		return nil, fmt.Errorf("unable to get absolute path for bind %v (%v): %w", bind, localPath, err)
-	}
+func (h *handler) serveBind(bind string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		h.handleFileRequest(path.Clean(fmt.Sprintf("/%v/", bind)), localPath, w, r)
-	}, nil
+		h.handleFileRequest(bind, w, r)
+	}
 }
 
-func (h *handler) handleFileRequest(bindPrefix string, localPath string, w http.ResponseWriter, r *http.Request) {
-	localAbs := filepath.Join(localPath, filepath.FromSlash(strings.TrimPrefix(path.Clean(r.URL.Path), bindPrefix)))
-	stat, err := os.Lstat(localAbs)
+func (h *handler) handleFileRequest(bind string, w http.ResponseWriter, r *http.Request) {
+	b := h.bindings[bind]
+	name := path.Clean("/" + strings.TrimPrefix(path.Clean(r.URL.Path), "/"+bind))
+	if isUpload(r) {
+		h.handleUpload(bind, name, w, r)
+		return
+	}
+	stat, err := b.FS.Stat(r.Context(), name)
 	if err != nil {
-		slog.Debug("File not found", "localAbs", localAbs)
+		slog.Debug("File not found", "bind", bind, "name", name)
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
+	if stat.IsDir() && b.Trash != nil && r.URL.Query().Has("trash") {
+		h.renderTrash(bind, name, w, r)
+		return
+	}
 	if stat.IsDir() {
 		// check if the url path ends with a slash, if not, force a redirect
 		if !strings.HasSuffix(r.URL.Path, "/") {
 			http.Redirect(w, r, fmt.Sprintf("/drive/%v/", r.URL.Path), http.StatusSeeOther)
 			return
 		}
-		h.renderDir(stat, localAbs, w, r)
+		h.renderDir(bind, name, w, r)
 		return
 	}
-	h.renderFile(stat, localAbs, w, r)
+	h.renderFile(stat, bind, name, w, r)
 }
 
-func (h *handler) renderDir(stat os.FileInfo, localAbs string, w http.ResponseWriter, r *http.Request) {
+func (h *handler) renderDir(bind, name string, w http.ResponseWriter, r *http.Request) {
+	b := h.bindings[bind]
+	basename := path.Base(name)
+	if name == "/" {
+		basename = path.Base(bind)
+	}
 	dd := dirData{
-		Path:      r.URL.Path,
-		Basename:  filepath.Base(localAbs),
-		Localpath: localAbs,
-		Files:     []string{},
-		Dirs:      []string{},
+		Mode:     b.Mode,
+		Trash:    b.Trash != nil,
+		Path:     r.URL.Path,
+		Basename: basename,
+		Listing:  parseListing(r.URL.Query()),
+		Crumbs:   h.breadcrumbs(bind, name),
+	}
+	if st, found, err := h.quotas.Status(config.UserNameFromContext(r.Context()), r.URL.Path); err != nil {
+		slog.Error("Failed to compute quota", "path", r.URL.Path, "error", err)
+	} else if found {
+		dd.Quota = &st
+	}
+	user := config.UserFromContext(r.Context())
+	visible := func(fi os.FileInfo) bool {
+		return user.Reaches(path.Join("/", bind, name, fi.Name()))
 	}
-	err := filepath.WalkDir(localAbs, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if path == localAbs {
-			return nil
-		}
-		if d.IsDir() {
-			dd.Dirs = append(dd.Dirs, filepath.Base(d.Name()))
-			return filepath.SkipDir
-		} else {
-			dd.Files = append(dd.Files, filepath.Base(d.Name()))
-		}
-		return nil
-	})
+	var err error
+	dd.Entries, err = readPage(r.Context(), b.FS, name, visible, &dd.Listing)
 	if err != nil {
-		slog.Error("Failed to read directory", "localAbs", localAbs, "error", err)
+		slog.Error("Failed to read directory", "bind", bind, "name", name, "error", err)
 		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
 		return
 	}
 	buf := &strings.Builder{}
 	err = templates.ExecuteTemplate(buf, "page/directory", dd)
 	if err != nil {
-		slog.Error("Failed to render template", "localAbs", localAbs, "error", err)
+		slog.Error("Failed to render template", "bind", bind, "name", name, "error", err)
 		http.Error(w, "Failed to render template", http.StatusInternalServerError)
 		return
 	}
@@ -134,21 +194,33 @@ func (h *handler) renderDir(stat os.FileInfo, localAbs string, w http.ResponseWr
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", buf.Len()))
 	_, err = w.Write([]byte(buf.String()))
 	if err != nil {
-		slog.Error("Failed to write response", "localAbs", localAbs, "error", err)
+		slog.Error("Failed to write response", "bind", bind, "name", name, "error", err)
 		return
 	}
 }
 
-func (h *handler) renderFile(stat os.FileInfo, localAbs string, w http.ResponseWriter, r *http.Request) {
+func (h *handler) renderFile(stat os.FileInfo, bind, name string, w http.ResponseWriter, r *http.Request) {
 	if r.URL.Query().Get("download") == "true" {
-		h.downloadFile(stat, localAbs, w, r)
+		if id := r.URL.Query().Get("version"); id != "" {
+			h.downloadVersion(bind, name, id, w, r)
+			return
+		}
+		h.downloadFile(stat, bind, name, w, r)
 		return
 	}
+	b := h.bindings[bind]
+	fd := fileData{FileInfo: stat, Mode: b.Mode, Versioned: b.Versions != nil, Crumbs: h.breadcrumbs(bind, name)}
 	var err error
+	if b.Versions != nil {
+		fd.Versions, err = b.Versions.List(r.Context(), name)
+		if err != nil {
+			slog.Error("Failed to list versions", "bind", bind, "name", name, "error", err)
+		}
+	}
 	buf := &strings.Builder{}
-	err = templates.ExecuteTemplate(buf, "page/file", stat)
+	err = templates.ExecuteTemplate(buf, "page/file", fd)
 	if err != nil {
-		slog.Error("Failed to render template", "localAbs", localAbs, "error", err)
+		slog.Error("Failed to render template", "bind", bind, "name", name, "error", err)
 		http.Error(w, "Failed to render template", http.StatusInternalServerError)
 		return
 	}
@@ -156,20 +228,20 @@ func (h *handler) renderFile(stat os.FileInfo, localAbs string, w http.ResponseW
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", buf.Len()))
 	_, err = w.Write([]byte(buf.String()))
 	if err != nil {
-		slog.Error("Failed to write response", "localAbs", localAbs, "error", err)
+		slog.Error("Failed to write response", "bind", bind, "name", name, "error", err)
 		return
 	}
 }
 
-func (h *handler) downloadFile(stat os.FileInfo, localAbs string, w http.ResponseWriter, r *http.Request) {
+func (h *handler) downloadFile(stat os.FileInfo, bind, name string, w http.ResponseWriter, r *http.Request) {
 	mtime := stat.ModTime()
-	fd, err := os.Open(localAbs)
+	fd, err := h.bindings[bind].FS.OpenFile(r.Context(), name, os.O_RDONLY, 0)
 	if err != nil {
-		slog.Error("Failed to open file for download", "localAbs", localAbs, "error", err)
+		slog.Error("Failed to open file for download", "bind", bind, "name", name, "error", err)
 		http.Error(w, "Failed to open file for download", http.StatusInternalServerError)
 		return
 	}
 	defer fd.Close()
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(localAbs)))
-	http.ServeContent(w, r, filepath.Base(localAbs), mtime, fd)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(name)))
+	http.ServeContent(w, r, path.Base(name), mtime, fd)
 }
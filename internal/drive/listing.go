@@ -0,0 +1,197 @@
+package drive
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// listing describes which page of a directory is rendered
+	listing struct {
+		Sort  string
+		Desc  bool
+		Page  int
+		Pages int
+		Total int
+	}
+
+	entry struct {
+		Name    string
+		Dir     bool
+		Size    int64
+		ModTime time.Time
+		Type    string
+	}
+
+	// entryHeap keeps the entries which sort last on top,
+	// so they can be discarded once the heap is full
+	entryHeap struct {
+		entries []entry
+		less    func(a, b entry) bool
+	}
+)
+
+const (
+	pageSize = 100
+	// readdirBatch is how many entries are read from the directory at once
+	readdirBatch = 256
+)
+
+var sortColumns = []string{"name", "size", "modified", "type"}
+
+func parseListing(q url.Values) listing {
+	l := listing{Sort: q.Get("sort"), Desc: q.Get("order") == "desc"}
+	if !slices.Contains(sortColumns, l.Sort) {
+		l.Sort = "name"
+	}
+	l.Page, _ = strconv.Atoi(q.Get("page"))
+	l.Page = max(l.Page, 1)
+	return l
+}
+
+// SortURL returns the query which sorts by column, toggling the order
+// if the listing is already sorted by it
+func (l listing) SortURL(column string) string {
+	order := "asc"
+	if l.Sort == column && !l.Desc {
+		order = "desc"
+	}
+	return fmt.Sprintf("?sort=%v&order=%v", column, order)
+}
+
+// PageURL returns the query of the given page, keeping the current order
+func (l listing) PageURL(page int) string {
+	order := "asc"
+	if l.Desc {
+		order = "desc"
+	}
+	return fmt.Sprintf("?sort=%v&order=%v&page=%v", l.Sort, order, page)
+}
+
+// Arrow returns the indicator shown next to the column used for sorting
+func (l listing) Arrow(column string) string {
+	switch {
+	case l.Sort != column:
+		return ""
+	case l.Desc:
+		return "▼"
+	}
+	return "▲"
+}
+
+func (l listing) less() func(a, b entry) bool {
+	var by func(a, b entry) int
+	switch l.Sort {
+	case "size":
+		by = func(a, b entry) int { return cmp.Compare(a.Size, b.Size) }
+	case "modified":
+		by = func(a, b entry) int { return a.ModTime.Compare(b.ModTime) }
+	case "type":
+		by = func(a, b entry) int { return strings.Compare(a.Type, b.Type) }
+	default:
+		by = func(a, b entry) int { return 0 }
+	}
+	return func(a, b entry) bool {
+		// directories are always listed first
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+		c := by(a, b)
+		if c == 0 {
+			c = strings.Compare(a.Name, b.Name)
+		}
+		if l.Desc {
+			return c > 0
+		}
+		return c < 0
+	}
+}
+
+// readPage reads the directory in batches, keeping only the entries up to
+// the requested page in memory, and returns the entries of that page.
+// Entries for which visible returns false are skipped.
+// l.Total and l.Pages are updated with the size of the directory.
+func readPage(ctx context.Context, fsys webdav.FileSystem, name string, visible func(os.FileInfo) bool, l *listing) ([]entry, error) {
+	f, err := fsys.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := &entryHeap{less: l.less()}
+	keep := l.Page * pageSize
+	l.Total = 0
+	for {
+		infos, err := f.Readdir(readdirBatch)
+		for _, fi := range infos {
+			if !visible(fi) {
+				continue
+			}
+			l.Total++
+			e := newEntry(fi)
+			if h.Len() < keep {
+				heap.Push(h, e)
+			} else if h.less(e, h.entries[0]) {
+				h.entries[0] = e
+				heap.Fix(h, 0)
+			}
+		}
+		// batches may be empty when entries are filtered (eg.: storage.Hide),
+		// every backend reports the end of the directory with io.EOF
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	l.Pages = max((l.Total+pageSize-1)/pageSize, 1)
+	entries := h.entries
+	sort.Slice(entries, func(i, j int) bool { return h.less(entries[i], entries[j]) })
+	start := (l.Page - 1) * pageSize
+	if start >= len(entries) {
+		return nil, nil
+	}
+	return entries[start:], nil
+}
+
+func newEntry(fi os.FileInfo) entry {
+	e := entry{Name: fi.Name(), Dir: fi.IsDir(), ModTime: fi.ModTime()}
+	if e.Dir {
+		e.Type = "directory"
+		return e
+	}
+	e.Size = fi.Size()
+	ext := strings.ToLower(path.Ext(e.Name))
+	if t, _, err := mime.ParseMediaType(mime.TypeByExtension(ext)); err == nil {
+		e.Type = t
+	} else if ext != "" {
+		e.Type = ext[1:]
+	} else {
+		e.Type = "file"
+	}
+	return e
+}
+
+func (h *entryHeap) Len() int           { return len(h.entries) }
+func (h *entryHeap) Less(i, j int) bool { return h.less(h.entries[j], h.entries[i]) }
+func (h *entryHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *entryHeap) Push(x any)         { h.entries = append(h.entries, x.(entry)) }
+func (h *entryHeap) Pop() any {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return e
+}
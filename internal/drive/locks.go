@@ -0,0 +1,102 @@
+package drive
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/andrebq/davd/internal/config"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	ifListRE  = regexp.MustCompile(`\(([^)]*)\)`)
+	ifTokenRE = regexp.MustCompile(`(Not\s+)?(?:<([^>]*)>|\[([^\]]*)\])`)
+
+	// errPreconditionFailed is returned by confirmLocks when the client sent
+	// lock conditions and none of them could be confirmed
+	errPreconditionFailed = errors.New("lock conditions were not confirmed")
+)
+
+// confirmLocks checks that the authenticated user can modify name0 and name1
+// (empty names are ignored). The lock namespace is shared with the WebDAV
+// handler of the same bind, so locks taken by WebDAV clients are honoured here.
+//
+// Lock tokens can be provided via the If or Lock-Token headers, like webdav.Handler
+// the request fails with errPreconditionFailed if none of the lists of conditions
+// is confirmed. Without conditions, the request is allowed only if no one else
+// is holding a lock on the given names.
+//
+// The returned function must be called once the modification is done.
+func (h *handler) confirmLocks(bind string, r *http.Request, name0, name1 string) (func(), error) {
+	ls := h.locks.TransientView(bind, config.UserFromContext(r.Context()).Name)
+	now := time.Now()
+	if lists := lockConditions(r); len(lists) > 0 {
+		// any list will do, the conditions of a list must all hold
+		for _, conditions := range lists {
+			release, err := ls.Confirm(now, name0, name1, conditions...)
+			if err == nil {
+				return release, nil
+			} else if !errors.Is(err, webdav.ErrConfirmationFailed) {
+				return nil, err
+			}
+		}
+		return nil, errPreconditionFailed
+	}
+	// same approach used by webdav.Handler, temporary locks which conflict
+	// with any lock held by another client
+	var tokens []string
+	release := func() {
+		for _, t := range tokens {
+			ls.Unlock(now, t)
+		}
+	}
+	for _, name := range []string{name0, name1} {
+		if name == "" {
+			continue
+		}
+		token, err := ls.Create(now, webdav.LockDetails{Root: name, Duration: -1, ZeroDepth: true})
+		if err != nil {
+			release()
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return release, nil
+}
+
+// lockConditions returns the lists of conditions of the If header (state tokens
+// and entity tags, which can be negated), the Lock-Token header is another list
+func lockConditions(r *http.Request) [][]webdav.Condition {
+	var lists [][]webdav.Condition
+	for _, list := range ifListRE.FindAllStringSubmatch(r.Header.Get("If"), -1) {
+		var conditions []webdav.Condition
+		for _, c := range ifTokenRE.FindAllStringSubmatch(list[1], -1) {
+			conditions = append(conditions, webdav.Condition{Not: c[1] != "", Token: c[2], ETag: c[3]})
+		}
+		lists = append(lists, conditions)
+	}
+	var conditions []webdav.Condition
+	for _, c := range ifTokenRE.FindAllStringSubmatch(r.Header.Get("Lock-Token"), -1) {
+		if c[2] != "" {
+			conditions = append(conditions, webdav.Condition{Token: c[2]})
+		}
+	}
+	if len(conditions) > 0 {
+		lists = append(lists, conditions)
+	}
+	return lists
+}
+
+// writeLockError translates errors from confirmLocks into HTTP responses
+func writeLockError(w http.ResponseWriter, err error) {
+	if errors.Is(err, webdav.ErrLocked) {
+		http.Error(w, "Resource is locked", http.StatusLocked)
+		return
+	} else if errors.Is(err, errPreconditionFailed) {
+		http.Error(w, "Lock tokens do not match", http.StatusPreconditionFailed)
+		return
+	}
+	http.Error(w, "Unable to check locks: "+err.Error(), http.StatusInternalServerError)
+}
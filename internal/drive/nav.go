@@ -0,0 +1,98 @@
+package drive
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/andrebq/davd/internal/config"
+)
+
+type (
+	// crumb is a link to one of the directories above the current page
+	crumb struct {
+		Name string
+		URL  string
+	}
+
+	crumbs []crumb
+
+	bindLink struct {
+		Name        string
+		URL         string
+		Description string
+		Mode        config.BindMode
+	}
+
+	bindsData struct {
+		User  string
+		Binds []bindLink
+	}
+)
+
+// breadcrumbs returns the links from /drive/ down to name (inside bind),
+// the last crumb is the current page and is not rendered as a link
+func (h *handler) breadcrumbs(bind, name string) crumbs {
+	c := crumbs{{Name: "Drive", URL: "/drive/"}}
+	segments := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	if segments[0] == "" {
+		segments = nil
+	}
+	root := path.Base(bind)
+	url := path.Join("/drive", bind) + "/"
+	if h.bindings[bind].PerUser && len(segments) > 0 {
+		// the bind itself is not reachable, start from the user directory
+		root = path.Join(root, segments[0])
+		url = path.Join(url, segments[0]) + "/"
+		segments = segments[1:]
+	}
+	c = append(c, crumb{Name: root, URL: url})
+	for _, s := range segments {
+		url = path.Join(url, s) + "/"
+		c = append(c, crumb{Name: s, URL: url})
+	}
+	return c
+}
+
+// Parent returns the URL of the directory above the current page
+func (c crumbs) Parent() string {
+	if len(c) < 2 {
+		return ""
+	}
+	return c[len(c)-2].URL
+}
+
+// renderBinds lists the binds the user can reach
+func (h *handler) renderBinds(w http.ResponseWriter, r *http.Request) {
+	user := config.UserFromContext(r.Context())
+	bd := bindsData{User: user.Name}
+	for key, b := range h.bindings {
+		link := bindLink{Name: path.Base(key), URL: path.Join("/drive", key) + "/", Description: b.Description, Mode: b.Mode}
+		target := path.Join("/", key)
+		if b.PerUser {
+			link.Name = path.Join(link.Name, user.Name)
+			link.URL = path.Join("/drive", key, user.Name) + "/"
+			target = path.Join(target, user.Name)
+		}
+		if user.Reaches(target) {
+			bd.Binds = append(bd.Binds, link)
+		}
+	}
+	sort.Slice(bd.Binds, func(i, j int) bool { return bd.Binds[i].URL < bd.Binds[j].URL })
+	buf := &strings.Builder{}
+	err := templates.ExecuteTemplate(buf, "page/binds", bd)
+	if err != nil {
+		slog.Error("Failed to render template", "error", err)
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", buf.Len()))
+	_, err = w.Write([]byte(buf.String()))
+	if err != nil {
+		slog.Error("Failed to write response", "error", err)
+	}
+}
@@ -26,10 +26,25 @@ func loadTemplates() (*template.Template, error) {
 				return ""
 			}
 		},
+		"bytes": humanizeBytes,
+		"add":   func(a, b int) int { return a + b },
 	}
 	return template.New("root").Funcs(funcs).ParseFS(templateAssets, "templates/*.html")
 }
 
+func humanizeBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func humanizeTimeAgo(d time.Duration) string {
 	if d < time.Minute {
 		return "just now"
@@ -0,0 +1,153 @@
+package drive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/andrebq/davd/internal/audit"
+	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/trash"
+)
+
+// renderTrash lists the items deleted from dir (or any directory under it)
+// which the user could read before they were deleted
+func (h *handler) renderTrash(bind, dir string, w http.ResponseWriter, r *http.Request) {
+	b := h.bindings[bind]
+	items, err := b.Trash.List(r.Context())
+	if err != nil {
+		slog.Error("Failed to list trash", "bind", bind, "error", err)
+		http.Error(w, "Failed to list trash", http.StatusInternalServerError)
+		return
+	}
+	td := trashData{Bind: bind, Location: path.Join(bind, dir), Mode: b.Mode, Crumbs: append(h.breadcrumbs(bind, dir), crumb{Name: "Trash"})}
+	for _, item := range items {
+		under := dir == "/" || item.Path == dir || strings.HasPrefix(item.Path, dir+"/")
+		if under && allowed(r, bind, config.VerbRead, item.Path) {
+			td.Items = append(td.Items, item)
+		}
+	}
+	buf := &strings.Builder{}
+	err = templates.ExecuteTemplate(buf, "page/trash", td)
+	if err != nil {
+		slog.Error("Failed to render template", "bind", bind, "error", err)
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", buf.Len()))
+	_, err = w.Write([]byte(buf.String()))
+	if err != nil {
+		slog.Error("Failed to write response", "bind", bind, "error", err)
+		return
+	}
+}
+
+// handleTrash restores or purges the item selected in the trash view,
+// which is posted to the directory whose trash was listed
+func (h *handler) handleTrash(bind, action string, w http.ResponseWriter, r *http.Request) {
+	b := h.bindings[bind]
+	if b.Trash == nil {
+		http.Error(w, "Bind has no trash", http.StatusNotFound)
+		return
+	}
+	item, err := b.Trash.Get(r.Context(), r.FormValue("id"))
+	if errors.Is(err, trash.ErrNoSuchItem) {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.Error("Failed to read trash item", "bind", bind, "error", err)
+		http.Error(w, "Failed to read trash item", http.StatusInternalServerError)
+		return
+	}
+	p := path.Join("/", bind, item.Path)
+	audit.FromContext(r.Context()).Path = p
+
+	switch action {
+	case "restore":
+		if !allowed(r, bind, config.VerbCreate, item.Path) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !checkMode(w, b.Mode, config.VerbCreate, p) {
+			return
+		}
+		release, err := h.confirmLocks(bind, r, item.Path, "")
+		if err != nil {
+			writeLockError(w, err)
+			return
+		}
+		defer release()
+		files := int64(1)
+		if item.Dir {
+			files = 0
+		}
+		// the content is already counted in the trash of the bind,
+		// but it is charged again to the user restoring it
+		user := config.UserNameFromContext(r.Context())
+		err = h.quotas.Check("", p, 0, files)
+		if err == nil {
+			err = h.quotas.CheckTransfer(user, path.Join("/", bind, trash.Dir, item.ID), p, item.Size, files)
+		}
+		if !quotaAllows(w, p, err) {
+			return
+		}
+		defer h.quotas.Invalidate(p)
+		_, err = b.Trash.Restore(r.Context(), item.ID)
+		if errors.Is(err, os.ErrExist) {
+			http.Error(w, fmt.Sprintf("%v already exists", item.Path), http.StatusConflict)
+			return
+		} else if err != nil {
+			slog.Error("Failed to restore from trash", "bind", bind, "id", item.ID, "error", err)
+			http.Error(w, "Failed to restore from trash", http.StatusInternalServerError)
+			return
+		}
+		h.quotas.Charge(user, p)
+	case "purge":
+		if !allowed(r, bind, config.VerbDelete, item.Path) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !checkMode(w, b.Mode, config.VerbDelete, p) {
+			return
+		}
+		defer h.quotas.Invalidate(p)
+		if err := b.Trash.Purge(r.Context(), item.ID); err != nil {
+			slog.Error("Failed to purge from trash", "bind", bind, "id", item.ID, "error", err)
+			http.Error(w, "Failed to purge from trash", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Purged from trash", "bind", bind, "path", item.Path, "id", item.ID, "user", config.UserFromContext(r.Context()).Name)
+	default:
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, path.Join("/drive", bind, path.Clean("/"+r.URL.Path))+"/?trash", http.StatusSeeOther)
+}
+
+// keepOverwritten saves a version of name (or moves it to the trash)
+// before it is replaced, empty files are not kept
+func (h *handler) keepOverwritten(ctx context.Context, bind, name string) error {
+	b := h.bindings[bind]
+	if b.Versions != nil {
+		_, err := b.Versions.Save(ctx, name)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if b.Trash == nil {
+		return nil
+	}
+	st, err := b.FS.Stat(ctx, name)
+	if err != nil || !st.Mode().IsRegular() || st.Size() == 0 {
+		return nil
+	}
+	_, err = b.Trash.Put(ctx, name, trash.ReasonOverwrite)
+	return err
+}
@@ -0,0 +1,249 @@
+package drive
+
+import (
+	"cmp"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andrebq/davd/internal/audit"
+	"github.com/andrebq/davd/internal/uploads"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,checksum"
+	// statusChecksumMismatch is defined by the checksum extension
+	statusChecksumMismatch = 460
+)
+
+var tusChecksums = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// NewTusHandler serves the tus 1.0 protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, termination and checksum extensions, it must be mounted under /tus/.
+//
+// Uploads are created by a POST to a directory of the bind, the file is named
+// after the filename (or name) metadata. The upload URL is the path of the file:
+//
+//	POST /<bind>/<dir>/                creates the upload, Location contains the upload URL
+//	HEAD /<bind>/<file>?upload=<id>    returns the offset
+//	PATCH /<bind>/<file>?upload=<id>   appends to the upload, the file is moved into place once complete
+//	DELETE /<bind>/<file>?upload=<id>  aborts the upload
+func NewTusHandler(bindings Bindings, opts Options) (http.Handler, error) {
+	muxer := http.NewServeMux()
+	h := &handler{
+		muxer:     muxer,
+		bindings:  bindings,
+		locks:     opts.Locks,
+		quotas:    opts.Quotas,
+		maxMemory: opts.MaxMemory,
+	}
+	for bind := range bindings {
+		muxer.HandleFunc(fmt.Sprintf("/%v/", bind), h.serveTus(bind))
+	}
+	return h, nil
+}
+
+func (h *handler) serveTus(bind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		audit.FromContext(r.Context()).Via = "tus"
+		w.Header().Set("Tus-Resumable", tusVersion)
+		b := h.bindings[bind]
+		if b.Uploads == nil {
+			http.Error(w, "Bind does not support uploads", http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.Header().Set("Tus-Extension", tusExtensions)
+			w.Header().Set("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+			return
+		}
+		name := path.Clean("/" + strings.TrimPrefix(path.Clean(r.URL.Path), "/"+bind))
+		if r.Method == http.MethodPost {
+			h.createTus(bind, name, w, r)
+			return
+		}
+		sess, ok := h.userUpload(bind, name, w, r)
+		if !ok {
+			return
+		} else if !sess.Stream {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodHead:
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Upload-Offset", strconv.FormatInt(sess.Offset, 10))
+			w.Header().Set("Upload-Length", strconv.FormatInt(sess.Size, 10))
+			if len(sess.Metadata) > 0 {
+				w.Header().Set("Upload-Metadata", formatTusMetadata(sess.Metadata))
+			}
+			w.WriteHeader(http.StatusOK)
+		case http.MethodPatch:
+			h.patchTus(bind, sess, w, r)
+		case http.MethodDelete:
+			defer h.quotas.Invalidate(uploadPath(bind, sess))
+			if !writeUploadError(w, bind, sess, b.Uploads.Abort(r.Context(), sess.ID)) {
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (h *handler) createTus(bind, dir string, w http.ResponseWriter, r *http.Request) {
+	b := h.bindings[bind]
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length is not supported", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filename := path.Base(path.Clean("/" + cmp.Or(metadata["filename"], metadata["name"])))
+	if filename == "/" {
+		http.Error(w, "Missing filename metadata", http.StatusBadRequest)
+		return
+	}
+	if st, err := b.FS.Stat(r.Context(), dir); err != nil || !st.IsDir() {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+	name := path.Join(dir, filename)
+	verb := writeVerb(r.Context(), b.FS, name, b.Mode)
+	if !allowed(r, bind, verb, name) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !checkMode(w, b.Mode, verb, path.Join("/", bind, name)) {
+		return
+	}
+	if !h.checkQuota(w, r, path.Join("/", bind, name), size, 1) {
+		return
+	}
+	sess, err := b.Uploads.CreateStream(r.Context(), name, size, metadata)
+	if err != nil {
+		http.Error(w, "Unable to create upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Location", uploadURL("/tus", bind, name, sess.ID))
+	if size == 0 {
+		if _, ok := h.finishUpload(bind, sess, w, r); !ok {
+			return
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *handler) patchTus(bind string, sess uploads.Session, w http.ResponseWriter, r *http.Request) {
+	b := h.bindings[bind]
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	var sum []byte
+	var hsh hash.Hash
+	if checksum := r.Header.Get("Upload-Checksum"); checksum != "" {
+		algorithm, encoded, _ := strings.Cut(checksum, " ")
+		newHash, found := tusChecksums[algorithm]
+		sum, err = base64.StdEncoding.DecodeString(encoded)
+		if !found || err != nil {
+			http.Error(w, "Unsupported or invalid Upload-Checksum", http.StatusBadRequest)
+			return
+		}
+		hsh = newHash()
+	}
+	// the received bytes are stored inside the bind and charged to the user
+	size := max(sess.Size-offset, 0)
+	if r.ContentLength >= 0 {
+		size = min(size, r.ContentLength)
+	}
+	if !h.checkQuota(w, r, uploadPath(bind, sess), size, 0) {
+		return
+	}
+	sess.Offset, err = b.Uploads.Append(r.Context(), sess.ID, offset, r.Body, hsh, sum)
+	if sess.Offset > offset && !errors.Is(err, uploads.ErrOffset) {
+		h.quotas.AddCharged(sess.User, uploadPath(bind, sess), sess.Offset-offset, 0)
+	}
+	switch {
+	case errors.Is(err, uploads.ErrOffset):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, uploads.ErrBusy):
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	case errors.Is(err, uploads.ErrChecksum):
+		http.Error(w, err.Error(), statusChecksumMismatch)
+		return
+	case !writeUploadError(w, bind, sess, err):
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(sess.Offset, 10))
+	if sess.Offset == sess.Size {
+		if _, ok := h.finishUpload(bind, sess, w, r); !ok {
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseTusMetadata parses the Upload-Metadata header, a comma separated
+// list of keys followed by their base64 encoded value (which is optional)
+func parseTusMetadata(hdr string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for pair := range strings.SplitSeq(hdr, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata %q: %w", key, err)
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
+
+func formatTusMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,133 @@
+package drive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTusServer returns the test server and its tus handler
+func newTusServer(t *testing.T) (*testServer, http.Handler) {
+	t.Helper()
+	s := newTestServer(t)
+	h, err := NewTusHandler(s.bindings, s.opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.bind.FS.Mkdir(context.Background(), "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	return s, h
+}
+
+// createTus starts a tus upload of /binds/scratch/dir/<filename>, returning its URL
+func createTus(t *testing.T, s *testServer, h http.Handler, filename, length string) string {
+	t.Helper()
+	rec := s.do(h, http.MethodPost, "/binds/scratch/dir/", nil,
+		"Tus-Resumable", tusVersion,
+		"Upload-Length", length,
+		"Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(filename)))
+	expectStatus(t, rec, http.StatusCreated)
+	return strings.TrimPrefix(rec.Header().Get("Location"), "/tus")
+}
+
+func patchTus(s *testServer, h http.Handler, u, offset string, body io.Reader, header ...string) *httptest.ResponseRecorder {
+	header = append(header,
+		"Tus-Resumable", tusVersion,
+		"Content-Type", "application/offset+octet-stream",
+		"Upload-Offset", offset)
+	return s.do(h, http.MethodPatch, u, body, header...)
+}
+
+func tusChecksum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestTusUpload(t *testing.T) {
+	s, h := newTusServer(t)
+	rec := s.do(h, http.MethodPost, "/binds/scratch/dir/", nil, "Upload-Length", "11")
+	expectStatus(t, rec, http.StatusPreconditionFailed)
+	if rec.Header().Get("Tus-Version") != tusVersion {
+		t.Fatalf("missing Tus-Version: %v", rec.Header())
+	}
+
+	u := createTus(t, s, h, "file.txt", "11")
+	offset := func() string {
+		t.Helper()
+		rec := s.do(h, http.MethodHead, u, nil, "Tus-Resumable", tusVersion)
+		expectStatus(t, rec, http.StatusOK)
+		return rec.Header().Get("Upload-Offset")
+	}
+	if got := offset(); got != "0" {
+		t.Fatalf("new upload is at offset %v", got)
+	}
+
+	// bytes whose checksum does not match are discarded
+	rec = patchTus(s, h, u, "0", strings.NewReader("hello"), "Upload-Checksum", tusChecksum("other"))
+	expectStatus(t, rec, statusChecksumMismatch)
+	if got := offset(); got != "0" {
+		t.Fatalf("rejected bytes moved the offset to %v", got)
+	}
+	rec = patchTus(s, h, u, "0", strings.NewReader("hello"), "Upload-Checksum", tusChecksum("hello"))
+	expectStatus(t, rec, http.StatusNoContent)
+	if got := rec.Header().Get("Upload-Offset"); got != "5" {
+		t.Fatalf("offset is %v after the first patch", got)
+	}
+
+	expectStatus(t, patchTus(s, h, u, "0", strings.NewReader(" world")), http.StatusConflict)
+	expectStatus(t, s.do(h, http.MethodPatch, u, strings.NewReader(" world"), "Tus-Resumable", tusVersion, "Upload-Offset", "5"), http.StatusUnsupportedMediaType)
+	expectStatus(t, s.do(h, http.MethodPatch, u, strings.NewReader(" world"), "Content-Type", "application/offset+octet-stream", "Upload-Offset", "5"), http.StatusPreconditionFailed)
+	if got := offset(); got != "5" {
+		t.Fatalf("rejected patches moved the offset to %v", got)
+	}
+
+	rec = patchTus(s, h, u, "5", strings.NewReader(" world"))
+	expectStatus(t, rec, http.StatusNoContent)
+	if got := rec.Header().Get("Upload-Offset"); got != "11" {
+		t.Fatalf("offset is %v after the last patch", got)
+	}
+	if got := s.readFile(t, "/dir/file.txt"); got != "hello world" {
+		t.Fatalf("uploaded content is %q", got)
+	}
+	expectStatus(t, s.do(h, http.MethodHead, u, nil, "Tus-Resumable", tusVersion), http.StatusNotFound)
+}
+
+func TestTusZeroLength(t *testing.T) {
+	s, h := newTusServer(t)
+	u := createTus(t, s, h, "empty.txt", "0")
+	if st, err := s.bind.FS.Stat(context.Background(), "/dir/empty.txt"); err != nil || st.Size() != 0 {
+		t.Fatalf("empty file was not created on creation: %v", err)
+	}
+	expectStatus(t, s.do(h, http.MethodHead, u, nil, "Tus-Resumable", tusVersion), http.StatusNotFound)
+}
+
+func TestTusConcurrentPatch(t *testing.T) {
+	s, h := newTusServer(t)
+	u := createTus(t, s, h, "file.txt", "10")
+
+	body, w := io.Pipe()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- patchTus(s, h, u, "0", body)
+	}()
+	// once the handler read the first bytes, it is appending to the upload
+	if _, err := io.WriteString(w, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, patchTus(s, h, u, "0", strings.NewReader("hello")), http.StatusLocked)
+	w.Close()
+	rec := <-done
+	expectStatus(t, rec, http.StatusNoContent)
+	if got := rec.Header().Get("Upload-Offset"); got != "5" {
+		t.Fatalf("offset is %v", got)
+	}
+
+	expectStatus(t, s.do(h, http.MethodDelete, u, nil, "Tus-Resumable", tusVersion), http.StatusNoContent)
+	expectStatus(t, s.do(h, http.MethodHead, u, nil, "Tus-Resumable", tusVersion), http.StatusNotFound)
+}
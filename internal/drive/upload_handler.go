@@ -2,36 +2,124 @@ package drive
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"path"
-	"path/filepath"
 
+	"github.com/andrebq/davd/internal/audit"
 	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/quota"
+	"github.com/andrebq/davd/internal/storage"
+	"golang.org/x/net/webdav"
 )
 
-func (h *handler) handlePost(bind, localPath string) http.HandlerFunc {
+func (h *handler) handlePost(bind string) http.HandlerFunc {
+	fsys, mode := h.bindings[bind].FS, h.bindings[bind].Mode
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		entry := audit.FromContext(r.Context())
+		entry.Via = "drive"
+		if isUpload(r) {
+			h.handleUpload(bind, path.Clean(r.URL.Path), w, r)
+			return
+		}
+		if h.maxMemory > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, h.maxMemory)
+		}
 		err := r.ParseForm()
-		if err != nil {
-			http.Error(w, "Failed to parse multipart form: "+err.Error(), http.StatusBadRequest)
+		if errors.As(err, new(*http.MaxBytesError)) {
+			http.Error(w, "Form is too large", http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		if newDir := r.FormValue("newdir"); newDir != "" {
-			createNewDir(filepath.Join(localPath), path.Clean(r.URL.Path), newDir, w)
+			dirPath := path.Join("/", bind, path.Clean(r.URL.Path), path.Clean(newDir))
+			entry.Path = dirPath
+			if !allowed(r, bind, config.VerbCreate, path.Join(path.Clean(r.URL.Path), path.Clean(newDir))) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			if !checkMode(w, mode, config.VerbCreate, dirPath) {
+				return
+			}
+			release, err := h.confirmLocks(bind, r, path.Join(path.Clean(r.URL.Path), path.Clean(newDir)), "")
+			if err != nil {
+				writeLockError(w, err)
+				return
+			}
+			defer release()
+			if !h.checkQuota(w, r, dirPath, 0, 1) {
+				return
+			}
+			defer h.quotas.Invalidate(dirPath)
+			// an existing directory is left as it is, so it is not charged again
+			if _, err := fsys.Stat(r.Context(), path.Join(path.Clean(r.URL.Path), path.Clean(newDir))); err != nil {
+				defer h.quotas.Charge(config.UserNameFromContext(r.Context()), dirPath)
+			}
+			createNewDir(r.Context(), fsys, path.Clean(r.URL.Path), newDir, w)
 			return
 		}
 
 		if renameDir := r.FormValue("newName"); renameDir != "" {
-			renameDirectory(r.Context(), filepath.Join(localPath), bind, path.Clean(r.URL.Path), renameDir, r, w)
+			urlPath := path.Clean(r.URL.Path)
+			dstPath := path.Join(path.Dir(urlPath), path.Base(path.Clean(renameDir)))
+			entry.Destination = path.Join("/", bind, dstPath)
+			// a missing source only checks its own path, the rename fails later
+			info, _ := fsys.Stat(r.Context(), urlPath)
+			if !allowedTree(r, h.bindings[bind], bind, selection{src: urlPath, dst: dstPath, info: info}, config.VerbMove, config.VerbCreate) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			if !checkMode(w, mode, config.VerbMove, path.Join("/", bind, urlPath)) {
+				return
+			}
+			// renaming over an existing entry would replace it without keeping it
+			// in the trash or versions, which needs more than move and create
+			if _, err := fsys.Stat(r.Context(), dstPath); err == nil {
+				http.Error(w, fmt.Sprintf("%v already exists", dstPath), http.StatusConflict)
+				return
+			}
+			release, err := h.confirmLocks(bind, r, urlPath, dstPath)
+			if err != nil {
+				writeLockError(w, err)
+				return
+			}
+			defer release()
+			src, dst := path.Join("/", bind, urlPath), path.Join("/", bind, dstPath)
+			if info != nil {
+				bytes, files := usage(r.Context(), h.bindings[bind], selection{src: urlPath, info: info})
+				if !quotaAllows(w, dst, h.quotas.CheckTransfer(config.UserNameFromContext(r.Context()), src, dst, bytes, files)) {
+					return
+				}
+			}
+			defer h.quotas.Invalidate(src)
+			defer h.quotas.Charge(config.UserNameFromContext(r.Context()), dst)
+			renameDirectory(r.Context(), fsys, bind, urlPath, renameDir, r, w)
+			return
+		}
+
+		if id := r.FormValue("restoreVersion"); id != "" {
+			h.restoreVersion(bind, path.Clean(r.URL.Path), id, w, r)
+			return
+		}
+
+		if action := r.FormValue("trash"); action != "" {
+			h.handleTrash(bind, action, w, r)
+			return
+		}
+
+		if action := r.FormValue("action"); action != "" {
+			h.handleAction(bind, action, w, r)
 			return
 		}
 
@@ -39,88 +127,165 @@ func (h *handler) handlePost(bind, localPath string) http.HandlerFunc {
 	}
 }
 
-func (h *handler) handlePut(bind, localPath string) http.HandlerFunc {
+// handlePut receives the parts sent by HugeUploader (uploader-* headers),
+// they are staged as an upload session (see uploads.Store.OpenParts) and
+// the file is moved into place once every part is received.
+// Parts are streamed from the request, which can be a multipart form
+// with a file field or contain only the part.
+func (h *handler) handlePut(bind string) http.HandlerFunc {
+	fsys, mode := h.bindings[bind].FS, h.bindings[bind].Mode
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPut {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		err := r.ParseMultipartForm(100_000_000)
-		if err != nil {
-			http.Error(w, "Failed to parse multipart form: "+err.Error(), http.StatusBadRequest)
+		audit.FromContext(r.Context()).Via = "drive"
+		if isUpload(r) {
+			h.handleUpload(bind, path.Clean(r.URL.Path), w, r)
+			return
+		}
+		b := h.bindings[bind]
+		if b.Uploads == nil {
+			http.Error(w, "Bind does not support uploads", http.StatusNotFound)
+			return
+		}
+		finalFilePath := path.Clean(r.URL.Path)
+		verb := writeVerb(r.Context(), fsys, finalFilePath, mode)
+		if !allowed(r, bind, verb, finalFilePath) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !checkMode(w, mode, verb, path.Join("/", bind, finalFilePath)) {
+			return
+		}
+		if !h.checkQuota(w, r, path.Join("/", bind, finalFilePath), max(r.ContentLength, 0), 1) {
 			return
 		}
 
-		finalFilePath := filepath.Join(localPath, path.Clean(r.URL.Path))
 		fileID := r.Header.Get("uploader-file-id")
-		chunkNum := r.Header.Get("uploader-chunk-number")
-		if fileID == "" || chunkNum == "" {
-			http.Error(w, "Missing uploader-file-id or uploader-chunk-number header", http.StatusBadRequest)
+		var chunk, total int
+		_, errChunk := fmt.Sscanf(r.Header.Get("uploader-chunk-number"), "%d", &chunk)
+		_, errTotal := fmt.Sscanf(r.Header.Get("uploader-chunks-total"), "%d", &total)
+		if fileID == "" || errChunk != nil || errTotal != nil {
+			http.Error(w, "Missing uploader-file-id, uploader-chunk-number or uploader-chunks-total header", http.StatusBadRequest)
 			return
 		}
 
-		file, _, err := r.FormFile("file")
+		file, err := uploadedFile(r)
 		if err != nil {
 			http.Error(w, "Missing file part: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		defer file.Close()
-
-		chunkFilename := fmt.Sprintf("%s.%s.%s.chunk", filepath.Base(finalFilePath), fileID, chunkNum)
-		chunkPath := filepath.Join(path.Dir(finalFilePath), chunkFilename)
 
-		out, err := createFile(chunkPath)
-		if err != nil {
-			http.Error(w, "Failed to create chunk file: "+err.Error(), http.StatusInternalServerError)
+		sess, err := b.Uploads.OpenParts(r.Context(), finalFilePath, fileID, total)
+		if !writeUploadError(w, bind, sess, err) {
 			return
 		}
-		defer out.Close()
-
-		_, err = io.Copy(out, file)
-		if err != nil {
-			http.Error(w, "Failed to save chunk: "+err.Error(), http.StatusInternalServerError)
+		written, err := b.Uploads.PutPart(r.Context(), sess.ID, chunk, file)
+		if !writeUploadError(w, bind, sess, err) {
+			return
+		}
+		h.quotas.AddCharged(sess.User, uploadPath(bind, sess), written, 0)
+		sess, err = b.Uploads.Get(r.Context(), sess.ID)
+		if !writeUploadError(w, bind, sess, err) {
 			return
 		}
+		if sess.MissingCount() == 0 {
+			h.completeUpload(bind, sess, w, r)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+}
 
-		// Check if this is the last chunk
-		totalChunksHeader := r.Header.Get("uploader-chunks-total")
-		if totalChunksHeader != "" {
-			var totalChunks, thisChunk int
-			fmt.Sscanf(totalChunksHeader, "%d", &totalChunks)
-			fmt.Sscanf(chunkNum, "%d", &thisChunk)
-			if totalChunks > 0 && (thisChunk+1) == totalChunks {
-				// Last chunk received, combine
-				err := combineChunks(finalFilePath, fileID, totalChunks)
-				if err != nil {
-					http.Error(w, "Failed to combine chunks: "+err.Error(), http.StatusInternalServerError)
-					return
-				}
-			}
+// uploadedFile returns the content of the file field of multipart requests,
+// without buffering it, the body of other requests is the content itself
+func uploadedFile(r *http.Request) (io.Reader, error) {
+	mr, err := r.MultipartReader()
+	if errors.Is(err, http.ErrNotMultipart) {
+		return r.Body, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("no file field")
+		} else if err != nil {
+			return nil, err
 		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
 
-		w.WriteHeader(http.StatusCreated)
+// checkQuota writes a 507 Insufficient Storage response if the user writing bytes
+// and creating files under p would exceed any quota
+func (h *handler) checkQuota(w http.ResponseWriter, r *http.Request, p string, bytes, files int64) bool {
+	return quotaAllows(w, p, h.quotas.Check(config.UserNameFromContext(r.Context()), p, bytes, files))
+}
+
+// quotaAllows writes the response for errors returned by quota.Manager checks
+func quotaAllows(w http.ResponseWriter, p string, err error) bool {
+	if errors.Is(err, quota.ErrExceeded) {
+		slog.Warn("Request rejected by quota", "path", p, "error", err)
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return false
+	} else if err != nil {
+		slog.Error("Unable to check quota", "path", p, "error", err)
+		http.Error(w, "Unable to check quota", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// checkMode writes a 403 Forbidden response if the bind mode does not allow verb
+func checkMode(w http.ResponseWriter, mode config.BindMode, verb config.Verb, p string) bool {
+	if mode.Allows(verb) {
+		return true
 	}
+	slog.Warn("Request refused by bind mode", "path", p, "mode", mode, "verb", verb)
+	http.Error(w, fmt.Sprintf("Bind is %v", mode), http.StatusForbidden)
+	return false
 }
 
-func renameDirectory(ctx context.Context, baseFilePath, bind, urlPath, newName string, req *http.Request, w http.ResponseWriter) {
-	oldFile := filepath.Join(baseFilePath, path.Clean(urlPath))
+// writeVerb returns the verb required to write to the file,
+// empty files can be overwritten in write-once binds (see config.BindModeWriteOnce)
+func writeVerb(ctx context.Context, fsys webdav.FileSystem, name string, mode config.BindMode) config.Verb {
+	st, err := fsys.Stat(ctx, name)
+	switch {
+	case err != nil:
+		return config.VerbCreate
+	case mode == config.BindModeWriteOnce && st.Mode().IsRegular() && st.Size() == 0:
+		return config.VerbCreate
+	}
+	return config.VerbOverwrite
+}
+
+// allowed checks if the authenticated user can perform verb on p (relative to bind)
+func allowed(r *http.Request, bind string, verb config.Verb, p string) bool {
+	return config.UserFromContext(r.Context()).Can(verb, path.Join("/", bind, p))
+}
+
+func renameDirectory(ctx context.Context, fsys webdav.FileSystem, bind, urlPath, newName string, req *http.Request, w http.ResponseWriter) {
+	oldFile := path.Clean("/" + urlPath)
 	newBaseName := path.Base(path.Clean(newName))
-	newFullName := filepath.Join(filepath.Dir(oldFile), newBaseName)
-	slog.Warn("Rename directory/file", "from", oldFile, "to", newFullName, "user", config.UserFromContext(ctx).Name)
-	err := os.Rename(oldFile, newFullName)
+	newFullName := path.Join(path.Dir(oldFile), newBaseName)
+	slog.Warn("Rename directory/file", "bind", bind, "from", oldFile, "to", newFullName, "user", config.UserFromContext(ctx).Name)
+	err := fsys.Rename(ctx, oldFile, newFullName)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Unable to rename directory: %v", err), http.StatusInternalServerError)
 		return
 	}
 	// redirect to the new path
 	redirpath := path.Join("/drive", bind, urlPath, "../", newBaseName)
-	println("redirect to", redirpath)
 	http.Redirect(w, req, redirpath, http.StatusSeeOther)
 }
 
-func createNewDir(baseFilePath, urlPath, newDir string, w http.ResponseWriter) {
-	dstDir := filepath.Join(baseFilePath, path.Clean(urlPath))
-	_, err := os.Lstat(dstDir)
+func createNewDir(ctx context.Context, fsys webdav.FileSystem, urlPath, newDir string, w http.ResponseWriter) {
+	dstDir := path.Clean("/" + urlPath)
+	_, err := fsys.Stat(ctx, dstDir)
 	if err != nil && os.IsNotExist(err) {
 		slog.Error("Directory does not exist, POST method called from invalid URL Path", "dstDir", dstDir)
 		http.Error(w, "Inivalid directory path", http.StatusBadRequest)
@@ -136,8 +301,8 @@ func createNewDir(baseFilePath, urlPath, newDir string, w http.ResponseWriter) {
 		return
 	}
 
-	dirPath := filepath.Join(dstDir, newDir)
-	err = os.MkdirAll(dirPath, 0755)
+	dirPath := path.Join(dstDir, newDir)
+	err = storage.MkdirAll(ctx, fsys, dirPath, 0755)
 	if err != nil {
 		slog.Error("Failed to create directory", "dirPath", dirPath, "error", err)
 		http.Error(w, "Unable to create directory", http.StatusInternalServerError)
@@ -145,40 +310,3 @@ func createNewDir(baseFilePath, urlPath, newDir string, w http.ResponseWriter) {
 	}
 	w.WriteHeader(http.StatusOK)
 }
-
-func combineChunks(finalFilePath, fileID string, totalChunks int) error {
-	dir := filepath.Dir(finalFilePath)
-	base := filepath.Base(finalFilePath)
-	out, err := createFile(finalFilePath)
-	if err != nil {
-		return fmt.Errorf("create final file: %w", err)
-	}
-	defer out.Close()
-
-	for i := 0; i < totalChunks; i++ {
-		chunkFilename := fmt.Sprintf("%s.%s.%d.chunk", base, fileID, i)
-		chunkPath := filepath.Join(dir, chunkFilename)
-		chunkFile, err := os.Open(chunkPath)
-		if err != nil {
-			return fmt.Errorf("open chunk %d: %w", i, err)
-		}
-		_, err = io.Copy(out, chunkFile)
-		chunkFile.Close()
-		if err != nil {
-			return fmt.Errorf("copy chunk %d: %w", i, err)
-		}
-		// Remove chunk after copying
-		if err := os.Remove(chunkPath); err != nil {
-			return fmt.Errorf("remove chunk %d: %w", i, err)
-		}
-	}
-	return nil
-}
-
-// createFile creates a file and its parent directories if needed
-func createFile(path string) (*os.File, error) {
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return nil, err
-	}
-	return os.Create(path)
-}
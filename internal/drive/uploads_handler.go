@@ -0,0 +1,224 @@
+package drive
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+
+	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/uploads"
+)
+
+// isUpload returns true if the request belongs to the upload session API
+func isUpload(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Has("uploads") || q.Has("upload")
+}
+
+// handleUpload implements the upload session API (see uploads.Store), the URL
+// is the destination file and the query selects the operation:
+//
+//	POST ?uploads               creates a session, the body is a JSON object with size, chunk_size and sha256 (optional)
+//	GET ?upload=<id>            returns the session, including the received chunks
+//	PUT ?upload=<id>&chunk=<n>  stores chunk n, the X-Chunk-SHA256 header must contain its hex encoded hash
+//	POST ?upload=<id>&complete  verifies the file and moves it into place
+//	POST ?upload=<id>&abort     removes the session
+func (h *handler) handleUpload(bind, name string, w http.ResponseWriter, r *http.Request) {
+	b := h.bindings[bind]
+	if b.Uploads == nil {
+		http.Error(w, "Bind does not support uploads", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	if r.Method == http.MethodPost && q.Has("uploads") {
+		h.createUpload(bind, name, w, r)
+		return
+	}
+	sess, ok := h.userUpload(bind, name, w, r)
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, sess)
+	case r.Method == http.MethodPut && q.Has("chunk"):
+		n, err := strconv.Atoi(q.Get("chunk"))
+		if err != nil {
+			http.Error(w, "Invalid chunk number", http.StatusBadRequest)
+			return
+		}
+		// chunks are stored inside the bind and charged to the user,
+		// chunks which are sent again replace the previous ones
+		var size int64
+		if n >= 0 && n < sess.Chunks() && !slices.Contains(sess.Received, n) {
+			size = sess.ChunkLen(n)
+		}
+		if !h.checkQuota(w, r, uploadPath(bind, sess), size, 0) {
+			return
+		}
+		err = b.Uploads.PutChunk(r.Context(), sess.ID, n, r.Body, r.Header.Get("X-Chunk-SHA256"))
+		if !writeUploadError(w, bind, sess, err) {
+			return
+		}
+		h.quotas.AddCharged(sess.User, uploadPath(bind, sess), size, 0)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && q.Has("complete"):
+		h.completeUpload(bind, sess, w, r)
+	case r.Method == http.MethodPost && q.Has("abort"):
+		defer h.quotas.Invalidate(uploadPath(bind, sess))
+		if !writeUploadError(w, bind, sess, b.Uploads.Abort(r.Context(), sess.ID)) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "invalid request", http.StatusBadRequest)
+	}
+}
+
+// userUpload returns the session in the upload query parameter, sessions
+// are only visible to the user which created them and under their own path
+func (h *handler) userUpload(bind, name string, w http.ResponseWriter, r *http.Request) (uploads.Session, bool) {
+	id := r.URL.Query().Get("upload")
+	sess, err := h.bindings[bind].Uploads.Get(r.Context(), id)
+	if errors.Is(err, uploads.ErrNoSuchSession) || (err == nil && (sess.Path != name || sess.User != config.UserNameFromContext(r.Context()))) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return sess, false
+	} else if err != nil {
+		slog.Error("Failed to read upload session", "bind", bind, "id", id, "error", err)
+		http.Error(w, "Failed to read upload session", http.StatusInternalServerError)
+		return sess, false
+	}
+	return sess, true
+}
+
+func (h *handler) createUpload(bind, name string, w http.ResponseWriter, r *http.Request) {
+	b := h.bindings[bind]
+	var sess uploads.Session
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&sess); err != nil {
+		http.Error(w, "Invalid upload session: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	sess.Path = name
+	verb := writeVerb(r.Context(), b.FS, name, b.Mode)
+	if !allowed(r, bind, verb, name) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !checkMode(w, b.Mode, verb, path.Join("/", bind, name)) {
+		return
+	}
+	if !h.checkQuota(w, r, path.Join("/", bind, name), sess.Size, 1) {
+		return
+	}
+	sess, err := b.Uploads.Create(r.Context(), sess)
+	if err != nil {
+		http.Error(w, "Unable to create upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Location", uploadURL("/drive", bind, name, sess.ID))
+	writeJSON(w, http.StatusCreated, sess)
+}
+
+// uploadPath returns the URL path where the data received by sess is kept,
+// which is charged to the user until the upload is finished
+func uploadPath(bind string, sess uploads.Session) string {
+	return path.Join("/", bind, uploads.Dir, sess.ID)
+}
+
+// uploadURL returns the escaped URL of the upload of name
+func uploadURL(root, bind, name, id string) string {
+	u := url.URL{Path: path.Join(root, bind, name), RawQuery: url.Values{"upload": {id}}.Encode()}
+	return u.String()
+}
+
+func (h *handler) completeUpload(bind string, sess uploads.Session, w http.ResponseWriter, r *http.Request) {
+	if sess, ok := h.finishUpload(bind, sess, w, r); ok {
+		writeJSON(w, http.StatusCreated, sess)
+	}
+}
+
+// finishUpload moves the uploaded file into place, the response is only written
+// on failure. Permissions are checked again, since the file might have been
+// created while the chunks were uploaded.
+func (h *handler) finishUpload(bind string, sess uploads.Session, w http.ResponseWriter, r *http.Request) (uploads.Session, bool) {
+	b := h.bindings[bind]
+	p := path.Join("/", bind, sess.Path)
+	verb := writeVerb(r.Context(), b.FS, sess.Path, b.Mode)
+	if !allowed(r, bind, verb, sess.Path) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return sess, false
+	}
+	if !checkMode(w, b.Mode, verb, p) {
+		return sess, false
+	}
+	release, err := h.confirmLocks(bind, r, sess.Path, "")
+	if err != nil {
+		writeLockError(w, err)
+		return sess, false
+	}
+	defer release()
+	sess, err = b.Uploads.Assemble(r.Context(), sess.ID)
+	if !writeUploadError(w, bind, sess, err) {
+		return sess, false
+	}
+	// the received data already counts towards the quotas,
+	// moving it into place only frees the file it replaces
+	var freed, newFiles int64 = 0, 1
+	if st, err := b.FS.Stat(r.Context(), sess.Path); err == nil {
+		freed, newFiles = h.quotas.Freed(p, st.Size()), 0
+	}
+	if !h.checkQuota(w, r, p, -freed, newFiles) {
+		return sess, false
+	}
+	if err := h.keepOverwritten(r.Context(), bind, sess.Path); err != nil {
+		http.Error(w, "Failed to keep the previous file: "+err.Error(), http.StatusInternalServerError)
+		return sess, false
+	}
+	defer h.quotas.Invalidate(p)
+	defer h.quotas.Invalidate(uploadPath(bind, sess))
+	if !writeUploadError(w, bind, sess, b.Uploads.Finish(r.Context(), sess.ID)) {
+		return sess, false
+	}
+	h.quotas.Charge(sess.User, p)
+	return sess, true
+}
+
+// maxMissing limits how many missing chunks are listed by writeUploadError
+const maxMissing = 100
+
+// writeUploadError writes the response for errors returned by uploads.Store,
+// returns true if err is nil
+func writeUploadError(w http.ResponseWriter, bind string, sess uploads.Session, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, uploads.ErrIncomplete):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]any{"error": err.Error(), "missing": sess.Missing(maxMissing), "missing_count": sess.MissingCount()})
+	case errors.Is(err, uploads.ErrChecksum):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, uploads.ErrInvalidChunk):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.As(err, new(*http.MaxBytesError)):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		slog.Error("Upload failed", "bind", bind, "path", sess.Path, "id", sess.ID, "error", err)
+		http.Error(w, "Upload failed: "+err.Error(), http.StatusInternalServerError)
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write response", "error", err)
+	}
+}
@@ -0,0 +1,243 @@
+package drive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/locks"
+	"github.com/andrebq/davd/internal/quota"
+	"github.com/andrebq/davd/internal/storage"
+	"github.com/andrebq/davd/internal/trash"
+	"github.com/andrebq/davd/internal/uploads"
+	"golang.org/x/net/webdav"
+)
+
+type testServer struct {
+	drive    http.Handler
+	bindings Bindings
+	opts     Options
+	// fs is the complete storage of binds/scratch, including storage.HiddenDir
+	fs   webdav.FileSystem
+	bind Bind
+	user *config.User
+}
+
+// newTestServer serves binds/scratch from a mem:// bind,
+// requests are made by a user allowed to do anything on it
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	t.Setenv("DAVD_SEED_KEY", strings.Repeat("ab", 32))
+	db, err := config.Open(context.Background(), t.TempDir(), os.Getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := storage.Open("mem://" + storage.NewID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas, err := quota.NewManager(db, map[string]quota.Mount{"/binds/scratch": {FS: fsys, Keeps: true}}, "home", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := locks.Open("", locks.Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{
+		fs: fsys,
+		bind: Bind{
+			FS:      storage.Hide(fsys),
+			Mode:    config.BindModeNormal,
+			Trash:   trash.NewBin(fsys),
+			Uploads: uploads.NewStore(fsys),
+		},
+		user: &config.User{Name: "alice", Active: true, Permissions: []config.Permission{{Prefix: "/binds/scratch", Verbs: []config.Verb{config.VerbAll}}}},
+	}
+	s.bindings = Bindings{"binds/scratch": s.bind}
+	s.opts = Options{Locks: ls, Quotas: quotas}
+	if s.drive, err = NewHandler(s.bindings, s.opts); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// do serves the request as the test user, header contains pairs of names and values
+func (s *testServer) do(h http.Handler, method, target string, body io.Reader, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	req = req.WithContext(config.WithUser(req.Context(), s.user))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *testServer) readFile(t *testing.T, name string) string {
+	t.Helper()
+	f, err := s.bind.FS.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("got status %v, expected %v: %v", rec.Code, status, rec.Body.String())
+	}
+}
+
+// createUpload starts an upload session of /binds/scratch/<name>, returning its URL
+func (s *testServer) createUpload(t *testing.T, name string, sess uploads.Session) (string, uploads.Session) {
+	t.Helper()
+	body, _ := json.Marshal(sess)
+	rec := s.do(s.drive, http.MethodPost, "/binds/scratch"+name+"?uploads", strings.NewReader(string(body)))
+	expectStatus(t, rec, http.StatusCreated)
+	if err := json.NewDecoder(rec.Body).Decode(&sess); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimPrefix(rec.Header().Get("Location"), "/drive"), sess
+}
+
+func TestChunkedUpload(t *testing.T) {
+	s := newTestServer(t)
+	content := "hello, world!"
+	chunks := []string{content[:5], content[5:10], content[10:]}
+	u, sess := s.createUpload(t, "/dir/file.txt", uploads.Session{Size: int64(len(content)), ChunkSize: 5, SHA256: sha256Hex(content)})
+	if sess.Chunks() != len(chunks) || sess.User != "alice" || sess.Path != "/dir/file.txt" {
+		t.Fatalf("unexpected session: %+v", sess)
+	}
+	putChunk := func(n int, chunk, sum string) *httptest.ResponseRecorder {
+		return s.do(s.drive, http.MethodPut, u+"&chunk="+strconv.Itoa(n), strings.NewReader(chunk), "X-Chunk-SHA256", sum)
+	}
+
+	// chunks are accepted in any order, but only if their checksum matches
+	expectStatus(t, putChunk(2, chunks[2], sha256Hex(chunks[2])), http.StatusNoContent)
+	expectStatus(t, putChunk(0, chunks[0], sha256Hex(chunks[1])), http.StatusUnprocessableEntity)
+	expectStatus(t, putChunk(1, chunks[1][1:], sha256Hex(chunks[1][1:])), http.StatusBadRequest)
+	expectStatus(t, putChunk(3, chunks[2], sha256Hex(chunks[2])), http.StatusBadRequest)
+
+	rec := s.do(s.drive, http.MethodPost, u+"&complete", nil)
+	expectStatus(t, rec, http.StatusConflict)
+	var incomplete struct {
+		Missing      []int `json:"missing"`
+		MissingCount int   `json:"missing_count"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&incomplete); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(incomplete.Missing, []int{0, 1}) || incomplete.MissingCount != 2 {
+		t.Fatalf("unexpected missing chunks: %+v", incomplete)
+	}
+	if _, err := s.bind.FS.Stat(context.Background(), "/dir/file.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("incomplete upload was moved into place: %v", err)
+	}
+
+	rec = s.do(s.drive, http.MethodGet, u, nil)
+	expectStatus(t, rec, http.StatusOK)
+	if err := json.NewDecoder(rec.Body).Decode(&sess); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(sess.Received, []int{2}) {
+		t.Fatalf("unexpected received chunks: %v", sess.Received)
+	}
+
+	for _, n := range []int{1, 0, 1} {
+		expectStatus(t, putChunk(n, chunks[n], sha256Hex(chunks[n])), http.StatusNoContent)
+	}
+	expectStatus(t, s.do(s.drive, http.MethodPost, u+"&complete", nil), http.StatusCreated)
+	if got := s.readFile(t, "/dir/file.txt"); got != content {
+		t.Fatalf("uploaded content is %q", got)
+	}
+	expectStatus(t, s.do(s.drive, http.MethodGet, u, nil), http.StatusNotFound)
+}
+
+func TestUploadFileHash(t *testing.T) {
+	s := newTestServer(t)
+	u, _ := s.createUpload(t, "/file.txt", uploads.Session{Size: 5, SHA256: sha256Hex("other")})
+	expectStatus(t, s.do(s.drive, http.MethodPut, u+"&chunk=0", strings.NewReader("hello"), "X-Chunk-SHA256", sha256Hex("hello")), http.StatusNoContent)
+	expectStatus(t, s.do(s.drive, http.MethodPost, u+"&complete", nil), http.StatusUnprocessableEntity)
+	if _, err := s.bind.FS.Stat(context.Background(), "/file.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("file with the wrong hash was moved into place: %v", err)
+	}
+
+	// sessions are only visible to the user which created them
+	other := *s
+	other.user = &config.User{Name: "bob", Active: true, Permissions: s.user.Permissions}
+	expectStatus(t, other.do(s.drive, http.MethodGet, u, nil), http.StatusNotFound)
+	expectStatus(t, other.do(s.drive, http.MethodPost, u+"&abort", nil), http.StatusNotFound)
+	expectStatus(t, s.do(s.drive, http.MethodPost, u+"&abort", nil), http.StatusNoContent)
+	expectStatus(t, s.do(s.drive, http.MethodGet, u, nil), http.StatusNotFound)
+}
+
+func TestZeroLengthUpload(t *testing.T) {
+	s := newTestServer(t)
+	u, sess := s.createUpload(t, "/empty.txt", uploads.Session{Size: 0})
+	if sess.Chunks() != 0 {
+		t.Fatalf("empty upload expects %v chunks", sess.Chunks())
+	}
+	expectStatus(t, s.do(s.drive, http.MethodPut, u+"&chunk=0", strings.NewReader(""), "X-Chunk-SHA256", sha256Hex("")), http.StatusBadRequest)
+	expectStatus(t, s.do(s.drive, http.MethodPost, u+"&complete", nil), http.StatusCreated)
+	if st, err := s.bind.FS.Stat(context.Background(), "/empty.txt"); err != nil || st.Size() != 0 {
+		t.Fatalf("empty file was not created: %v", err)
+	}
+}
+
+func TestPurgeStaleUploads(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	u, _ := s.createUpload(t, "/file.txt", uploads.Session{Size: 10, ChunkSize: 5})
+	expectStatus(t, s.do(s.drive, http.MethodPut, u+"&chunk=0", strings.NewReader("hello"), "X-Chunk-SHA256", sha256Hex("hello")), http.StatusNoContent)
+
+	// chunks are staged outside of the served tree
+	if _, err := s.bind.FS.Stat(ctx, uploads.Dir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("upload sessions are visible in the bind: %v", err)
+	}
+	if entries, err := storage.ReadDir(ctx, s.bind.FS, "/"); err != nil || len(entries) != 0 {
+		t.Fatalf("unexpected entries in the bind: %v, %v", entries, err)
+	}
+
+	purged, err := s.bind.Uploads.PurgeBefore(ctx, time.Now().Add(-time.Hour))
+	if err != nil || purged != 0 {
+		t.Fatalf("purged %v recent sessions: %v", purged, err)
+	}
+	expectStatus(t, s.do(s.drive, http.MethodGet, u, nil), http.StatusOK)
+
+	// invalid sessions are purged as well
+	if err := s.fs.Mkdir(ctx, uploads.Dir+"/invalid", 0755); err != nil {
+		t.Fatal(err)
+	}
+	purged, err = s.bind.Uploads.PurgeBefore(ctx, time.Now().Add(time.Minute))
+	if err != nil || purged != 2 {
+		t.Fatalf("purged %v stale sessions: %v", purged, err)
+	}
+	expectStatus(t, s.do(s.drive, http.MethodGet, u, nil), http.StatusNotFound)
+	if entries, err := storage.ReadDir(ctx, s.fs, uploads.Dir); err != nil || len(entries) != 0 {
+		t.Fatalf("sessions left after purging: %v, %v", entries, err)
+	}
+}
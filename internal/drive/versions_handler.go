@@ -0,0 +1,83 @@
+package drive
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+
+	"github.com/andrebq/davd/internal/audit"
+	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/versions"
+)
+
+func (h *handler) downloadVersion(bind, name, id string, w http.ResponseWriter, r *http.Request) {
+	b := h.bindings[bind]
+	if b.Versions == nil {
+		http.Error(w, "Bind is not versioned", http.StatusNotFound)
+		return
+	}
+	v, err := b.Versions.Get(r.Context(), name, id)
+	if errors.Is(err, versions.ErrNoSuchVersion) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.Error("Failed to read version", "bind", bind, "name", name, "id", id, "error", err)
+		http.Error(w, "Failed to read version", http.StatusInternalServerError)
+		return
+	}
+	fd, err := b.Versions.Open(r.Context(), name, id)
+	if err != nil {
+		slog.Error("Failed to open version for download", "bind", bind, "name", name, "id", id, "error", err)
+		http.Error(w, "Failed to open version for download", http.StatusInternalServerError)
+		return
+	}
+	defer fd.Close()
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(name)))
+	http.ServeContent(w, r, path.Base(name), v.ModTime, fd)
+}
+
+// restoreVersion replaces the content of the file with the selected version
+func (h *handler) restoreVersion(bind, name, id string, w http.ResponseWriter, r *http.Request) {
+	b := h.bindings[bind]
+	p := path.Join("/", bind, name)
+	audit.FromContext(r.Context()).Path = p
+	if b.Versions == nil {
+		http.Error(w, "Bind is not versioned", http.StatusNotFound)
+		return
+	}
+	if !allowed(r, bind, config.VerbOverwrite, name) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !checkMode(w, b.Mode, config.VerbOverwrite, p) {
+		return
+	}
+	v, err := b.Versions.Get(r.Context(), name, id)
+	if errors.Is(err, versions.ErrNoSuchVersion) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.Error("Failed to read version", "bind", bind, "name", name, "id", id, "error", err)
+		http.Error(w, "Failed to read version", http.StatusInternalServerError)
+		return
+	}
+	release, err := h.confirmLocks(bind, r, name, "")
+	if err != nil {
+		writeLockError(w, err)
+		return
+	}
+	defer release()
+	if !h.checkQuota(w, r, p, v.Size, 0) {
+		return
+	}
+	defer h.quotas.Invalidate(p)
+	if err := b.Versions.Restore(r.Context(), name, id); err != nil {
+		slog.Error("Failed to restore version", "bind", bind, "name", name, "id", id, "error", err)
+		http.Error(w, "Failed to restore version", http.StatusInternalServerError)
+		return
+	}
+	h.quotas.Charge(config.UserNameFromContext(r.Context()), p)
+	http.Redirect(w, r, path.Join("/drive", bind, name), http.StatusSeeOther)
+}
@@ -0,0 +1,455 @@
+package locks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// Limits control how many resources the lock system is allowed to use
+	Limits struct {
+		// PerUser is the maximum number of locks a single user can hold
+		PerUser int
+		// Global is the maximum number of locks across all users.
+		// Transient locks (see TransientView) count towards neither limit.
+		Global int
+		// MaxTimeout is the longest duration a lock can have,
+		// infinite locks are capped to this value
+		MaxTimeout time.Duration
+	}
+
+	// System implements a webdav.LockSystem which is shared by all binds,
+	// each bind (and user) gets its own view via System.View.
+	//
+	// Locks are persisted to disk so they survive server restarts,
+	// except for the temporary locks created by webdav.Handler while
+	// it is processing a request.
+	System struct {
+		mu        sync.Mutex
+		limits    Limits
+		statePath string
+		byToken   map[string]*lock
+		// perUser and total only count the locks which are not transient,
+		// those only live while a request is processed and are not limited
+		perUser map[string]int
+		total   int
+	}
+
+	lock struct {
+		Token     string    `json:"token"`
+		User      string    `json:"user"`
+		Root      string    `json:"root"`
+		OwnerXML  string    `json:"owner_xml,omitempty"`
+		ZeroDepth bool      `json:"zero_depth"`
+		Expiry    time.Time `json:"expiry,omitempty"`
+
+		duration  time.Duration
+		transient bool
+		held      bool
+	}
+
+	view struct {
+		sys       *System
+		namespace string
+		user      string
+		// transient locks are not persisted (see TransientView)
+		transient bool
+	}
+)
+
+var (
+	// DefaultLimits are used when a Limits field is left empty
+	DefaultLimits = Limits{
+		PerUser:    1000,
+		Global:     10000,
+		MaxTimeout: 24 * time.Hour,
+	}
+)
+
+// Open returns a lock system which stores its state at statePath,
+// locks which were persisted and are not expired are loaded back.
+func Open(statePath string, limits Limits) (*System, error) {
+	if limits.PerUser <= 0 {
+		limits.PerUser = DefaultLimits.PerUser
+	}
+	if limits.Global <= 0 {
+		limits.Global = DefaultLimits.Global
+	}
+	if limits.MaxTimeout <= 0 {
+		limits.MaxTimeout = DefaultLimits.MaxTimeout
+	}
+	s := &System{
+		limits:    limits,
+		statePath: statePath,
+		byToken:   make(map[string]*lock),
+		perUser:   make(map[string]int),
+	}
+	var persisted []*lock
+	buf, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &persisted); err != nil {
+		return nil, fmt.Errorf("unable to parse lock state from %v: %w", statePath, err)
+	}
+	now := time.Now()
+	for _, l := range persisted {
+		if l.expired(now) || len(s.byToken) >= limits.Global {
+			continue
+		}
+		l.duration = l.Expiry.Sub(now)
+		s.byToken[l.Token] = l
+		s.perUser[l.User]++
+		s.total++
+	}
+	slog.Info("Restored persisted locks", "count", len(s.byToken), "path", statePath)
+	return s, nil
+}
+
+// View returns a webdav.LockSystem for the given namespace (usually a bind),
+// every lock created through it is owned by user.
+func (s *System) View(namespace, user string) webdav.LockSystem {
+	return &view{sys: s, namespace: path.Clean("/" + namespace), user: user}
+}
+
+// TransientView is like View, but the locks created through it only last
+// while a request is processed and are not persisted. It is used for requests
+// which can not create locks on behalf of the client (eg.: webdav.Handler locks
+// the resources of a PUT without an If header, and unlocks them once it is done).
+func (s *System) TransientView(namespace, user string) webdav.LockSystem {
+	return &view{sys: s, namespace: path.Clean("/" + namespace), user: user, transient: true}
+}
+
+// ExpireLoop removes expired locks every interval, until ctx is done.
+func (s *System) ExpireLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			s.collectExpired(now)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *System) confirm(now time.Time, user, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collectExpired(now)
+
+	var l0, l1 *lock
+	if name0 != "" {
+		if l0 = s.lookup(user, name0, conditions...); l0 == nil {
+			return nil, webdav.ErrConfirmationFailed
+		}
+	}
+	if name1 != "" {
+		if l1 = s.lookup(user, name1, conditions...); l1 == nil {
+			return nil, webdav.ErrConfirmationFailed
+		}
+	}
+	if l1 == l0 {
+		l1 = nil
+	}
+	for _, l := range []*lock{l0, l1} {
+		if l != nil {
+			l.held = true
+		}
+	}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, l := range []*lock{l0, l1} {
+			if l != nil {
+				l.held = false
+			}
+		}
+	}, nil
+}
+
+// lookup returns the lock which covers name and matches one of the conditions,
+// locks owned by other users or which are already held are ignored.
+// Negated conditions and entity tags never identify a lock.
+func (s *System) lookup(user, name string, conditions ...webdav.Condition) *lock {
+	for _, c := range conditions {
+		if c.Not || c.Token == "" {
+			continue
+		}
+		l := s.byToken[c.Token]
+		if l == nil || l.held || l.User != user {
+			continue
+		}
+		if l.covers(name) {
+			return l
+		}
+	}
+	return nil
+}
+
+func (s *System) create(now time.Time, user string, details webdav.LockDetails, transient bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collectExpired(now)
+
+	if !transient && s.total >= s.limits.Global {
+		slog.Warn("Global lock limit reached", "limit", s.limits.Global, "user", user)
+		return "", webdav.ErrLocked
+	}
+	if !transient && s.perUser[user] >= s.limits.PerUser {
+		slog.Warn("User lock limit reached", "limit", s.limits.PerUser, "user", user)
+		return "", webdav.ErrLocked
+	}
+	for _, other := range s.byToken {
+		if other.conflicts(details.Root, details.ZeroDepth) {
+			return "", webdav.ErrLocked
+		}
+	}
+	l := &lock{
+		Token:     newToken(),
+		User:      user,
+		Root:      details.Root,
+		OwnerXML:  details.OwnerXML,
+		ZeroDepth: details.ZeroDepth,
+		transient: transient,
+	}
+	l.refresh(now, s.clampTimeout(details.Duration))
+	s.byToken[l.Token] = l
+	if !l.transient {
+		s.perUser[user]++
+		s.total++
+		s.persist()
+	}
+	return l.Token, nil
+}
+
+func (s *System) refresh(now time.Time, user, token string, duration time.Duration) (webdav.LockDetails, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collectExpired(now)
+
+	l := s.byToken[token]
+	if l == nil {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	if l.held || l.User != user {
+		return webdav.LockDetails{}, webdav.ErrLocked
+	}
+	l.refresh(now, s.clampTimeout(duration))
+	if !l.transient {
+		s.persist()
+	}
+	return l.details(), nil
+}
+
+func (s *System) unlock(now time.Time, user, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collectExpired(now)
+
+	l := s.byToken[token]
+	if l == nil {
+		return webdav.ErrNoSuchLock
+	}
+	if l.User != user {
+		return webdav.ErrForbidden
+	}
+	if l.held {
+		return webdav.ErrLocked
+	}
+	s.remove(l)
+	if !l.transient {
+		s.persist()
+	}
+	return nil
+}
+
+func (s *System) clampTimeout(d time.Duration) time.Duration {
+	if d < 0 || d > s.limits.MaxTimeout {
+		return s.limits.MaxTimeout
+	}
+	return d
+}
+
+func (s *System) collectExpired(now time.Time) {
+	changed := false
+	for _, l := range s.byToken {
+		if !l.held && l.expired(now) {
+			s.remove(l)
+			changed = changed || !l.transient
+		}
+	}
+	if changed {
+		s.persist()
+	}
+}
+
+func (s *System) remove(l *lock) {
+	delete(s.byToken, l.Token)
+	if l.transient {
+		return
+	}
+	s.total--
+	s.perUser[l.User]--
+	if s.perUser[l.User] <= 0 {
+		delete(s.perUser, l.User)
+	}
+}
+
+// persist writes all non-transient locks to disk, errors are logged
+// since a failure to persist should not prevent the lock from working
+func (s *System) persist() {
+	if s.statePath == "" {
+		return
+	}
+	persisted := []*lock{}
+	for _, l := range s.byToken {
+		if !l.transient {
+			persisted = append(persisted, l)
+		}
+	}
+	buf, err := json.MarshalIndent(persisted, "", "  ")
+	if err != nil {
+		slog.Error("Unable to encode lock state", "error", err)
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(s.statePath), 0755)
+	if err != nil {
+		slog.Error("Unable to create lock state directory", "path", s.statePath, "error", err)
+		return
+	}
+	err = writeFileSync(s.statePath+".tmp", buf)
+	if err == nil {
+		err = os.Rename(s.statePath+".tmp", s.statePath)
+	}
+	if err != nil {
+		slog.Error("Unable to persist lock state", "path", s.statePath, "error", err)
+	}
+}
+
+// writeFileSync writes data to name and syncs it to disk before returning,
+// so the file can be renamed into place without leaving it partially written
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (l *lock) refresh(now time.Time, duration time.Duration) {
+	l.duration = duration
+	l.Expiry = now.Add(duration)
+}
+
+func (l *lock) expired(now time.Time) bool {
+	return !l.Expiry.IsZero() && !now.Before(l.Expiry)
+}
+
+func (l *lock) details() webdav.LockDetails {
+	return webdav.LockDetails{
+		Root:      l.Root,
+		Duration:  l.duration,
+		OwnerXML:  l.OwnerXML,
+		ZeroDepth: l.ZeroDepth,
+	}
+}
+
+// covers returns true if name is locked by l
+func (l *lock) covers(name string) bool {
+	if name == l.Root {
+		return true
+	}
+	return !l.ZeroDepth && isDescendant(name, l.Root)
+}
+
+// conflicts returns true if l prevents a new lock at root from being created
+func (l *lock) conflicts(root string, zeroDepth bool) bool {
+	if root == l.Root {
+		return true
+	}
+	if !l.ZeroDepth && isDescendant(root, l.Root) {
+		return true
+	}
+	return !zeroDepth && isDescendant(l.Root, root)
+}
+
+func isDescendant(name, ancestor string) bool {
+	return ancestor == "/" || strings.HasPrefix(name, ancestor+"/")
+}
+
+func newToken() string {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		panic("FATAL RUNTIME ERROR: unable to read from crypto/rand")
+	}
+	return fmt.Sprintf("opaquelocktoken:%s", hex.EncodeToString(buf[:]))
+}
+
+func (v *view) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	return v.sys.confirm(now, v.user, v.toSystem(name0), v.toSystem(name1), conditions...)
+}
+
+func (v *view) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	details.Root = v.toSystem(details.Root)
+	return v.sys.create(now, v.user, details, v.transient)
+}
+
+func (v *view) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	details, err := v.sys.refresh(now, v.user, token, duration)
+	if err != nil {
+		return details, err
+	}
+	details.Root, err = v.fromSystem(details.Root)
+	return details, err
+}
+
+func (v *view) Unlock(now time.Time, token string) error {
+	return v.sys.unlock(now, v.user, token)
+}
+
+func (v *view) toSystem(name string) string {
+	if name == "" {
+		return ""
+	}
+	return path.Join(v.namespace, path.Clean("/"+name))
+}
+
+func (v *view) fromSystem(name string) (string, error) {
+	if v.namespace == "/" {
+		return name, nil
+	} else if name == v.namespace {
+		return "/", nil
+	}
+	rel, found := strings.CutPrefix(name, v.namespace+"/")
+	if !found {
+		return "", errors.New("lock outside of namespace")
+	}
+	return path.Clean("/" + rel), nil
+}
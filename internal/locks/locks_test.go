@@ -0,0 +1,240 @@
+package locks
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+var epoch = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func openTest(t *testing.T, statePath string, limits Limits) *System {
+	t.Helper()
+	s, err := Open(statePath, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// step is an operation applied to webdav.NewMemLS and to a view of System,
+// tokens are referenced by the index of the step which created them
+type step struct {
+	name string
+	op   string
+	root string
+	// names are the arguments of Confirm
+	names [2]string
+	// tokens are indexes of previous create steps
+	tokens    []int
+	zeroDepth bool
+	// release releases the locks held by a previous confirm step
+	release int
+}
+
+func TestMirrorsMemLS(t *testing.T) {
+	steps := []step{
+		{name: "lock a file", op: "create", root: "/dir/file", zeroDepth: true},
+		{name: "lock the same file", op: "create", root: "/dir/file", zeroDepth: true},
+		{name: "lock a directory", op: "create", root: "/other"},
+		{name: "lock inside a locked directory", op: "create", root: "/other/file", zeroDepth: true},
+		{name: "lock the parent of a locked file", op: "create", root: "/dir"},
+		{name: "lock the parent with zero depth", op: "create", root: "/dir", zeroDepth: true},
+		{name: "confirm without tokens", op: "confirm", names: [2]string{"/dir/file"}},
+		{name: "confirm with a token of another file", op: "confirm", names: [2]string{"/dir/file"}, tokens: []int{2}},
+		{name: "confirm a file", op: "confirm", names: [2]string{"/dir/file"}, tokens: []int{0}},
+		{name: "confirm a held lock", op: "confirm", names: [2]string{"/dir/file"}, tokens: []int{0}},
+		{name: "unlock a held lock", op: "unlock", tokens: []int{0}},
+		{name: "refresh a held lock", op: "refresh", tokens: []int{0}},
+		{name: "release", op: "release", release: 8},
+		{name: "confirm under a directory", op: "confirm", names: [2]string{"/other/a/b", "/other/c"}, tokens: []int{2}},
+		{name: "confirm two locks", op: "confirm", names: [2]string{"/dir/file", "/dir"}, tokens: []int{0, 5}},
+		{name: "release both", op: "release", release: 14},
+		{name: "zero depth does not cover children", op: "confirm", names: [2]string{"/dir/file"}, tokens: []int{5}},
+		{name: "refresh", op: "refresh", tokens: []int{0}},
+		{name: "unlock", op: "unlock", tokens: []int{0}},
+		{name: "unlock again", op: "unlock", tokens: []int{0}},
+		{name: "refresh a removed lock", op: "refresh", tokens: []int{0}},
+		{name: "lock a released file", op: "create", root: "/dir/file", zeroDepth: true},
+	}
+
+	run := func(ls webdav.LockSystem) []error {
+		var errs []error
+		tokens := map[int]string{}
+		releases := map[int]func(){}
+		for i, s := range steps {
+			var conditions []webdav.Condition
+			for _, n := range s.tokens {
+				conditions = append(conditions, webdav.Condition{Token: tokens[n]})
+			}
+			var err error
+			switch s.op {
+			case "create":
+				tokens[i], err = ls.Create(epoch, webdav.LockDetails{Root: s.root, Duration: time.Hour, ZeroDepth: s.zeroDepth})
+			case "confirm":
+				releases[i], err = ls.Confirm(epoch, s.names[0], s.names[1], conditions...)
+			case "release":
+				releases[s.release]()
+			case "refresh":
+				_, err = ls.Refresh(epoch, conditions[0].Token, time.Hour)
+			case "unlock":
+				err = ls.Unlock(epoch, conditions[0].Token)
+			}
+			errs = append(errs, err)
+		}
+		return errs
+	}
+	expected := run(webdav.NewMemLS())
+	got := run(openTest(t, "", Limits{}).View("binds/a", "user"))
+	for i, s := range steps {
+		if !errors.Is(got[i], expected[i]) {
+			t.Errorf("%v: got %v, memLS returned %v", s.name, got[i], expected[i])
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	s := openTest(t, "", Limits{PerUser: 2, Global: 3})
+	alice, bob := s.View("binds/a", "alice"), s.View("binds/a", "bob")
+	for _, root := range []string{"/1", "/2"} {
+		if _, err := alice.Create(epoch, webdav.LockDetails{Root: root, Duration: time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := alice.Create(epoch, webdav.LockDetails{Root: "/3", Duration: time.Hour}); !errors.Is(err, webdav.ErrLocked) {
+		t.Fatalf("expected the user limit to be reached, got %v", err)
+	}
+	token, err := bob.Create(epoch, webdav.LockDetails{Root: "/3", Duration: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Create(epoch, webdav.LockDetails{Root: "/4", Duration: time.Hour}); !errors.Is(err, webdav.ErrLocked) {
+		t.Fatalf("expected the global limit to be reached, got %v", err)
+	}
+
+	// transient locks are not limited and do not count towards the limits
+	transient := s.TransientView("binds/a", "bob")
+	tmp, err := transient.Create(epoch, webdav.LockDetails{Root: "/5", Duration: -1, ZeroDepth: true})
+	if err != nil {
+		t.Fatalf("transient lock refused: %v", err)
+	}
+	if err := bob.Unlock(epoch, token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Create(epoch, webdav.LockDetails{Root: "/4", Duration: time.Hour}); err != nil {
+		t.Fatalf("transient lock counted towards the limits: %v", err)
+	}
+	if err := transient.Unlock(epoch, tmp); err != nil {
+		t.Fatal(err)
+	}
+	if s.total != 3 || s.perUser["bob"] != 1 {
+		t.Fatalf("unexpected counters: total %v, bob %v", s.total, s.perUser["bob"])
+	}
+}
+
+func TestMaxTimeout(t *testing.T) {
+	s := openTest(t, "", Limits{MaxTimeout: time.Minute})
+	ls := s.View("binds/a", "user")
+	token, err := ls.Create(epoch, webdav.LockDetails{Root: "/file", Duration: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	details, err := ls.Refresh(epoch, token, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Duration != time.Minute || details.Root != "/file" {
+		t.Fatalf("unexpected details: %+v", details)
+	}
+	if _, err := ls.Confirm(epoch.Add(time.Minute), "/file", "", webdav.Condition{Token: token}); !errors.Is(err, webdav.ErrConfirmationFailed) {
+		t.Fatalf("expected the lock to expire, got %v", err)
+	}
+	if _, err := ls.Create(epoch.Add(time.Minute), webdav.LockDetails{Root: "/file", Duration: time.Second}); err != nil {
+		t.Fatalf("expired lock still conflicts: %v", err)
+	}
+}
+
+func TestUsersAndNamespaces(t *testing.T) {
+	s := openTest(t, "", Limits{})
+	alice := s.View("binds/a", "alice")
+	token, err := alice.Create(epoch, webdav.LockDetails{Root: "/dir", Duration: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := s.View("binds/a", "bob")
+	if _, err := bob.Confirm(epoch, "/dir/file", "", webdav.Condition{Token: token}); !errors.Is(err, webdav.ErrConfirmationFailed) {
+		t.Fatalf("confirmed the lock of another user: %v", err)
+	}
+	if err := bob.Unlock(epoch, token); !errors.Is(err, webdav.ErrForbidden) {
+		t.Fatalf("unlocked the lock of another user: %v", err)
+	}
+	if _, err := bob.Create(epoch, webdav.LockDetails{Root: "/dir/file", Duration: time.Hour}); !errors.Is(err, webdav.ErrLocked) {
+		t.Fatalf("locks of another user do not conflict: %v", err)
+	}
+	if _, err := s.View("binds/b", "bob").Create(epoch, webdav.LockDetails{Root: "/dir", Duration: time.Hour}); err != nil {
+		t.Fatalf("locks of another namespace conflict: %v", err)
+	}
+	if _, err := s.TransientView("binds/a", "alice").Confirm(epoch, "/dir/file", "", webdav.Condition{Token: token}); err != nil {
+		t.Fatalf("views of the same namespace do not share locks: %v", err)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "locks.json")
+	s := openTest(t, statePath, Limits{})
+	ls := s.View("binds/a", "user")
+	token, err := ls.Create(epoch, webdav.LockDetails{Root: "/file", Duration: time.Hour, OwnerXML: "<owner/>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.Create(epoch, webdav.LockDetails{Root: "/expired", Duration: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.TransientView("binds/a", "user").Create(epoch, webdav.LockDetails{Root: "/transient", Duration: -1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Open drops the locks which expired before now
+	now := time.Now()
+	for _, l := range s.byToken {
+		if l.Root == "/binds/a/file" {
+			l.Expiry = now.Add(time.Hour)
+		} else {
+			l.Expiry = now.Add(-time.Second)
+		}
+	}
+	s.persist()
+
+	reopened := openTest(t, statePath, Limits{})
+	if len(reopened.byToken) != 1 || reopened.total != 1 || reopened.perUser["user"] != 1 {
+		t.Fatalf("unexpected locks after reopening: %v", reopened.byToken)
+	}
+	ls = reopened.View("binds/a", "user")
+	release, err := ls.Confirm(now, "/file", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("persisted lock was not restored: %v", err)
+	}
+	release()
+	if _, err := ls.Create(now, webdav.LockDetails{Root: "/transient", Duration: time.Hour}); err != nil {
+		t.Fatalf("transient lock was persisted: %v", err)
+	}
+	details, err := ls.Refresh(now, token, time.Hour)
+	if err != nil || details.OwnerXML != "<owner/>" {
+		t.Fatalf("unexpected details %+v: %v", details, err)
+	}
+}
+func TestNegatedConditions(t *testing.T) {
+	ls := openTest(t, "", Limits{}).View("binds/a", "user")
+	token, err := ls.Create(epoch, webdav.LockDetails{Root: "/file", Duration: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []webdav.Condition{{Not: true, Token: token}, {ETag: `"etag"`}} {
+		if _, err := ls.Confirm(epoch, "/file", "", c); !errors.Is(err, webdav.ErrConfirmationFailed) {
+			t.Fatalf("%+v confirmed the lock: %v", c, err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package quota
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type (
+	// owners records which user wrote each file (and directory) outside of
+	// their home directory, keyed by URL path, so it can be charged to them
+	// wherever it was written (see Manager.Charge).
+	//
+	// Entries are dropped once the file no longer exists (see reconcile).
+	// Changes are appended to a journal at statePath, which is compacted
+	// when it is opened and once it grows larger than the state it holds.
+	// The journal is not synced, the entries are reconciled with the file
+	// systems once the server starts (see Manager.SetMounts).
+	owners struct {
+		statePath string
+
+		mu     sync.Mutex
+		files  map[string]owned
+		totals map[string]Usage
+		// dirty contains the entries changed since the last flush
+		dirty    []string
+		journal  *os.File
+		appended int
+	}
+
+	owned struct {
+		User  string `json:"user"`
+		Bytes int64  `json:"bytes,omitempty"`
+		Files int64  `json:"files,omitempty"`
+	}
+
+	// journalEntry is a line of the journal, entries without user were removed
+	journalEntry struct {
+		Name string `json:"name"`
+		owned
+	}
+)
+
+const (
+	// compactAfter is how many entries can be appended to the journal,
+	// on top of the current state, before it is compacted
+	compactAfter = 10000
+)
+
+// openOwners loads the state stored at statePath, an empty path keeps the state in memory
+func openOwners(statePath string) (*owners, error) {
+	o := &owners{statePath: statePath, files: map[string]owned{}, totals: map[string]Usage{}}
+	if statePath == "" {
+		return o, nil
+	}
+	f, err := os.Open(statePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	} else if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			var e journalEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				// eg.: the last line was not completely written
+				slog.Warn("Ignoring invalid entry of the file owners", "path", statePath, "line", line, "error", err)
+				continue
+			}
+			o.set(e.Name, e.owned)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read file owners from %v: %w", statePath, err)
+		}
+	}
+	o.dirty = nil
+	if err := o.compact(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// usage returns how much data is charged to user
+func (o *owners) usage(user string) Usage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.totals[user]
+}
+
+// usageUnder returns how much data under p is charged to user
+func (o *owners) usageUnder(user, p string) Usage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var usage Usage
+	for name, f := range o.files {
+		if f.User == user && under(name, p) {
+			usage = f.add(usage, 1)
+		}
+	}
+	return usage
+}
+
+// charge sets user as the owner of files, replacing the previous owners
+func (o *owners) charge(user string, files map[string]Usage) {
+	if len(files) == 0 {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for name, usage := range files {
+		o.set(name, owned{User: user, Bytes: usage.Bytes, Files: usage.Files})
+	}
+	o.flush()
+}
+
+// reconcile updates the entries under p (or charged to user, if not empty)
+// using stat, which returns false once the file no longer exists
+func (o *owners) reconcile(p, user string, stat func(name string) (Usage, bool, error)) error {
+	o.mu.Lock()
+	var names []string
+	for name, f := range o.files {
+		if (p != "" && under(name, p)) || (user != "" && f.User == user) {
+			names = append(names, name)
+		}
+	}
+	o.mu.Unlock()
+	if len(names) == 0 {
+		return nil
+	}
+
+	current := make(map[string]*Usage, len(names))
+	for _, name := range names {
+		usage, exists, err := stat(name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			current[name] = &usage
+		} else {
+			current[name] = nil
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	changed := false
+	for name, usage := range current {
+		f, found := o.files[name]
+		switch {
+		case !found:
+		case usage == nil:
+			o.set(name, owned{})
+			changed = true
+		case usage.Bytes != f.Bytes || usage.Files != f.Files:
+			o.set(name, owned{User: f.User, Bytes: usage.Bytes, Files: usage.Files})
+			changed = true
+		}
+	}
+	if changed {
+		o.flush()
+	}
+	return nil
+}
+
+// set replaces the entry of name, an entry without user removes it
+func (o *owners) set(name string, f owned) {
+	o.dirty = append(o.dirty, name)
+	if old, found := o.files[name]; found {
+		o.totals[old.User] = old.add(o.totals[old.User], -1)
+		if o.totals[old.User] == (Usage{}) {
+			delete(o.totals, old.User)
+		}
+		delete(o.files, name)
+	}
+	if f.User == "" {
+		return
+	}
+	o.files[name] = f
+	o.totals[f.User] = f.add(o.totals[f.User], 1)
+}
+
+// flush appends the dirty entries to the journal, errors are logged
+// since the entries are still reconciled with the file systems
+func (o *owners) flush() {
+	dirty := o.dirty
+	o.dirty = nil
+	if o.journal == nil {
+		return
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, name := range dirty {
+		enc.Encode(journalEntry{Name: name, owned: o.files[name]})
+	}
+	if _, err := o.journal.Write(buf.Bytes()); err != nil {
+		slog.Error("Unable to persist file owners", "path", o.statePath, "error", err)
+	}
+	o.appended += len(dirty)
+	if o.appended > len(o.files)+compactAfter {
+		if err := o.compact(); err != nil {
+			slog.Error("Unable to compact file owners", "path", o.statePath, "error", err)
+		}
+	}
+}
+
+// compact replaces the journal with the current entries
+// and opens it again, so new changes are appended to it
+func (o *owners) compact() error {
+	if o.statePath == "" {
+		return nil
+	}
+	if o.journal != nil {
+		o.journal.Close()
+		o.journal = nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for name, f := range o.files {
+		if err := enc.Encode(journalEntry{Name: name, owned: f}); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(o.statePath), filepath.Base(o.statePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), o.statePath)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write file owners to %v: %w", o.statePath, err)
+	}
+	o.journal, err = os.OpenFile(o.statePath, os.O_WRONLY|os.O_APPEND, 0644)
+	o.appended = 0
+	return err
+}
+
+// add returns usage plus (or minus, if sign is negative) the data of f
+func (f owned) add(usage Usage, sign int64) Usage {
+	return Usage{Bytes: usage.Bytes + sign*f.Bytes, Files: usage.Files + sign*f.Files}
+}
+
+// under returns true if name is p or any path under it
+func under(name, p string) bool {
+	return name == p || strings.HasPrefix(name, strings.TrimSuffix(p, "/")+"/")
+}
@@ -0,0 +1,575 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/storage"
+	"golang.org/x/net/webdav"
+)
+
+type (
+	Usage struct {
+		Bytes int64
+		Files int64
+	}
+
+	// Status is the usage and limit of the most restrictive quota
+	// which applies to a path
+	Status struct {
+		Scope string
+		Used  Usage
+		Limit config.Quota
+	}
+
+	// Mount is a file system whose usage is tracked by Manager
+	Mount struct {
+		// FS is the complete storage, including storage.HiddenDir
+		FS webdav.FileSystem
+		// Keeps is true if overwritten files are kept (eg.: in the trash),
+		// so replacing a file does not free its space
+		Keeps bool
+	}
+
+	// Manager tracks how much data is stored under each bind and user home,
+	// and checks writes against the quotas stored in config.DB.
+	//
+	// Usage is computed by walking the file systems, the result is cached
+	// and updated as writes are accounted via Add. Operations which cannot be
+	// easily accounted (eg.: DELETE) should call Invalidate instead.
+	//
+	// The data kept in storage.HiddenDir (trash, versions and upload sessions)
+	// counts towards the bind usage. The quota of a user counts their home
+	// directory and the data they wrote anywhere else (see Charge and AddCharged), it applies
+	// to the writes made by the user and to the writes made to their home.
+	Manager struct {
+		db       *config.DB
+		mounts   map[string]Mount
+		homeBind string
+		owners   *owners
+
+		mu       sync.Mutex
+		trackers map[string]*tracker
+		// pending is the data added by AddCharged which was not charged yet,
+		// keyed by user and URL path
+		pending map[string]map[string]Usage
+		// limits caches the quotas read from db, keyed by bind prefix
+		// or user (see limit)
+		limits map[string]cachedLimit
+		// reconciled checks the files charged to users once
+		// the first mounts are set (see owners)
+		reconciled sync.Once
+	}
+
+	cachedLimit struct {
+		limit    config.Quota
+		loadedAt time.Time
+	}
+
+	scope struct {
+		name    string
+		limit   config.Quota
+		tracker *tracker
+		// user is set for user quotas, which also count the data charged
+		// to the user outside of their home (see owners)
+		user string
+	}
+
+	// tracker caches the result of measure, fs is the file system
+	// being measured (see Manager.tracker)
+	tracker struct {
+		fs      webdav.FileSystem
+		measure func(context.Context) (Usage, error)
+
+		mu        sync.Mutex
+		usage     Usage
+		valid     bool
+		scannedAt time.Time
+	}
+)
+
+const (
+	// maxScanAge forces a new scan from time to time, to account for changes
+	// made outside of davd
+	maxScanAge = 5 * time.Minute
+	// maxLimitAge reloads the quotas from time to time,
+	// since they are changed by other processes (eg.: davd quota set)
+	maxLimitAge = time.Minute
+)
+
+var (
+	ErrExceeded = errors.New("quota exceeded")
+)
+
+// NewManager returns a manager for the given mounts (keyed by URL prefix),
+// paths under homeBind are also checked against the quota of the user which owns
+// the home directory. The data charged to each user is persisted at statePath,
+// an empty path keeps it in memory.
+func NewManager(db *config.DB, mounts map[string]Mount, homeBind, statePath string) (*Manager, error) {
+	owners, err := openOwners(statePath)
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{
+		db:       db,
+		mounts:   mounts,
+		homeBind: path.Clean("/" + homeBind),
+		owners:   owners,
+		trackers: make(map[string]*tracker),
+		pending:  make(map[string]map[string]Usage),
+		limits:   make(map[string]cachedLimit),
+	}, nil
+}
+
+// SetMounts replaces the mounts, used when binds are reloaded,
+// the quotas are also read again from db
+func (m *Manager) SetMounts(mounts map[string]Mount) {
+	m.mu.Lock()
+	m.mounts = mounts
+	clear(m.limits)
+	m.mu.Unlock()
+	m.reconciled.Do(func() {
+		go func() {
+			if err := m.owners.reconcile("/", "", m.stat); err != nil {
+				slog.Error("Unable to update the data charged to users", "error", err)
+			}
+		}()
+	})
+}
+
+// Check returns an error wrapping ErrExceeded if user writing bytes and creating files
+// under p would exceed any quota, user can be empty (eg.: background tasks)
+func (m *Manager) Check(user, p string, bytes, files int64) error {
+	scopes, err := m.scopes(user, p)
+	if err != nil {
+		return err
+	}
+	for _, s := range scopes {
+		if err := m.checkScope(s, bytes, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckTransfer is like Check, but ignores quotas which already count src,
+// since moving data within them does not change their usage
+func (m *Manager) CheckTransfer(user, src, dst string, bytes, files int64) error {
+	srcScopes, err := m.scopes("", src)
+	if err != nil {
+		return err
+	}
+	dstScopes, err := m.scopes(user, dst)
+	if err != nil {
+		return err
+	}
+	dstScopes = slices.DeleteFunc(dstScopes, func(d scope) bool {
+		return slices.ContainsFunc(srcScopes, func(s scope) bool { return s.tracker == d.tracker })
+	})
+	for _, s := range dstScopes {
+		b, f := bytes, files
+		if user != "" && s.user == user {
+			charged := m.owners.usageUnder(user, path.Clean("/"+src))
+			b, f = b-charged.Bytes, f-charged.Files
+		}
+		if err := m.checkScope(s, b, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) checkScope(s scope, bytes, files int64) error {
+	used, err := m.used(s)
+	if err != nil {
+		return err
+	}
+	if s.limit.MaxBytes > 0 && bytes > 0 && used.Bytes+bytes > s.limit.MaxBytes {
+		return fmt.Errorf("%w: %v would use %d of %d bytes", ErrExceeded, s.name, used.Bytes+bytes, s.limit.MaxBytes)
+	}
+	if s.limit.MaxFiles > 0 && files > 0 && used.Files+files > s.limit.MaxFiles {
+		return fmt.Errorf("%w: %v would have %d of %d files", ErrExceeded, s.name, used.Files+files, s.limit.MaxFiles)
+	}
+	return nil
+}
+
+func (m *Manager) used(s scope) (Usage, error) {
+	used, err := s.tracker.current()
+	if err != nil || s.user == "" {
+		return used, err
+	}
+	charged := m.owners.usage(s.user)
+	pending := m.pendingUsage(s.user)
+	return Usage{Bytes: used.Bytes + charged.Bytes + pending.Bytes, Files: used.Files + charged.Files + pending.Files}, nil
+}
+
+// Remaining returns how many bytes user can still write under p,
+// negative values mean there is no limit
+func (m *Manager) Remaining(user, p string) (int64, error) {
+	st, found, err := m.Status(user, p)
+	if err != nil || !found || st.Limit.MaxBytes <= 0 {
+		return -1, err
+	}
+	return max(st.Limit.MaxBytes-st.Used.Bytes, 0), nil
+}
+
+// Freed returns how many bytes are freed by replacing a file of the given size under p,
+// which is zero if the mount keeps overwritten files
+func (m *Manager) Freed(p string, size int64) int64 {
+	prefix, mount := m.mount(p)
+	if prefix == "" || mount.Keeps {
+		return 0
+	}
+	return size
+}
+
+// Add accounts for data written under p, negative values are allowed.
+// Data written outside of the home of the user must also be charged (see Charge).
+func (m *Manager) Add(p string, bytes, files int64) {
+	scopes, err := m.scopes("", p)
+	if err != nil {
+		slog.Error("Unable to account quota usage", "path", p, "error", err)
+		return
+	}
+	for _, s := range scopes {
+		s.tracker.add(bytes, files)
+	}
+}
+
+// AddCharged is like Add, but the data also counts towards the quota of user,
+// without walking p, until p is charged (see Charge) or invalidated.
+// It is meant for data written in many small steps, like the chunks of an upload.
+func (m *Manager) AddCharged(user, p string, bytes, files int64) {
+	m.Add(p, bytes, files)
+	p = path.Clean("/" + p)
+	if user == "" || under(p, path.Join(m.homeBind, user)) {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pending[user] == nil {
+		m.pending[user] = map[string]Usage{}
+	}
+	usage := m.pending[user][p]
+	m.pending[user][p] = Usage{Bytes: usage.Bytes + bytes, Files: usage.Files + files}
+}
+
+// Charge records that user wrote p (and everything under it), replacing whoever
+// wrote it before. Data written to the home directory of the user is already
+// counted as part of it.
+func (m *Manager) Charge(user, p string) {
+	p = path.Clean("/" + p)
+	m.dropPending(p)
+	if user == "" || under(p, path.Join(m.homeBind, user)) {
+		return
+	}
+	prefix, mount := m.mount(p)
+	if prefix == "" {
+		return
+	}
+	files := map[string]Usage{}
+	err := storage.Walk(context.Background(), mount.FS, "/"+strings.TrimPrefix(p, prefix), func(name string, info os.FileInfo) error {
+		files[path.Join(prefix, name)] = entryUsage(name, info)
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		slog.Error("Unable to charge quota usage", "path", p, "user", user, "error", err)
+		return
+	}
+	m.owners.charge(user, files)
+}
+
+// Invalidate forces a new scan of all quotas which apply to p
+func (m *Manager) Invalidate(p string) {
+	scopes, err := m.scopes("", p)
+	if err != nil {
+		slog.Error("Unable to invalidate quota usage", "path", p, "error", err)
+		return
+	}
+	for _, s := range scopes {
+		s.tracker.invalidate()
+	}
+	m.dropPending(path.Clean("/" + p))
+	if err := m.owners.reconcile(path.Clean("/"+p), "", m.stat); err != nil {
+		slog.Error("Unable to update the data charged to users", "path", p, "error", err)
+	}
+}
+
+// pendingUsage returns the data added by AddCharged for user
+func (m *Manager) pendingUsage(user string) Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var usage Usage
+	for _, u := range m.pending[user] {
+		usage.Bytes += u.Bytes
+		usage.Files += u.Files
+	}
+	return usage
+}
+
+// prunePending forgets the data added by AddCharged for user
+// under paths which no longer exist (eg.: purged upload sessions)
+func (m *Manager) prunePending(user string) {
+	m.mu.Lock()
+	var names []string
+	for name := range m.pending[user] {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+	for _, name := range names {
+		if _, exists, err := m.stat(name); err == nil && !exists {
+			m.dropPending(name)
+		}
+	}
+}
+
+// dropPending forgets the data added by AddCharged under p,
+// which is either charged or measured again by the caller
+func (m *Manager) dropPending(p string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for user, paths := range m.pending {
+		for name := range paths {
+			if under(name, p) {
+				delete(paths, name)
+			}
+		}
+		if len(paths) == 0 {
+			delete(m.pending, user)
+		}
+	}
+}
+
+// Status returns the most restrictive quota which applies to user writing under p,
+// found is false if p is not limited by any quota
+func (m *Manager) Status(user, p string) (st Status, found bool, err error) {
+	scopes, err := m.scopes(user, p)
+	if err != nil {
+		return st, false, err
+	}
+	for _, s := range scopes {
+		used, err := m.used(s)
+		if err != nil {
+			return st, false, err
+		}
+		candidate := Status{Scope: s.name, Used: used, Limit: s.limit}
+		if !found || candidate.remainingBytes() < st.remainingBytes() {
+			st, found = candidate, true
+		}
+	}
+	return st, found, nil
+}
+
+func (s Status) remainingBytes() int64 {
+	if s.Limit.MaxBytes <= 0 {
+		return 1<<63 - 1
+	}
+	return s.Limit.MaxBytes - s.Used.Bytes
+}
+
+// scopes returns the quotas which apply to user writing under p
+// (bind, owner of the home directory and user)
+func (m *Manager) scopes(user, p string) ([]scope, error) {
+	p = path.Clean("/" + p)
+	prefix, mount := m.mount(p)
+	if prefix == "" {
+		return nil, nil
+	}
+	var scopes []scope
+	limit, err := m.limit("bind "+prefix, func() (config.Quota, error) {
+		return m.db.BindQuota(prefix)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !limit.Unlimited() {
+		t := m.tracker(prefix, mount.FS, func(ctx context.Context) (Usage, error) {
+			return Measure(ctx, mount.FS, "/")
+		})
+		scopes = append(scopes, scope{name: fmt.Sprintf("bind %v", prefix), limit: limit, tracker: t})
+	}
+	var users []string
+	if prefix == m.homeBind {
+		owner, _, _ := strings.Cut(strings.TrimPrefix(p, prefix+"/"), "/")
+		if config.ValidUsername(owner) {
+			users = append(users, owner)
+		}
+	}
+	if user != "" && !slices.Contains(users, user) {
+		users = append(users, user)
+	}
+	for _, name := range users {
+		s, found, err := m.userScope(name)
+		if err != nil {
+			return nil, err
+		} else if found {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes, nil
+}
+
+// userScope returns the quota of the user, its tracker measures the home directory
+// of the user, the data written elsewhere is charged to the user (see owners)
+func (m *Manager) userScope(user string) (scope, bool, error) {
+	limit, err := m.limit("user "+user, func() (config.Quota, error) {
+		limit, err := m.db.UserQuota(user)
+		if errors.Is(err, config.ErrNoSuchKey) {
+			return config.Quota{}, nil
+		}
+		return limit, err
+	})
+	if err != nil || limit.Unlimited() {
+		return scope{}, false, err
+	}
+	_, home := m.mount(m.homeBind)
+	t := m.tracker(path.Join(m.homeBind, user), home.FS, func(ctx context.Context) (Usage, error) {
+		// changes made outside of davd are also noticed by the data charged to the user
+		if err := m.owners.reconcile("", user, m.stat); err != nil {
+			return Usage{}, err
+		}
+		m.prunePending(user)
+		if home.FS == nil {
+			return Usage{}, nil
+		}
+		return Measure(ctx, home.FS, path.Join("/", user))
+	})
+	return scope{name: fmt.Sprintf("user %v", user), limit: limit, tracker: t, user: user}, true, nil
+}
+
+// limit returns the quota cached under key, load reads it from db
+// once it is missing or older than maxLimitAge
+func (m *Manager) limit(key string, load func() (config.Quota, error)) (config.Quota, error) {
+	m.mu.Lock()
+	cached, found := m.limits[key]
+	m.mu.Unlock()
+	if found && time.Since(cached.loadedAt) < maxLimitAge {
+		return cached.limit, nil
+	}
+	limit, err := load()
+	if err != nil {
+		return limit, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limits[key] = cachedLimit{limit: limit, loadedAt: time.Now()}
+	return limit, nil
+}
+
+// stat returns the usage of the file at the URL path p (see owners.reconcile)
+func (m *Manager) stat(p string) (Usage, bool, error) {
+	prefix, mount := m.mount(p)
+	if prefix == "" {
+		return Usage{}, false, nil
+	}
+	name := "/" + strings.TrimPrefix(p, prefix)
+	info, err := mount.FS.Stat(context.Background(), name)
+	if errors.Is(err, os.ErrNotExist) {
+		return Usage{}, false, nil
+	} else if err != nil {
+		return Usage{}, false, err
+	}
+	return entryUsage(path.Clean(name), info), true, nil
+}
+
+// mount returns the mount which contains p and its URL prefix,
+// the prefix is empty if p is not under any mount
+func (m *Manager) mount(p string) (string, Mount) {
+	p = path.Clean("/" + p)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix := ""
+	for candidate := range m.mounts {
+		if (p == candidate || strings.HasPrefix(p, candidate+"/")) && len(candidate) > len(prefix) {
+			prefix = candidate
+		}
+	}
+	return prefix, m.mounts[prefix]
+}
+
+// tracker returns the tracker for the URL path p, which measures data stored in fs.
+// Trackers are replaced when the bind is reloaded with a different file system.
+func (m *Manager) tracker(p string, fs webdav.FileSystem, measure func(context.Context) (Usage, error)) *tracker {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.trackers[p]
+	if t == nil || t.fs != fs {
+		t = &tracker{fs: fs, measure: measure}
+		m.trackers[p] = t
+	}
+	return t
+}
+
+func (t *tracker) current() (Usage, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.valid && time.Since(t.scannedAt) < maxScanAge {
+		return t.usage, nil
+	}
+	usage, err := t.measure(context.Background())
+	if err != nil {
+		return Usage{}, err
+	}
+	t.usage, t.valid, t.scannedAt = usage, true, time.Now()
+	return t.usage, nil
+}
+
+// Measure returns the number of files, directories and bytes under root (excluding root itself),
+// a missing root is reported as empty. Files under storage.HiddenDir only count their bytes,
+// since they are managed by davd (eg.: the metadata of the trash).
+func Measure(ctx context.Context, fs webdav.FileSystem, root string) (Usage, error) {
+	var usage Usage
+	root = path.Clean("/" + root)
+	err := storage.Walk(ctx, fs, root, func(name string, info os.FileInfo) error {
+		if name == root {
+			return nil
+		}
+		entry := entryUsage(name, info)
+		usage.Bytes += entry.Bytes
+		usage.Files += entry.Files
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return Usage{}, nil
+	}
+	return usage, err
+}
+
+// entryUsage returns the usage of a single entry, files under storage.HiddenDir only count their bytes
+func entryUsage(name string, info os.FileInfo) Usage {
+	var usage Usage
+	if !storage.IsHidden(name) {
+		usage.Files = 1
+	}
+	if info.Mode().IsRegular() {
+		usage.Bytes = info.Size()
+	}
+	return usage
+}
+
+func (t *tracker) add(bytes, files int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.valid {
+		return
+	}
+	t.usage.Bytes = max(t.usage.Bytes+bytes, 0)
+	t.usage.Files = max(t.usage.Files+files, 0)
+}
+
+func (t *tracker) invalidate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.valid = false
+}
@@ -0,0 +1,7 @@
+// Package reserved holds the names davd keeps for its own use,
+// so they can be checked without depending on the packages using them.
+package reserved
+
+// HiddenName is the name of the directory holding the data managed by davd
+// inside a bind (see storage.HiddenDir), it cannot name users or groups
+const HiddenName = ".davd"
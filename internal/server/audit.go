@@ -0,0 +1,97 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/andrebq/davd/internal/audit"
+	"github.com/andrebq/davd/internal/config"
+)
+
+type (
+	// auditResponseWriter captures the status code sent to the client
+	auditResponseWriter struct {
+		http.ResponseWriter
+		status int
+	}
+
+	// countingReader counts how many bytes were read from the request body
+	countingReader struct {
+		io.ReadCloser
+		read int64
+	}
+)
+
+// auditedMethods are the methods which change the content of a bind
+var auditedMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodPost:   true,
+	http.MethodDelete: true,
+	"MOVE":            true,
+	"COPY":            true,
+	"MKCOL":           true,
+	"PROPPATCH":       true,
+}
+
+// auditRequests records every mutating request in log, including the ones
+// rejected by next. Handlers can refine the entry using audit.FromContext
+// (eg.: the drive handlers use form values instead of the Destination header).
+func auditRequests(log *audit.Log, m mounts, next http.Handler) http.Handler {
+	if log == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auditedMethods[r.Method] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p := path.Clean("/" + r.URL.Path)
+		entry := &audit.Entry{
+			Time:   time.Now(),
+			User:   config.UserFromContext(r.Context()).Name,
+			Via:    "webdav",
+			Method: r.Method,
+			Path:   p,
+		}
+		if prefix, ok := m.prefix(p); ok {
+			entry.Bind = strings.TrimPrefix(prefix, "/")
+		}
+		if dst, err := destinationPath(r); err == nil {
+			entry.Destination = dst
+		}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		aw := &auditResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(audit.WithEntry(r.Context(), entry)))
+		entry.Size = body.read
+		entry.Status = aw.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		log.Record(*entry)
+	})
+}
+
+func (a *auditResponseWriter) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditResponseWriter) Write(buf []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	return a.ResponseWriter.Write(buf)
+}
+
+func (c *countingReader) Read(buf []byte) (int, error) {
+	n, err := c.ReadCloser.Read(buf)
+	c.read += int64(n)
+	return n, err
+}
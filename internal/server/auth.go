@@ -1,40 +1,131 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
 	"strings"
 
+	"github.com/andrebq/davd/internal/audit"
 	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/storage"
 )
 
-func Protect(db *config.DB, next http.Handler) http.Handler {
+var (
+	errNoCredentials = errors.New("no credentials provided")
+)
+
+// Protect authenticates the request before passing it to next.
+//
+// Users can authenticate with:
+//   - Basic auth, using their password
+//   - Basic auth, using an API key (see config.FormatAPIKey) as password
+//   - Bearer tokens minted by config.DB.CreateAPIKey
+//
+// Permissions are checked against the request path, m is used to
+// inspect the resources affected by the request (see requiredAccess).
+//
+// Users which must rotate their credentials are denied access until they do so
+// (see changePassword).
+//
+// Mutating requests from authenticated users are recorded in log (which can be nil),
+// even if they are denied.
+func Protect(db *config.DB, m mounts, log *audit.Log, next http.Handler) http.Handler {
+	return authenticated(db, auditRequests(log, m, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := config.UserFromContext(r.Context())
+		if user.RotateCredentials {
+			slog.Warn("User must rotate credentials before accessing resources", "user", user.Name, "path", r.URL.Path)
+			http.Error(w, fmt.Sprintf("Credentials must be rotated, POST a new password to %v", passwordPath), http.StatusForbidden)
+			return
+		}
+		authorize(w, r, m, next)
+	})))
+}
+
+// authenticated checks the user credentials and stores it in the request
+// context, but it does not perform any permission check.
+func authenticated(db *config.DB, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user, pwd, found := r.BasicAuth()
-		if !found {
+		userdata, err := authenticate(db, r)
+		if errors.Is(err, errNoCredentials) {
 			slog.Debug("Access without proper credentials", "path", r.URL.Path)
-			w.Header().Add("WWW-Authenticate", "Basic realm=\"DAVD Server\"")
-			w.WriteHeader(http.StatusUnauthorized)
+			requestCredentials(w)
 			return
-		}
-		_, userdata, err := db.PasswordLogin(user, pwd)
-		if err != nil {
+		} else if err != nil {
 			slog.Error("Error while checking user authentication", "err", err)
-			w.Header().Add("WWW-Authenticate", "Basic realm=\"DAVD Server\"")
-			w.WriteHeader(http.StatusUnauthorized)
+			requestCredentials(w)
 			return
 		}
 		r = r.WithContext(config.WithUser(r.Context(), userdata))
-		authorize(w, r, next)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func authenticate(db *config.DB, r *http.Request) (*config.User, error) {
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		_, userdata, err := db.TokenLogin(strings.TrimSpace(token))
+		return userdata, err
+	}
+	user, pwd, found := r.BasicAuth()
+	if !found {
+		return nil, errNoCredentials
+	}
+	if config.IsAPIKey(pwd) {
+		_, userdata, err := db.APIKeyLogin(user, pwd)
+		return userdata, err
+	}
+	_, userdata, err := db.PasswordLogin(user, pwd)
+	return userdata, err
+}
+
+func requestCredentials(w http.ResponseWriter) {
+	w.Header().Add("WWW-Authenticate", "Basic realm=\"DAVD Server\"")
+	w.Header().Add("WWW-Authenticate", "Bearer realm=\"DAVD Server\"")
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+type (
+	// accessCheck requires any of verbs to be allowed on path
+	accessCheck struct {
+		path  string
+		verbs []config.Verb
+	}
+
+	uploadSessionsKey struct{}
+)
+
+// uploadSessions marks the requests to handlers which serve upload sessions
+// for the ?upload=<id> query (see drive.NewTusHandler), those requests only
+// reach the session of the user and not the file at their path. They require
+// the same verb as writing the file, so users that can only create files are
+// able to resume or abort their uploads.
+func uploadSessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), uploadSessionsKey{}, true)))
 	})
 }
 
-func authorize(w http.ResponseWriter, r *http.Request, next http.Handler) {
+func authorize(w http.ResponseWriter, r *http.Request, m mounts, next http.Handler) {
 	user := config.UserFromContext(r.Context())
-	if !hasPermissions(user.Permissions, r.URL, r.Method) {
-		slog.Error("User attempted to access a resources but lacks permission", "url", r.URL, "method", r.Method)
+	checks, err := requiredAccess(r, m)
+	if err != nil {
+		slog.Debug("Unable to compute required permissions", "url", r.URL, "method", r.Method, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, c := range checks {
+		if !user.CanAny(c.path, c.verbs...) {
+			slog.Error("User attempted to access a resources but lacks permission", "url", r.URL, "method", r.Method, "path", c.path, "verbs", c.verbs, "user", user.Name)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	if !allowedTree(r, m, user) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -42,27 +133,139 @@ func authorize(w http.ResponseWriter, r *http.Request, next http.Handler) {
 	next.ServeHTTP(w, r)
 }
 
-func hasPermissions(perm []config.Permission, url *url.URL, method string) bool {
-	var assigned config.Permission
-	for _, v := range perm {
-		prefix := v.Prefix
-		if !strings.HasSuffix(prefix, "/") {
-			prefix = fmt.Sprintf("%v/", v)
+// requiredAccess maps the request to the list of verbs the user must have,
+// mounts are used to check if the target resources exist
+// (eg.: PUT requires create or overwrite, depending on the target).
+func requiredAccess(r *http.Request, m mounts) ([]accessCheck, error) {
+	p := path.Clean("/" + r.URL.Path)
+	single := func(verbs ...config.Verb) []accessCheck {
+		return []accessCheck{{path: p, verbs: verbs}}
+	}
+	if r.Context().Value(uploadSessionsKey{}) != nil && r.URL.Query().Has("upload") {
+		return single(m.writeVerb(p)), nil
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if p == "/" {
+			// landing pages (eg.: /drive/) only list what the user can reach
+			return nil, nil
 		}
-		if strings.HasPrefix(url.Path, prefix) && (v.Writer || v.Reader || v.Execute) {
-			assigned = v
-			break
+		if m.isDir(p) {
+			return single(config.VerbList), nil
 		}
+		return single(config.VerbRead), nil
+	case http.MethodOptions:
+		return single(config.VerbRead, config.VerbList), nil
+	case "PROPFIND":
+		return single(config.VerbList), nil
+	case http.MethodPut, http.MethodPatch:
+		// PATCH is only used by tus uploads (see drive.NewTusHandler)
+		return single(m.writeVerb(p)), nil
+	case "MKCOL":
+		return single(config.VerbCreate), nil
+	case http.MethodDelete:
+		return single(config.VerbDelete), nil
+	case "MOVE", "COPY":
+		dst, err := destinationPath(r)
+		if err != nil {
+			return nil, err
+		}
+		srcVerb := config.VerbMove
+		if r.Method == "COPY" {
+			srcVerb = config.VerbRead
+		}
+		return []accessCheck{
+			{path: p, verbs: []config.Verb{srcVerb}},
+			{path: dst, verbs: []config.Verb{m.writeVerb(dst)}},
+		}, nil
+	case "LOCK", "UNLOCK":
+		return single(config.VerbLock), nil
+	case "PROPPATCH":
+		return single(config.VerbPropSet), nil
+	case http.MethodPost:
+		// POST is only used by the drive handlers which perform
+		// fine grained checks based on the form values
+		return single(config.VerbCreate, config.VerbMove, config.VerbDelete), nil
+	}
+	return nil, fmt.Errorf("unsupported method: %v", r.Method)
+}
+
+// allowedTree checks every entry under the collections changed by DELETE, MOVE
+// and COPY (requiredAccess only checks the request path), so a rule denying
+// access to an entry is not bypassed by sending the request to one of its parents.
+//
+// Entries must allow the verb required on the source and the ones moved or copied
+// must be allowed to be created at the destination. Existing destinations are
+// removed before they are overwritten, so their entries must allow delete.
+func allowedTree(r *http.Request, m mounts, user *config.User) bool {
+	p := path.Clean("/" + r.URL.Path)
+	var srcVerb config.Verb
+	switch r.Method {
+	case http.MethodDelete:
+		return allowedUnder(r, m, user, p, func(entry string) bool {
+			return user.Can(config.VerbDelete, entry)
+		})
+	case "MOVE":
+		srcVerb = config.VerbMove
+	case "COPY":
+		srcVerb = config.VerbRead
+	default:
+		return true
 	}
-	if assigned.Prefix == "" {
+	dst, err := destinationPath(r)
+	if err != nil {
+		// already refused by requiredAccess
 		return false
 	}
+	if r.Header.Get("Overwrite") != "F" {
+		ok := allowedUnder(r, m, user, dst, func(entry string) bool {
+			return user.Can(config.VerbDelete, entry)
+		})
+		if !ok {
+			return false
+		}
+	}
+	if r.Method == "COPY" && r.Header.Get("Depth") == "0" {
+		// only the collection itself is copied
+		return true
+	}
+	return allowedUnder(r, m, user, p, func(entry string) bool {
+		return user.Can(srcVerb, entry) && user.Can(config.VerbCreate, path.Join(dst, strings.TrimPrefix(entry, p)))
+	})
+}
 
-	switch method {
-	case "GET", "PROPFIND":
-		// writers can also read data, therefore we dont need to check if CanWrite is true
-		return assigned.Reader
+// allowedUnder calls allowed with the URL path of every entry under the collection p,
+// returns false if any entry is not allowed. Files and missing paths have no entries.
+func allowedUnder(r *http.Request, m mounts, user *config.User, p string, allowed func(entry string) bool) bool {
+	fsys, name, ok := m.resolve(p)
+	if !ok {
+		return true
+	}
+	if st, err := fsys.Stat(r.Context(), name); err != nil || !st.IsDir() {
+		return true
+	}
+	err := storage.Walk(r.Context(), fsys, name, func(entry string, _ os.FileInfo) error {
+		if entry == name {
+			return nil
+		}
+		entry = path.Join(p, strings.TrimPrefix(entry, name))
+		if !allowed(entry) {
+			slog.Error("User attempted to change a collection but lacks permission on an entry", "url", r.URL, "method", r.Method, "path", entry, "user", user.Name)
+			return os.ErrPermission
+		}
+		return nil
+	})
+	return err == nil
+}
 
+func destinationPath(r *http.Request) (string, error) {
+	hdr := r.Header.Get("Destination")
+	if hdr == "" {
+		return "", errors.New("missing destination header")
+	}
+	u, err := url.Parse(hdr)
+	if err != nil {
+		return "", fmt.Errorf("invalid destination header: %w", err)
 	}
-	return assigned.Writer
+	return path.Clean("/" + u.Path), nil
 }
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/andrebq/davd/internal/audit"
+	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/drive"
+	"github.com/andrebq/davd/internal/locks"
+	"github.com/andrebq/davd/internal/quota"
+	"github.com/andrebq/davd/internal/storage"
+	"github.com/andrebq/davd/internal/trash"
+	"github.com/andrebq/davd/internal/uploads"
+	"github.com/andrebq/davd/internal/versions"
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// bindRoutes serves /binds/, /home/, /browser/, /drive/ and /tus/ using the
+	// binds loaded from the binds file, the routes are rebuilt by reload
+	// while requests in flight keep using the routes they started with.
+	bindRoutes struct {
+		db       *config.DB
+		env      Environ
+		homeDir  string
+		locks    *locks.System
+		quotas   *quota.Manager
+		auditLog *audit.Log
+		// maxMemory is passed to drive.Options.MaxMemory
+		maxMemory int64
+
+		mu      sync.Mutex
+		binds   []config.Bind
+		stores  map[string]bindStores
+		current atomic.Pointer[http.ServeMux]
+	}
+
+	// bindStores are the hidden stores of a bind (see storage.HiddenDir),
+	// versions is nil if the bind is not versioned and trash is nil for home
+	bindStores struct {
+		trash    *trash.Bin
+		versions *versions.Store
+		uploads  *uploads.Store
+	}
+)
+
+func (b *bindRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.current.Load().ServeHTTP(w, r)
+}
+
+// reload reads the binds file and replaces the routes,
+// if the file is invalid the previous routes are kept.
+func (b *bindRoutes) reload() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	binds, err := b.db.LoadBinds()
+	if err != nil {
+		return err
+	}
+	for _, eb := range envBinds(b.env.Entries, b.env.Expand) {
+		if slices.ContainsFunc(binds, func(fb config.Bind) bool { return fb.Name == eb.Name }) {
+			slog.Warn("Bind defined in the binds file and in the environment, ignoring the environment", "name", eb.Name)
+			continue
+		}
+		binds = append(binds, eb)
+	}
+	binds = slices.DeleteFunc(binds, func(bind config.Bind) bool {
+		local, ok := storage.LocalPath(bind.Path)
+		if !ok {
+			return false
+		}
+		st, err := os.Stat(local)
+		if err != nil || !st.IsDir() {
+			slog.Error("Ignoring bind, path is not a directory", "name", bind.Name, "path", bind.Path, "error", err)
+			return true
+		}
+		return false
+	})
+	mux, stores, err := b.routes(binds)
+	if err != nil {
+		return err
+	}
+	b.current.Store(mux)
+	b.stores = stores
+	b.logChanges(binds)
+	b.binds = binds
+	return nil
+}
+
+func (b *bindRoutes) logChanges(binds []config.Bind) {
+	for _, bind := range binds {
+		idx := slices.IndexFunc(b.binds, func(old config.Bind) bool { return old.Name == bind.Name })
+		switch {
+		case idx < 0:
+			slog.Info("Bind added", "name", bind.Name, "path", bind.Path)
+		case b.binds[idx] != bind:
+			slog.Info("Bind updated", "name", bind.Name, "path", bind.Path)
+		}
+	}
+	for _, old := range b.binds {
+		if !slices.ContainsFunc(binds, func(bind config.Bind) bool { return bind.Name == old.Name }) {
+			slog.Info("Bind removed", "name", old.Name, "path", old.Path)
+		}
+	}
+}
+
+func (b *bindRoutes) routes(binds []config.Bind) (*http.ServeMux, map[string]bindStores, error) {
+	// binds are keyed by their URL prefix, which is the same for all handlers,
+	// mounts do not expose storage.HiddenDir which is only used by the stores
+	allMounts := mounts{}
+	modes := bindModes{}
+	storages := map[string]webdav.FileSystem{}
+	stores := map[string]bindStores{}
+	binds = slices.DeleteFunc(slices.Clone(binds), func(bind config.Bind) bool {
+		fsys, err := b.db.OpenBindStorage(bind)
+		if err != nil {
+			slog.Error("Ignoring bind, unable to open storage", "name", bind.Name, "path", bind.Path, "error", err)
+			return true
+		}
+		allMounts[path.Join("/", "binds", bind.Name)] = storage.Hide(fsys)
+		storages[path.Join("/", "binds", bind.Name)] = fsys
+		bs := bindStores{trash: trash.NewBin(fsys), uploads: uploads.NewStore(fsys)}
+		if bind.Versioned() {
+			bs.versions = versions.NewStore(fsys, versions.Policy{Keep: bind.KeepVersions, Window: time.Duration(bind.VersionsWindow)})
+		}
+		stores[path.Join("/", "binds", bind.Name)] = bs
+		modes[path.Join("/", "binds", bind.Name)] = bind.Mode
+		return false
+	})
+	home := webdav.Dir(b.homeDir)
+	allMounts[path.Join("/", HomeBind)] = storage.Hide(home)
+	stores[path.Join("/", HomeBind)] = bindStores{uploads: uploads.NewStore(home)}
+
+	bindsMuxer := http.NewServeMux()
+	for _, bind := range binds {
+		prefix := path.Join("/", "binds", bind.Name)
+		fsys := trash.FS(allMounts[prefix], stores[prefix].trash)
+		if stores[prefix].versions != nil {
+			fsys = versions.FS(fsys, stores[prefix].versions)
+		}
+		bindsMuxer.Handle(prefix+"/", &davBind{
+			prefix:    prefix + "/",
+			namespace: path.Join("binds", bind.Name),
+			fileSystem: &stageFS{
+				FileSystem: &quotaFS{
+					FileSystem: &modeFS{FileSystem: fsys, mode: bind.Mode},
+					prefix:     prefix + "/",
+					quotas:     b.quotas,
+				},
+				raw: storages[prefix],
+			},
+			locks: b.locks,
+		})
+	}
+	homeMuxer := &davBind{
+		prefix:    "/home/",
+		namespace: HomeBind,
+		fileSystem: &stageFS{
+			FileSystem: &quotaFS{FileSystem: allMounts["/home"], prefix: "/home/", quotas: b.quotas},
+			raw:        home,
+		},
+		locks: b.locks,
+	}
+
+	browserMuxer := http.NewServeMux()
+	driveBindings := drive.Bindings{}
+	for prefix, fsys := range allMounts {
+		browserMuxer.Handle(prefix+"/", http.StripPrefix(prefix+"/", browse(prefix, fsys)))
+		driveBindings[strings.TrimPrefix(prefix, "/")] = drive.Bind{FS: fsys, Mode: modes[prefix], Trash: stores[prefix].trash, Versions: stores[prefix].versions, Uploads: stores[prefix].uploads, PerUser: prefix == "/"+HomeBind}
+	}
+	for _, bind := range binds {
+		db := driveBindings[path.Join("binds", bind.Name)]
+		db.Description = bind.Description
+		driveBindings[path.Join("binds", bind.Name)] = db
+	}
+	driveOpts := drive.Options{
+		Locks:     b.locks,
+		Quotas:    b.quotas,
+		MaxMemory: b.maxMemory,
+	}
+	driveMuxer, err := drive.NewHandler(driveBindings, driveOpts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create drive handler: %w", err)
+	}
+	tusMuxer, err := drive.NewTusHandler(driveBindings, driveOpts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create tus handler: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/binds/", Protect(b.db, allMounts, b.auditLog, ensureHome(b.homeDir, enforceModes(modes, allMounts, enforceQuota(b.quotas, allMounts, bindsMuxer)))))
+	mux.Handle("/home/", Protect(b.db, allMounts, b.auditLog, ensureHome(b.homeDir, enforceQuota(b.quotas, allMounts, homeMuxer))))
+	mux.Handle("/browser/", http.StripPrefix("/browser", Protect(b.db, allMounts, b.auditLog, ensureHome(b.homeDir, browserMuxer))))
+	mux.Handle("/drive/", http.StripPrefix("/drive", uploadSessions(Protect(b.db, allMounts, b.auditLog, ensureHome(b.homeDir, driveMuxer)))))
+	mux.Handle("/tus/", http.StripPrefix("/tus", uploadSessions(Protect(b.db, allMounts, b.auditLog, ensureHome(b.homeDir, tusMuxer)))))
+	for _, bind := range binds {
+		// binds used to be served under /drive/<bind>/, the old links are redirected
+		if bind.Name != "binds" && bind.Name != HomeBind {
+			mux.Handle(path.Join("/drive", bind.Name)+"/", authenticated(b.db, http.HandlerFunc(redirectDrive)))
+		}
+	}
+	// quotas measure the complete storages, binds keep overwritten files in their trash
+	quotaMounts := map[string]quota.Mount{path.Join("/", HomeBind): {FS: home}}
+	for prefix, fsys := range storages {
+		quotaMounts[prefix] = quota.Mount{FS: fsys, Keeps: true}
+	}
+	// only once nothing can fail, a failed reload keeps the previous mounts
+	b.quotas.SetMounts(quotaMounts)
+	return mux, stores, nil
+}
+
+// redirectDrive redirects /drive/<bind>/... to /drive/binds/<bind>/...
+func redirectDrive(w http.ResponseWriter, r *http.Request) {
+	u := url.URL{Path: "/drive/binds" + strings.TrimPrefix(r.URL.Path, "/drive"), RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+}
+
+// browse serves the files of fsys, directories only list what the user can reach
+func browse(prefix string, fsys webdav.FileSystem) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		visible := &visibleFS{FileSystem: fsys, prefix: prefix, user: config.UserFromContext(r.Context())}
+		http.FileServer(storage.HTTPFileSystem(visible)).ServeHTTP(w, r)
+	})
+}
+
+// watch reloads the binds on SIGHUP or when the binds file changes,
+// the file is checked every interval (zero disables the check).
+func (b *bindRoutes) watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	last := fileVersion(b.db.BindsFile())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("SIGHUP received, reloading binds")
+		case <-tick:
+			current := fileVersion(b.db.BindsFile())
+			if current == last {
+				continue
+			}
+			last = current
+			slog.Info("Binds file changed, reloading binds", "file", b.db.BindsFile())
+		}
+		if err := b.reload(); err != nil {
+			slog.Error("Unable to reload binds, keeping the previous ones", "error", err)
+		}
+	}
+}
+
+// cleanup removes items which stayed in the trash of any bind for longer than
+// trashRetention, upload sessions idle for longer than uploadExpiry (zero keeps
+// them) and prunes versions every interval, until ctx is done
+func (b *bindRoutes) cleanup(ctx context.Context, trashRetention, uploadExpiry, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		b.mu.Lock()
+		stores := b.stores
+		b.mu.Unlock()
+		for prefix, bs := range stores {
+			if bs.trash != nil && trashRetention > 0 {
+				purged, err := bs.trash.PurgeBefore(ctx, time.Now().Add(-trashRetention))
+				if err != nil {
+					slog.Error("Unable to purge trash", "bind", prefix, "error", err)
+				} else if purged > 0 {
+					slog.Info("Purged expired items from trash", "bind", prefix, "items", purged)
+					b.quotas.Invalidate(prefix)
+				}
+			}
+			if bs.versions != nil {
+				if versioned, err := bs.versions.PruneAll(ctx); err != nil {
+					slog.Error("Unable to prune versions", "bind", prefix, "error", err)
+				} else if versioned > 0 {
+					b.quotas.Invalidate(prefix)
+				}
+			}
+			if uploadExpiry > 0 {
+				purged, err := bs.uploads.PurgeBefore(ctx, time.Now().Add(-uploadExpiry))
+				if err != nil {
+					slog.Error("Unable to purge stale uploads", "bind", prefix, "error", err)
+				} else if purged > 0 {
+					slog.Info("Purged stale uploads", "bind", prefix, "sessions", purged)
+					b.quotas.Invalidate(prefix)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fileVersion changes whenever the file is modified, created or removed
+func fileVersion(file string) string {
+	st, err := os.Stat(file)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%v:%v", st.ModTime().UnixNano(), st.Size())
+}
@@ -1,39 +1,45 @@
 package server
 
 import (
-	"context"
 	"log/slog"
+	"path/filepath"
 	"regexp"
 	"sort"
-)
 
-type (
-	DynamicBindings struct {
-		Entries map[string]string
-	}
+	"github.com/andrebq/davd/internal/config"
 )
 
-func UpdateDynamicBinds(ctx context.Context, environ func() []string, expandEnv func(string) string) (*DynamicBindings, error) {
+// envBinds parses the deprecated DAVD_DYNBIND_<VAR>=<name>:<path> variables,
+// binds should be defined in the binds file instead (see config.DB.BindsFile).
+func envBinds(environ func() []string, expandEnv func(string) string) []config.Bind {
 	vars := environ()
 	sort.Strings(vars)
 
-	varnameRE := regexp.MustCompile("^DAVD_DYNBIND_([A-Z]+)=(.*)$")
-	bindVal := regexp.MustCompile("^([a-z0-9]+):(.*)$")
-	dynbind := DynamicBindings{
-		Entries: make(map[string]string),
-	}
+	varnameRE := regexp.MustCompile("^DAVD_DYNBIND_([A-Za-z0-9_]+)=(.*)$")
+	bindVal := regexp.MustCompile("^([^:]+):(.*)$")
+	var binds []config.Bind
 	for _, v := range vars {
 		matches := varnameRE.FindAllStringSubmatch(v, -1)
-		if len(matches) == 1 {
-			value := matches[0][2]
-			nameAndPath := bindVal.FindAllStringSubmatch(expandEnv(value), -1)
-			if len(nameAndPath) == 1 {
-				bindName := nameAndPath[0][1]
-				bindPath := nameAndPath[0][2]
-				slog.Info("Found dynamic binding", "name", bindName, "path", bindPath)
-				dynbind.Entries[nameAndPath[0][1]] = nameAndPath[0][2]
-			}
+		if len(matches) != 1 {
+			continue
+		}
+		nameAndPath := bindVal.FindAllStringSubmatch(expandEnv(matches[0][2]), -1)
+		if len(nameAndPath) != 1 {
+			slog.Warn("Ignoring invalid dynamic binding, expected <name>:<path>", "var", v)
+			continue
+		}
+		bindPath, err := filepath.Abs(nameAndPath[0][2])
+		if err != nil {
+			slog.Warn("Ignoring invalid dynamic binding", "var", v, "error", err)
+			continue
+		}
+		b := config.Bind{Name: nameAndPath[0][1], Path: bindPath}
+		if err := b.Validate(); err != nil {
+			slog.Warn("Ignoring invalid dynamic binding", "var", v, "error", err)
+			continue
 		}
+		slog.Warn("DAVD_DYNBIND_* variables are deprecated, move the bind to the binds file", "name", b.Name, "path", b.Path)
+		binds = append(binds, b)
 	}
-	return &dynbind, nil
+	return binds
 }
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/andrebq/davd/internal/config"
+)
+
+const (
+	// HomeBind is the name used to expose the home directories from the root dir
+	HomeBind = "home"
+)
+
+// ensureHome creates the home directory of the authenticated user (if needed)
+// before passing the request to next.
+func ensureHome(homeDir string, next http.Handler) http.Handler {
+	var created sync.Map
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := config.UserFromContext(r.Context())
+		if _, done := created.Load(user.Name); !done && config.ValidUsername(user.Name) {
+			userHome := filepath.Join(homeDir, user.Name)
+			err := os.MkdirAll(userHome, 0755)
+			if err != nil {
+				slog.Error("Unable to create user home directory", "user", user.Name, "path", userHome, "error", err)
+				http.Error(w, "Unable to setup home directory", http.StatusInternalServerError)
+				return
+			}
+			created.Store(user.Name, struct{}{})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
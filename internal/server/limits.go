@@ -0,0 +1,24 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// limitRequests rejects requests with a body larger than maxSize with
+// 413 Request Entity Too Large, bodies of unknown length fail once they
+// exceed maxSize (see http.MaxBytesReader). Zero removes the limit.
+func limitRequests(maxSize int64, next http.Handler) http.Handler {
+	if maxSize <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxSize {
+			slog.Warn("Request body too large", "path", r.URL.Path, "method", r.Method, "size", r.ContentLength, "max", maxSize)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+		next.ServeHTTP(w, r)
+	})
+}
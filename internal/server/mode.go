@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/andrebq/davd/internal/config"
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// bindModes maps URL prefixes (see mounts) to the mode of the bind
+	bindModes map[string]config.BindMode
+
+	// modeFS refuses changes not allowed by the bind mode,
+	// even if the request reached the file system
+	modeFS struct {
+		webdav.FileSystem
+		mode config.BindMode
+	}
+)
+
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
+func (bm bindModes) mode(m mounts, p string) config.BindMode {
+	prefix, ok := m.prefix(p)
+	if !ok {
+		return config.BindModeNormal
+	}
+	return bm[prefix]
+}
+
+// enforceModes rejects requests which are not allowed by the mode of the bind
+// with 403 Forbidden, the checks use the same verbs as the permissions (see requiredAccess).
+func enforceModes(modes bindModes, m mounts, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks, err := requiredAccess(r, m)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, exists := m.stat(r.URL.Path); r.Method == "LOCK" && !exists {
+			// locking an unmapped URL creates an empty file
+			checks = []accessCheck{{path: path.Clean("/" + r.URL.Path), verbs: []config.Verb{config.VerbCreate}}}
+		}
+		for _, c := range checks {
+			mode := modes.mode(m, c.path)
+			if modeAllowsAny(mode, m, c) {
+				continue
+			}
+			slog.Warn("Request refused by bind mode", "method", r.Method, "path", c.path, "mode", mode, "user", config.UserFromContext(r.Context()).Name)
+			http.Error(w, fmt.Sprintf("Bind is %v", mode), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func modeAllowsAny(mode config.BindMode, m mounts, c accessCheck) bool {
+	for _, v := range c.verbs {
+		if mode.Allows(v) {
+			return true
+		}
+		if v == config.VerbOverwrite && mode == config.BindModeWriteOnce {
+			if st, exists := m.stat(c.path); exists && st.Mode().IsRegular() && st.Size() == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *modeFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if f.mode == config.BindModeReadOnly {
+		return os.ErrPermission
+	}
+	return f.FileSystem.Mkdir(ctx, name, perm)
+}
+
+func (f *modeFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&writeFlags == 0 {
+		return f.FileSystem.OpenFile(ctx, name, flag, perm)
+	}
+	switch f.mode {
+	case config.BindModeReadOnly:
+		return nil, os.ErrPermission
+	case config.BindModeWriteOnce:
+		st, err := f.FileSystem.Stat(ctx, name)
+		if err == nil && (!st.Mode().IsRegular() || st.Size() > 0) {
+			return nil, os.ErrPermission
+		}
+		if err != nil {
+			// only create the file if it still does not exist
+			flag |= os.O_CREATE | os.O_EXCL
+		}
+	}
+	return f.FileSystem.OpenFile(ctx, name, flag, perm)
+}
+
+func (f *modeFS) RemoveAll(ctx context.Context, name string) error {
+	if f.mode == config.BindModeReadOnly || f.mode == config.BindModeWriteOnce {
+		return os.ErrPermission
+	}
+	return f.FileSystem.RemoveAll(ctx, name)
+}
+
+func (f *modeFS) Rename(ctx context.Context, oldName, newName string) error {
+	if f.mode == config.BindModeReadOnly || f.mode == config.BindModeWriteOnce {
+		return os.ErrPermission
+	}
+	return f.FileSystem.Rename(ctx, oldName, newName)
+}
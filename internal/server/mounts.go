@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/andrebq/davd/internal/config"
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// mounts maps URL prefixes (eg.: /binds/scratch) to the file system of the bind,
+	// the same URL prefix is used by WebDAV, /browser and /drive (after
+	// removing their own prefix), which keeps permissions consistent across them.
+	mounts map[string]webdav.FileSystem
+)
+
+// prefix returns the longest URL prefix which contains p
+func (m mounts) prefix(p string) (string, bool) {
+	p = path.Clean("/" + p)
+	best := ""
+	for prefix := range m {
+		if (p == prefix || strings.HasPrefix(p, prefix+"/")) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	return best, best != ""
+}
+
+// resolve returns the file system for the given URL path and
+// the name of p inside of it
+func (m mounts) resolve(p string) (webdav.FileSystem, string, bool) {
+	p = path.Clean("/" + p)
+	best, ok := m.prefix(p)
+	if !ok {
+		return nil, "", false
+	}
+	return m[best], path.Clean("/" + strings.TrimPrefix(p, best)), true
+}
+
+func (m mounts) stat(p string) (os.FileInfo, bool) {
+	fsys, name, ok := m.resolve(p)
+	if !ok {
+		return nil, false
+	}
+	st, err := fsys.Stat(context.Background(), name)
+	return st, err == nil
+}
+
+func (m mounts) isDir(p string) bool {
+	st, ok := m.stat(p)
+	return ok && st.IsDir()
+}
+
+// writeVerb returns the verb required to write to p
+func (m mounts) writeVerb(p string) config.Verb {
+	if _, exists := m.stat(p); exists {
+		return config.VerbOverwrite
+	}
+	return config.VerbCreate
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/andrebq/davd/internal/config"
+)
+
+const (
+	passwordPath      = "/auth/password"
+	minPasswordLength = 8
+)
+
+// changePassword replaces the password of the authenticated user
+// with the content of the request body (leading/trailing whitespace is removed).
+func changePassword(db *config.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := config.UserFromContext(r.Context())
+		passwd, err := io.ReadAll(io.LimitReader(r.Body, 1024))
+		if err != nil {
+			http.Error(w, "Unable to read new password", http.StatusBadRequest)
+			return
+		}
+		passwd = bytes.TrimSpace(passwd)
+		if len(passwd) < minPasswordLength {
+			http.Error(w, "Password is too short", http.StatusBadRequest)
+			return
+		}
+		err = db.UpdatePassword(user.Name, string(passwd))
+		if err != nil {
+			slog.Error("Unable to update password", "user", user.Name, "error", err)
+			http.Error(w, "Unable to update password", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Password updated", "user", user.Name)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/quota"
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// quotaFS exposes the RFC 4331 quota properties on collections
+	quotaFS struct {
+		webdav.FileSystem
+		prefix string
+		quotas *quota.Manager
+	}
+
+	quotaFile struct {
+		webdav.File
+		path   string
+		user   string
+		quotas *quota.Manager
+	}
+
+	// quotaReader stops reading once the request body exceeds the remaining quota,
+	// tooLarge is set if the body exceeded the maximum request size (see limitRequests)
+	// and done once the whole body was read (see stageFS)
+	quotaReader struct {
+		io.ReadCloser
+		remaining int64
+		read      int64
+		exceeded  bool
+		tooLarge  bool
+		done      bool
+	}
+
+	// quotaResponseWriter replaces the error written by webdav.Handler
+	// when the request failed because the quota or the request size was exceeded
+	quotaResponseWriter struct {
+		http.ResponseWriter
+		body        *quotaReader
+		status      int
+		replaced    bool
+		wroteHeader bool
+	}
+)
+
+var (
+	quotaAvailableBytes = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+	quotaUsedBytes      = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+)
+
+// enforceQuota rejects WebDAV requests which would exceed a quota with
+// 507 Insufficient Storage, before any data is written to disk,
+// and accounts the data written by successful requests to the user.
+func enforceQuota(quotas *quota.Manager, m mounts, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean("/" + r.URL.Path)
+		user := config.UserNameFromContext(r.Context())
+		// written is charged to the user if the request succeeds
+		var written string
+		switch r.Method {
+		case http.MethodPut:
+			putWithQuota(quotas, m, user, p, w, r, next)
+			return
+		case "MKCOL", "LOCK":
+			if _, exists := m.stat(p); exists {
+				break
+			}
+			if err := quotas.Check(user, p, 0, 1); err != nil {
+				insufficientStorage(w, err)
+				return
+			}
+			defer quotas.Invalidate(p)
+			written = p
+		case "COPY", "MOVE":
+			dst, err := destinationPath(r)
+			if err != nil {
+				break
+			}
+			usage, err := localUsage(r.Context(), m, p)
+			if err != nil {
+				slog.Error("Unable to compute usage of source", "path", p, "error", err)
+				http.Error(w, "Unable to check quota", http.StatusInternalServerError)
+				return
+			}
+			if r.Method == "MOVE" {
+				err = quotas.CheckTransfer(user, p, dst, usage.Bytes, usage.Files)
+			} else {
+				err = quotas.Check(user, dst, usage.Bytes, usage.Files)
+			}
+			if err != nil {
+				insufficientStorage(w, err)
+				return
+			}
+			defer quotas.Invalidate(p)
+			defer quotas.Invalidate(dst)
+			written = dst
+		case http.MethodDelete:
+			defer quotas.Invalidate(p)
+		}
+		if written == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := &auditResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status < 300 {
+			quotas.Charge(user, written)
+		}
+	})
+}
+
+func putWithQuota(quotas *quota.Manager, m mounts, user, p string, w http.ResponseWriter, r *http.Request, next http.Handler) {
+	var freed, newFiles int64
+	st, exists := m.stat(p)
+	if exists {
+		freed = quotas.Freed(p, st.Size())
+	} else {
+		newFiles = 1
+	}
+	if r.ContentLength >= 0 {
+		if err := quotas.Check(user, p, r.ContentLength-freed, newFiles); err != nil {
+			insufficientStorage(w, err)
+			return
+		}
+	} else if err := quotas.Check(user, p, 0, newFiles); err != nil {
+		insufficientStorage(w, err)
+		return
+	}
+	remaining, err := quotas.Remaining(user, p)
+	if err != nil {
+		slog.Error("Unable to check quota", "path", p, "error", err)
+		http.Error(w, "Unable to check quota", http.StatusInternalServerError)
+		return
+	}
+	body := &quotaReader{ReadCloser: r.Body, remaining: -1}
+	if remaining >= 0 {
+		body.remaining = remaining + freed
+	}
+	r.Body = body
+	qw := &quotaResponseWriter{ResponseWriter: w, body: body}
+	next.ServeHTTP(qw, r.WithContext(withPutBody(r.Context(), body)))
+
+	switch {
+	case body.exceeded || body.tooLarge:
+		// the staged file was discarded and the target left as it was (see stageFS),
+		// removing it here could remove a file created meanwhile by another request
+		quotas.Invalidate(p)
+	case qw.status < 300:
+		quotas.Add(p, body.read-freed, newFiles)
+		quotas.Charge(user, p)
+	default:
+		quotas.Invalidate(p)
+	}
+}
+
+func insufficientStorage(w http.ResponseWriter, err error) {
+	slog.Warn("Request rejected by quota", "error", err)
+	http.Error(w, err.Error(), http.StatusInsufficientStorage)
+}
+
+// localUsage returns the size of p (recursively if p is a directory)
+func localUsage(ctx context.Context, m mounts, p string) (quota.Usage, error) {
+	fsys, name, ok := m.resolve(p)
+	if !ok {
+		return quota.Usage{}, nil
+	}
+	st, err := fsys.Stat(ctx, name)
+	if errors.Is(err, os.ErrNotExist) {
+		return quota.Usage{}, nil
+	} else if err != nil {
+		return quota.Usage{}, err
+	}
+	if !st.IsDir() {
+		return quota.Usage{Bytes: st.Size(), Files: 1}, nil
+	}
+	usage, err := quota.Measure(ctx, fsys, name)
+	usage.Files++
+	return usage, err
+}
+
+func (q *quotaReader) Read(buf []byte) (int, error) {
+	if q.remaining >= 0 && q.read >= q.remaining {
+		// only fail if there is more data to read
+		var probe [1]byte
+		n, err := q.ReadCloser.Read(probe[:])
+		if n > 0 {
+			q.exceeded = true
+			return 0, quota.ErrExceeded
+		}
+		q.done = errors.Is(err, io.EOF)
+		return 0, io.EOF
+	}
+	if q.remaining >= 0 && int64(len(buf)) > q.remaining-q.read {
+		buf = buf[:q.remaining-q.read]
+	}
+	n, err := q.ReadCloser.Read(buf)
+	q.read += int64(n)
+	if errors.As(err, new(*http.MaxBytesError)) {
+		q.tooLarge = true
+	}
+	q.done = err == io.EOF
+	return n, err
+}
+
+func (q *quotaResponseWriter) WriteHeader(status int) {
+	if q.wroteHeader {
+		return
+	}
+	q.wroteHeader = true
+	q.status = status
+	if q.body.exceeded && status >= 400 {
+		q.replaced = true
+		q.status = http.StatusInsufficientStorage
+		http.Error(q.ResponseWriter, quota.ErrExceeded.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if q.body.tooLarge && status >= 400 {
+		q.replaced = true
+		q.status = http.StatusRequestEntityTooLarge
+		http.Error(q.ResponseWriter, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	q.ResponseWriter.WriteHeader(status)
+}
+
+func (q *quotaResponseWriter) Write(buf []byte) (int, error) {
+	if !q.wroteHeader {
+		q.WriteHeader(http.StatusOK)
+	}
+	if q.replaced {
+		return len(buf), nil
+	}
+	return q.ResponseWriter.Write(buf)
+}
+
+func (q *quotaFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := q.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaFile{File: f, path: path.Join(q.prefix, name), user: config.UserNameFromContext(ctx), quotas: q.quotas}, nil
+}
+
+func (q *quotaFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	st, err := q.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, nil
+	}
+	status, found, err := q.quotas.Status(q.user, q.path)
+	if err != nil || !found || status.Limit.MaxBytes <= 0 {
+		return nil, err
+	}
+	available := max(status.Limit.MaxBytes-status.Used.Bytes, 0)
+	return map[xml.Name]webdav.Property{
+		quotaAvailableBytes: {XMLName: quotaAvailableBytes, InnerXML: []byte(strconv.FormatInt(available, 10))},
+		quotaUsedBytes:      {XMLName: quotaUsedBytes, InnerXML: []byte(strconv.FormatInt(status.Used.Bytes, 10))},
+	}, nil
+}
+
+// Patch refuses all changes, the underlying file system does not support dead properties
+func (q *quotaFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return refusePatch(patches), nil
+}
+
+func refusePatch(patches []webdav.Proppatch) []webdav.Propstat {
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, prop := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: prop.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}
+}
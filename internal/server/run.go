@@ -9,11 +9,14 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"path"
+	"path/filepath"
 	"time"
 
+	"github.com/andrebq/davd/internal/audit"
 	"github.com/andrebq/davd/internal/config"
 	"github.com/andrebq/davd/internal/drive"
+	"github.com/andrebq/davd/internal/locks"
+	"github.com/andrebq/davd/internal/quota"
 
 	"golang.org/x/net/webdav"
 )
@@ -23,53 +26,101 @@ type (
 		Entries func() []string
 		Expand  func(string) string
 	}
+
+	Options struct {
+		Locks locks.Limits
+		// BindsPollInterval controls how often the binds file is checked for changes,
+		// zero disables the check (binds are still reloaded on SIGHUP)
+		BindsPollInterval time.Duration
+		// TrashRetention is how long deleted or overwritten files are kept
+		// in the trash of the binds, zero keeps them until they are purged by a user
+		TrashRetention time.Duration
+		// UploadExpiry is how long upload sessions are kept without receiving
+		// any chunk, zero keeps them until they are completed or aborted
+		UploadExpiry time.Duration
+		// MaxRequestSize limits the body of every request, zero removes the limit
+		MaxRequestSize int64
+		// MaxRequestMemory limits the forms parsed in memory, file contents
+		// are always streamed to the binds, zero removes the limit
+		MaxRequestMemory int64
+	}
+
+	// davBind serves a webdav.FileSystem, using a lock system view
+	// that belongs to the authenticated user
+	davBind struct {
+		prefix     string
+		namespace  string
+		fileSystem webdav.FileSystem
+		locks      *locks.System
+	}
 )
 
-func Run(ctx context.Context, db *config.DB, hostAndPort string, env Environ) error {
-	handlers := map[string]webdav.FileSystem{}
+// Run starts the HTTP server and blocks until ctx is cancelled.
+//
+// rootDir is the default WebDAV tree, its home directory is served under /home/
+// (and /drive/home/, /browser/home/) and contains one directory per user.
+//
+// Binds are read from the binds file (see config.DB.BindsFile) and served under
+// /binds/<name>/ (and /drive/binds/<name>/, /browser/binds/<name>/, /tus/binds/<name>/), they are
+// reloaded when the file changes or on SIGHUP.
+func Run(ctx context.Context, db *config.DB, hostAndPort string, rootDir string, env Environ, opts Options) error {
+	lockState, err := db.StatePath("locks.json")
+	if err != nil {
+		return err
+	}
+	lockSystem, err := locks.Open(lockState, opts.Locks)
+	if err != nil {
+		return fmt.Errorf("unable to open lock system: %w", err)
+	}
 
-	bindings, err := UpdateDynamicBinds(ctx, env.Entries, env.Expand)
+	auditFile, err := db.StatePath(audit.FileName)
 	if err != nil {
 		return err
 	}
-	for name, fp := range bindings.Entries {
-		handlers[name] = webdav.Dir(fp)
-	}
-
-	bindsMuxer := http.NewServeMux()
-	for k, v := range handlers {
-		urlpath := fmt.Sprintf("%v/", path.Join("/", "binds", k))
-		h := webdav.Handler{
-			Prefix:     urlpath,
-			FileSystem: v,
-			// TODO: here we are basically allowing users to use up all memory by creating a bunch of useless locks
-			// fix this in the future
-			LockSystem: webdav.NewMemLS(),
-			Logger: func(r *http.Request, err error) {
-				if err != nil {
-					slog.Error("Failed request", "path", r.URL.Path, "error", err)
-				}
-				slog.Info("Request", "method", r.Method, "path", r.URL.Path)
-			},
-		}
-		bindsMuxer.Handle(urlpath, &h)
+	auditLog, err := audit.Open(auditFile)
+	if err != nil {
+		return err
 	}
+	defer auditLog.Close()
 
-	browserMuxer := http.NewServeMux()
-	for name, localPath := range bindings.Entries {
-		prefix := fmt.Sprintf("%v/", path.Join("/", "binds", name))
-		browserMuxer.Handle(prefix, http.StripPrefix(prefix, http.FileServerFS(os.DirFS(localPath))))
+	ownersState, err := db.StatePath("quota-owners.json")
+	if err != nil {
+		return err
+	}
+	quotas, err := quota.NewManager(db, nil, HomeBind, ownersState)
+	if err != nil {
+		return fmt.Errorf("unable to open quota manager: %w", err)
 	}
 
-	driveMuxer, err := drive.NewHandler(drive.Bindings(bindings.Entries))
+	homeDir, err := filepath.Abs(filepath.Join(rootDir, HomeBind))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(homeDir, 0755)
 	if err != nil {
-		return fmt.Errorf("unable to create drive handler: %w", err)
+		return fmt.Errorf("unable to create home directory under root dir %v: %w", rootDir, err)
+	}
+
+	binds := &bindRoutes{
+		db:        db,
+		env:       env,
+		homeDir:   homeDir,
+		locks:     lockSystem,
+		quotas:    quotas,
+		auditLog:  auditLog,
+		maxMemory: opts.MaxRequestMemory,
+	}
+	if err := binds.reload(); err != nil {
+		return err
 	}
 
 	rootMux := http.NewServeMux()
-	rootMux.Handle("/binds/", Protect(db, bindsMuxer))
-	rootMux.Handle("/browser/", http.StripPrefix("/browser", Protect(db, browserMuxer)))
-	rootMux.Handle("/drive/", http.StripPrefix("/drive", Protect(db, driveMuxer)))
+	rootMux.Handle("/binds/", binds)
+	rootMux.Handle("/home/", binds)
+	rootMux.Handle("/browser/", binds)
+	rootMux.Handle("/drive/", binds)
+	rootMux.Handle("/tus/", binds)
+	rootMux.Handle(fmt.Sprintf("POST %v", passwordPath), authenticated(db, changePassword(db)))
 	rootMux.Handle("/assets/drive/", http.StripPrefix("/assets/drive/", drive.AssetsHandler()))
 	rootMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, "OK")
@@ -78,12 +129,21 @@ func Run(ctx context.Context, db *config.DB, hostAndPort string, env Environ) er
 	srv := http.Server{
 		Addr:           hostAndPort,
 		MaxHeaderBytes: 1000,
-		Handler:        rootMux,
+		Handler:        limitRequests(opts.MaxRequestSize, rootMux),
 		BaseContext:    func(l net.Listener) context.Context { return ctx },
 	}
 
 	errch := make(chan error, 1)
 	ctx, cancel := context.WithCancel(ctx)
+	go lockSystem.ExpireLoop(ctx, time.Minute)
+	go binds.watch(ctx, opts.BindsPollInterval)
+	cleanupInterval := time.Hour
+	for _, d := range []time.Duration{opts.TrashRetention, opts.UploadExpiry} {
+		if d > 0 {
+			cleanupInterval = min(d, cleanupInterval)
+		}
+	}
+	go binds.cleanup(ctx, opts.TrashRetention, opts.UploadExpiry, cleanupInterval)
 	go func() {
 		defer cancel()
 		defer close(errch)
@@ -99,6 +159,27 @@ func Run(ctx context.Context, db *config.DB, hostAndPort string, env Environ) er
 	return <-errch
 }
 
+func (d *davBind) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := config.UserFromContext(r.Context())
+	ls := d.locks.View(d.namespace, user.Name)
+	if r.Method != "LOCK" {
+		// any other method only creates temporary locks for its own changes
+		ls = d.locks.TransientView(d.namespace, user.Name)
+	}
+	h := webdav.Handler{
+		Prefix:     d.prefix,
+		FileSystem: &visibleFS{FileSystem: d.fileSystem, prefix: d.prefix, user: user},
+		LockSystem: ls,
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				slog.Error("Failed request", "path", r.URL.Path, "error", err)
+			}
+			slog.Info("Request", "method", r.Method, "path", r.URL.Path)
+		},
+	}
+	h.ServeHTTP(w, r)
+}
+
 func shutdownServer(srv *http.Server) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
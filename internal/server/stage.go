@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+
+	"github.com/andrebq/davd/internal/storage"
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// stageFS writes the body of PUT requests (see putWithQuota) to a staging file
+	// and only moves it over the target once the whole body was received, so a PUT
+	// which fails halfway (eg.: exceeding a quota) does not truncate an existing file.
+	//
+	// raw is the bind storage before storage.Hide, where staging files are kept.
+	stageFS struct {
+		webdav.FileSystem
+		raw webdav.FileSystem
+	}
+
+	stagedFile struct {
+		webdav.File
+		fs     *stageFS
+		ctx    context.Context
+		name   string
+		staged string
+		perm   os.FileMode
+		body   *quotaReader
+	}
+
+	putBodyKey struct{}
+)
+
+// stagingDir holds the body of PUT requests in progress
+const stagingDir = storage.HiddenDir + "/staging"
+
+var errIncompleteBody = errors.New("request body was not received completely")
+
+func withPutBody(ctx context.Context, body *quotaReader) context.Context {
+	return context.WithValue(ctx, putBodyKey{}, body)
+}
+
+func (s *stageFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	body, ok := ctx.Value(putBodyKey{}).(*quotaReader)
+	if !ok || flag&os.O_TRUNC == 0 {
+		return s.FileSystem.OpenFile(ctx, name, flag, perm)
+	}
+	if st, err := s.FileSystem.Stat(ctx, name); err == nil && st.IsDir() {
+		// fails as it would without staging
+		return s.FileSystem.OpenFile(ctx, name, flag, perm)
+	}
+	if _, err := s.FileSystem.Stat(ctx, path.Dir(name)); err != nil {
+		return nil, err
+	}
+	if err := storage.MkdirAll(ctx, s.raw, stagingDir, 0755); err != nil {
+		return nil, err
+	}
+	staged := path.Join(stagingDir, storage.NewID())
+	f, err := s.raw.OpenFile(ctx, staged, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &stagedFile{File: f, fs: s, ctx: context.WithoutCancel(ctx), name: name, staged: staged, perm: perm, body: body}, nil
+}
+
+// commit replaces name with the staged file. The target is truncated through
+// the bind file system first, which keeps its content in the trash or versions
+// of the bind and checks the bind mode.
+func (s *stageFS) commit(ctx context.Context, staged, name string, perm os.FileMode) error {
+	f, err := s.FileSystem.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return s.raw.Rename(ctx, staged, name)
+}
+
+func (f *stagedFile) Close() error {
+	err := f.File.Close()
+	if err == nil && !f.body.done {
+		err = errIncompleteBody
+	}
+	if err == nil {
+		err = f.fs.commit(f.ctx, f.staged, f.name, f.perm)
+	}
+	if err != nil {
+		f.fs.raw.RemoveAll(f.ctx, f.staged)
+	}
+	return err
+}
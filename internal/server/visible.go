@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"encoding/xml"
+	"os"
+	"path"
+
+	"github.com/andrebq/davd/internal/config"
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// visibleFS only lists the entries which the user can reach (see config.User.Reaches),
+	// prefix is the URL prefix of the file system (see mounts)
+	visibleFS struct {
+		webdav.FileSystem
+		prefix string
+		user   *config.User
+	}
+
+	visibleDir struct {
+		webdav.File
+		dir  string
+		user *config.User
+	}
+)
+
+func (v *visibleFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := v.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil || flag&writeFlags != 0 {
+		return f, err
+	}
+	if st, err := f.Stat(); err != nil || !st.IsDir() {
+		return f, nil
+	}
+	return &visibleDir{File: f, dir: path.Join(v.prefix, name), user: v.user}, nil
+}
+
+func (d *visibleDir) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := d.File.Readdir(count)
+	visible := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if d.user.Reaches(path.Join(d.dir, e.Name())) {
+			visible = append(visible, e)
+		}
+	}
+	return visible, err
+}
+
+// DeadProps and Patch keep the properties of the directory (see quotaFile)
+func (d *visibleDir) DeadProps() (map[xml.Name]webdav.Property, error) {
+	if holder, ok := d.File.(webdav.DeadPropsHolder); ok {
+		return holder.DeadProps()
+	}
+	return nil, nil
+}
+
+func (d *visibleDir) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if holder, ok := d.File.(webdav.DeadPropsHolder); ok {
+		return holder.Patch(patches)
+	}
+	return refusePatch(patches), nil
+}
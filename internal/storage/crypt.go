@@ -0,0 +1,404 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/net/webdav"
+)
+
+// Encrypted files start with a header (magic + random nonce prefix) followed by
+// the content split in chunks of cryptChunkSize bytes, each chunk is sealed
+// with secretbox using the nonce prefix and the chunk index.
+//
+// The last chunk is always shorter than cryptChunkSize (it might be empty)
+// and is sealed with a different nonce, so truncated files are detected.
+const (
+	cryptMagic      = "DAVDENC\x01"
+	cryptPrefixSize = 16
+	cryptHeaderSize = len(cryptMagic) + cryptPrefixSize
+	cryptChunkSize  = 64 << 10
+	cryptSealedSize = cryptChunkSize + secretbox.Overhead
+
+	// finalChunk is set on the chunk index of the last chunk
+	finalChunk = uint64(1) << 63
+)
+
+var (
+	ErrCorrupted = errors.New("encrypted file is corrupted or was encrypted with a different key")
+
+	// ErrRewriteOnly is returned when an encrypted file is opened for writing
+	// without truncating it, since chunks cannot be changed in place
+	ErrRewriteOnly = errors.New("encrypted files can only be rewritten from the start")
+
+	nameEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+)
+
+type (
+	// cryptFS encrypts the content (and optionally the names) of the files
+	// stored in another file system
+	cryptFS struct {
+		fs         webdav.FileSystem
+		contentKey [32]byte
+		nameKey    [32]byte
+		names      bool
+	}
+
+	cryptInfo struct {
+		os.FileInfo
+		name string
+		size int64
+	}
+
+	cryptReader struct {
+		webdav.File
+		fs     *cryptFS
+		info   cryptInfo
+		prefix [cryptPrefixSize]byte
+		offset int64
+		index  int64
+		chunk  []byte
+		// final is set once the last chunk was authenticated
+		final bool
+	}
+
+	cryptWriter struct {
+		webdav.File
+		fs     *cryptFS
+		name   string
+		prefix [cryptPrefixSize]byte
+		index  uint64
+		buf    []byte
+		size   int64
+		closed bool
+	}
+
+	cryptDir struct {
+		webdav.File
+		fs   *cryptFS
+		info cryptInfo
+	}
+)
+
+// Encrypt returns a file system which stores the content of the files
+// encrypted with key, if names is true the name of every file and directory
+// is also encrypted.
+//
+// Encrypted names are deterministic (the same name always has the same
+// encrypted form), so they can be resolved without an index, but this
+// reveals which entries share the same name. Since encrypted names are longer
+// than the original ones, the limits of the underlying file system apply
+// to roughly half the usual length.
+func Encrypt(fsys webdav.FileSystem, key [32]byte, names bool) webdav.FileSystem {
+	return &cryptFS{
+		fs:         fsys,
+		contentKey: subKey(key, "content"),
+		nameKey:    subKey(key, "names"),
+		names:      names,
+	}
+}
+
+func subKey(key [32]byte, label string) [32]byte {
+	var k [32]byte
+	copy(k[:], hmacSHA256(key[:], label))
+	return k
+}
+
+// plainSize returns the size of the content of an encrypted file with the given size,
+// an empty file is accepted as empty content
+func plainSize(size int64) (int64, bool) {
+	if size == 0 {
+		return 0, true
+	}
+	size -= int64(cryptHeaderSize)
+	full, rest := size/cryptSealedSize, size%cryptSealedSize
+	if size < 0 || rest < secretbox.Overhead {
+		return 0, false
+	}
+	return full*cryptChunkSize + rest - secretbox.Overhead, true
+}
+
+func chunkNonce(prefix [cryptPrefixSize]byte, index uint64, final bool) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:], prefix[:])
+	if final {
+		index |= finalChunk
+	}
+	binary.BigEndian.PutUint64(nonce[cryptPrefixSize:], index)
+	return &nonce
+}
+
+// encryptName uses a synthetic nonce (derived from the name) so the same name
+// is always encrypted to the same value
+func (c *cryptFS) encryptName(name string) string {
+	var nonce [24]byte
+	copy(nonce[:16], hmacSHA256(c.nameKey[:], name))
+	sealed := secretbox.Seal(nonce[:16], []byte(name), &nonce, &c.nameKey)
+	return strings.ToLower(nameEncoding.EncodeToString(sealed))
+}
+
+func (c *cryptFS) decryptName(encoded string) (string, bool) {
+	sealed, err := nameEncoding.DecodeString(strings.ToUpper(encoded))
+	if err != nil || len(sealed) < 16+secretbox.Overhead {
+		return "", false
+	}
+	var nonce [24]byte
+	copy(nonce[:16], sealed[:16])
+	name, ok := secretbox.Open(nil, sealed[16:], &nonce, &c.nameKey)
+	if !ok || !hmac.Equal(hmacSHA256(c.nameKey[:], string(name))[:16], sealed[:16]) {
+		return "", false
+	}
+	return string(name), true
+}
+
+// realName returns the name used in the underlying file system
+func (c *cryptFS) realName(name string) string {
+	name = path.Clean("/" + name)
+	if !c.names || name == "/" {
+		return name
+	}
+	segments := strings.Split(name[1:], "/")
+	for i, s := range segments {
+		segments[i] = c.encryptName(s)
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+func (c *cryptFS) info(fi os.FileInfo, name string) cryptInfo {
+	ci := cryptInfo{FileInfo: fi, name: name, size: fi.Size()}
+	if !fi.IsDir() {
+		ci.size, _ = plainSize(fi.Size())
+	}
+	return ci
+}
+
+func (c *cryptFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fi, err := c.fs.Stat(ctx, c.realName(name))
+	if err != nil {
+		return nil, err
+	}
+	return c.info(fi, path.Base(path.Clean("/"+name))), nil
+}
+
+func (c *cryptFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return c.fs.Mkdir(ctx, c.realName(name), perm)
+}
+
+func (c *cryptFS) RemoveAll(ctx context.Context, name string) error {
+	return c.fs.RemoveAll(ctx, c.realName(name))
+}
+
+func (c *cryptFS) Rename(ctx context.Context, oldName, newName string) error {
+	return c.fs.Rename(ctx, c.realName(oldName), c.realName(newName))
+}
+
+func (c *cryptFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	real := c.realName(name)
+	base := path.Base(path.Clean("/" + name))
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		f, err := c.fs.OpenFile(ctx, real, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if fi.IsDir() {
+			return &cryptDir{File: f, fs: c, info: c.info(fi, base)}, nil
+		}
+		return c.openReader(f, c.info(fi, base))
+	}
+	if flag&os.O_TRUNC == 0 {
+		if fi, err := c.fs.Stat(ctx, real); err == nil && fi.Size() > 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: ErrRewriteOnly}
+		}
+	}
+	flag = flag&^(os.O_APPEND|os.O_WRONLY) | os.O_RDWR | os.O_TRUNC
+	f, err := c.fs.OpenFile(ctx, real, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	w := &cryptWriter{File: f, fs: c, name: base, buf: make([]byte, 0, cryptChunkSize)}
+	if _, err := rand.Read(w.prefix[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Write(append([]byte(cryptMagic), w.prefix[:]...)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (c *cryptFS) openReader(f webdav.File, info cryptInfo) (webdav.File, error) {
+	r := &cryptReader{File: f, fs: c, info: info, index: -1}
+	if size := info.FileInfo.Size(); size == 0 {
+		return r, nil
+	} else if _, ok := plainSize(size); !ok {
+		f.Close()
+		return nil, ErrCorrupted
+	}
+	header := make([]byte, cryptHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil || !bytes.HasPrefix(header, []byte(cryptMagic)) {
+		f.Close()
+		return nil, ErrCorrupted
+	}
+	copy(r.prefix[:], header[len(cryptMagic):])
+	return r, nil
+}
+
+func (i cryptInfo) Name() string { return i.name }
+func (i cryptInfo) Size() int64  { return i.size }
+
+func (r *cryptReader) Read(buf []byte) (int, error) {
+	if r.offset >= r.info.size {
+		// the last chunk is empty when the content fills every chunk,
+		// it must still be opened to detect a truncated or replaced file
+		if !r.final && r.info.FileInfo.Size() > 0 {
+			if err := r.load(r.info.size / cryptChunkSize); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+	index := r.offset / cryptChunkSize
+	if index != r.index {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(buf, r.chunk[r.offset-index*cryptChunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *cryptReader) load(index int64) error {
+	_, err := r.File.Seek(int64(cryptHeaderSize)+index*cryptSealedSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	sealed := make([]byte, cryptSealedSize)
+	n, err := io.ReadFull(r.File, sealed)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	final := n < cryptSealedSize
+	chunk, ok := secretbox.Open(r.chunk[:0], sealed[:n], chunkNonce(r.prefix, uint64(index), final), &r.fs.contentKey)
+	if !ok {
+		r.index = -1
+		return ErrCorrupted
+	}
+	r.chunk, r.index = chunk, index
+	r.final = r.final || final
+	return nil
+}
+
+func (r *cryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.info.size
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *cryptReader) Write([]byte) (int, error)  { return 0, os.ErrPermission }
+func (r *cryptReader) Stat() (os.FileInfo, error) { return r.info, nil }
+
+func (w *cryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cryptChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		w.size += int64(n)
+		if len(w.buf) == cryptChunkSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *cryptWriter) flush(final bool) error {
+	sealed := secretbox.Seal(nil, w.buf, chunkNonce(w.prefix, w.index, final), &w.fs.contentKey)
+	if _, err := w.File.Write(sealed); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.index++
+	return nil
+}
+
+// Seek only reports the current position, writes are always sequential
+func (w *cryptWriter) Seek(offset int64, whence int) (int64, error) {
+	switch {
+	case whence == io.SeekCurrent && offset == 0,
+		whence == io.SeekStart && offset == w.size,
+		whence == io.SeekEnd && offset == 0:
+		return w.size, nil
+	}
+	return 0, ErrRewriteOnly
+}
+
+func (w *cryptWriter) Read([]byte) (int, error) { return 0, os.ErrInvalid }
+
+func (w *cryptWriter) Stat() (os.FileInfo, error) {
+	fi, err := w.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return cryptInfo{FileInfo: fi, name: w.name, size: w.size}, nil
+}
+
+// Close writes the last chunk
+func (w *cryptWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	if err := w.flush(true); err != nil {
+		w.File.Close()
+		return err
+	}
+	return w.File.Close()
+}
+
+func (d *cryptDir) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := d.File.Readdir(count)
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if d.fs.names {
+			var ok bool
+			if name, ok = d.fs.decryptName(name); !ok {
+				// not created by this file system
+				continue
+			}
+		}
+		infos = append(infos, d.fs.info(e, name))
+	}
+	return infos, err
+}
+
+func (d *cryptDir) Stat() (os.FileInfo, error) { return d.info, nil }
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func testKey(t *testing.T) [32]byte {
+	t.Helper()
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, cryptChunkSize - 1, cryptChunkSize, cryptChunkSize + 1, 2 * cryptChunkSize} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			raw := webdav.NewMemFS()
+			fsys := Encrypt(raw, testKey(t), true)
+			content := randomContent(t, size)
+			writeFile(t, fsys, "/file", content)
+
+			if got := mustReadFile(t, fsys, "/file"); !bytes.Equal(got, content) {
+				t.Fatalf("read %d bytes, expected the %d bytes written", len(got), len(content))
+			}
+			st, err := fsys.Stat(context.Background(), "/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Size() != int64(size) || st.Name() != "file" {
+				t.Fatalf("stat returned %q with %d bytes", st.Name(), st.Size())
+			}
+			if _, err := raw.Stat(context.Background(), "/file"); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("name was not encrypted: %v", err)
+			}
+			// short contents might appear in the sealed bytes by chance
+			if size >= 32 && bytes.Contains(mustReadFile(t, raw, fsys.(*cryptFS).realName("/file")), content) {
+				t.Fatal("content was not encrypted")
+			}
+		})
+	}
+}
+
+func TestCryptReadDir(t *testing.T) {
+	ctx := context.Background()
+	fsys := Encrypt(webdav.NewMemFS(), testKey(t), true)
+	if err := fsys.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fsys, "/dir/a.txt", []byte("abc"))
+	entries, err := ReadDir(ctx, fsys, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "a.txt" || entries[0].Size() != 3 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}
+
+func TestCryptRewriteOnly(t *testing.T) {
+	fsys := Encrypt(webdav.NewMemFS(), testKey(t), false)
+	writeFile(t, fsys, "/file", []byte("abc"))
+	_, err := fsys.OpenFile(context.Background(), "/file", os.O_WRONLY|os.O_APPEND, 0644)
+	if !errors.Is(err, ErrRewriteOnly) {
+		t.Fatalf("expected ErrRewriteOnly, got %v", err)
+	}
+}
+
+func TestCryptServeContent(t *testing.T) {
+	fsys := Encrypt(webdav.NewMemFS(), testKey(t), false)
+	content := randomContent(t, 3*cryptChunkSize+100)
+	writeFile(t, fsys, "/file", content)
+
+	for _, tc := range []struct {
+		rng        string
+		start, end int
+	}{
+		{"bytes=0-9", 0, 10},
+		{"bytes=65530-65545", 65530, 65546},
+		{"bytes=131072-", 131072, len(content)},
+		{"bytes=-10", len(content) - 10, len(content)},
+	} {
+		t.Run(tc.rng, func(t *testing.T) {
+			f, err := fsys.OpenFile(context.Background(), "/file", os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			req := httptest.NewRequest(http.MethodGet, "/file", nil)
+			req.Header.Set("Range", tc.rng)
+			rec := httptest.NewRecorder()
+			http.ServeContent(rec, req, "file", time.Time{}, f)
+
+			if rec.Code != http.StatusPartialContent {
+				t.Fatalf("status %d", rec.Code)
+			}
+			if !bytes.Equal(rec.Body.Bytes(), content[tc.start:tc.end]) {
+				t.Fatalf("read %d bytes, expected [%d, %d)", rec.Body.Len(), tc.start, tc.end)
+			}
+		})
+	}
+}
+
+func TestCryptTruncated(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		size int
+		// cut is the number of encrypted bytes removed from the end
+		cut int
+	}{
+		{"partial final chunk", cryptChunkSize + 100, 10},
+		{"whole final chunk", cryptChunkSize + 100, 100 + 16},
+		{"empty final chunk", cryptChunkSize, 16},
+		{"final and full chunks", 2 * cryptChunkSize, 16 + cryptSealedSize},
+		{"full chunk", 2 * cryptChunkSize, 16 + 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := webdav.NewMemFS()
+			fsys := Encrypt(raw, testKey(t), false)
+			writeFile(t, fsys, "/file", randomContent(t, tc.size))
+			sealed := mustReadFile(t, raw, "/file")
+			writeFile(t, raw, "/file", sealed[:len(sealed)-tc.cut])
+
+			if _, err := readFile(fsys, "/file"); !errors.Is(err, ErrCorrupted) {
+				t.Fatalf("expected ErrCorrupted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCryptSwappedFinalChunk(t *testing.T) {
+	for _, size := range []int{cryptChunkSize, cryptChunkSize + 100} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			raw := webdav.NewMemFS()
+			fsys := Encrypt(raw, testKey(t), false)
+			content := randomContent(t, size)
+			writeFile(t, fsys, "/a", content)
+			writeFile(t, fsys, "/b", content)
+
+			a, b := mustReadFile(t, raw, "/a"), mustReadFile(t, raw, "/b")
+			last := cryptHeaderSize + cryptSealedSize
+			writeFile(t, raw, "/a", append(a[:last:last], b[last:]...))
+
+			if _, err := readFile(fsys, "/a"); !errors.Is(err, ErrCorrupted) {
+				t.Fatalf("expected ErrCorrupted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCryptWrongKey(t *testing.T) {
+	raw := webdav.NewMemFS()
+	writeFile(t, Encrypt(raw, testKey(t), false), "/file", []byte("abc"))
+	if _, err := readFile(Encrypt(raw, testKey(t), false), "/file"); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted, got %v", err)
+	}
+}
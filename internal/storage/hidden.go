@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/andrebq/davd/internal/reserved"
+	"golang.org/x/net/webdav"
+)
+
+// HiddenDir holds the data managed by davd inside a bind (eg.: trash),
+// it is not visible to users (see Hide). The stores of this data must be
+// given the bind storage before it is hidden.
+//
+// Entries are usually named by NewID and described by a JSON record
+// (see WriteRecord).
+const HiddenDir = "/" + reserved.HiddenName
+
+type (
+	hiddenFS struct {
+		webdav.FileSystem
+	}
+
+	hiddenDir struct {
+		webdav.File
+	}
+)
+
+// Hide returns a file system where HiddenDir does not exist,
+// it cannot be created, listed or used as the target of a rename
+func Hide(fsys webdav.FileSystem) webdav.FileSystem {
+	return hiddenFS{FileSystem: fsys}
+}
+
+// IsHidden returns true if name is HiddenDir or any file under it
+func IsHidden(name string) bool {
+	name = path.Clean("/" + name)
+	return name == HiddenDir || strings.HasPrefix(name, HiddenDir+"/")
+}
+
+// NewID returns a unique id, sorted by creation time
+func NewID() string {
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	return fmt.Sprintf("%v-%v", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix[:]))
+}
+
+// ValidID returns true if id can be used as the name of an entry,
+// ids are received from users and must not escape their directory
+func ValidID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "/\\") && id != "." && id != ".."
+}
+
+// WriteRecord stores v as JSON in name, which must not exist
+func WriteRecord(ctx context.Context, fsys webdav.FileSystem, name string, v any) error {
+	f, err := fsys.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(v)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadRecord decodes the JSON stored in name into v
+func ReadRecord(ctx context.Context, fsys webdav.FileSystem, name string, v any) error {
+	f, err := fsys.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+// RecordIDs returns the ids of the records (<id>.json) in dir,
+// the most recent first (see NewID). A missing dir has no records.
+func RecordIDs(ctx context.Context, fsys webdav.FileSystem, dir string) ([]string, error) {
+	entries, err := ReadDir(ctx, fsys, dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if id, ok := strings.CutSuffix(e.Name(), ".json"); ok && !e.IsDir() && ValidID(id) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	slices.Reverse(ids)
+	return ids, nil
+}
+
+func (h hiddenFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if IsHidden(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return h.FileSystem.Stat(ctx, name)
+}
+
+func (h hiddenFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if IsHidden(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+	}
+	return h.FileSystem.Mkdir(ctx, name, perm)
+}
+
+func (h hiddenFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if IsHidden(name) {
+		if flag&os.O_CREATE != 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	f, err := h.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil || path.Clean("/"+name) != "/" {
+		return f, err
+	}
+	return hiddenDir{File: f}, nil
+}
+
+func (h hiddenFS) RemoveAll(ctx context.Context, name string) error {
+	if IsHidden(name) {
+		return &fs.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	return h.FileSystem.RemoveAll(ctx, name)
+}
+
+func (h hiddenFS) Rename(ctx context.Context, oldName, newName string) error {
+	if IsHidden(oldName) || IsHidden(newName) {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: os.ErrPermission}
+	}
+	return h.FileSystem.Rename(ctx, oldName, newName)
+}
+
+func (d hiddenDir) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := d.File.Readdir(count)
+	for i, e := range entries {
+		if e.Name() == path.Base(HiddenDir) {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	return entries, err
+}
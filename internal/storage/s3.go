@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// s3FS maps a webdav.FileSystem to objects under a prefix of a bucket,
+	// directories are objects whose key ends with a slash (or any common prefix)
+	s3FS struct {
+		client *s3Client
+		prefix string
+	}
+
+	s3FileInfo struct {
+		name    string
+		size    int64
+		modTime time.Time
+		dir     bool
+	}
+
+	// s3ReadFile reads the object on demand, seeking reopens the object at the new offset
+	s3ReadFile struct {
+		fs     *s3FS
+		ctx    context.Context
+		info   s3FileInfo
+		key    string
+		offset int64
+		body   io.ReadCloser
+	}
+
+	// s3WriteFile buffers the content in a temporary file which is uploaded on Close
+	s3WriteFile struct {
+		*os.File
+		fs   *s3FS
+		ctx  context.Context
+		name string
+		key  string
+	}
+
+	s3Dir struct {
+		fs      *s3FS
+		ctx     context.Context
+		name    string
+		info    s3FileInfo
+		entries []os.FileInfo
+		// token continues the listing (see s3Client.listPage), done is set after the last page
+		token string
+		done  bool
+	}
+)
+
+// OpenS3 returns a file system for a location like s3://bucket/prefix.
+//
+// The endpoint and region can be provided as query parameters
+// (eg.: s3://bucket/prefix?endpoint=http://127.0.0.1:9000&region=us-east-1),
+// otherwise DAVD_S3_ENDPOINT and DAVD_S3_REGION (or AWS_REGION) are used.
+//
+// Credentials are read from DAVD_S3_ACCESS_KEY_ID and DAVD_S3_SECRET_ACCESS_KEY
+// (or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY).
+//
+// Files larger than 64 MiB are written (and renamed) in parts, so they
+// can reach the 5 TiB limit of S3, larger files fail with ErrTooLarge.
+// Files are buffered in a temporary file until they are closed.
+func OpenS3(u *url.URL) (webdav.FileSystem, error) {
+	query := u.Query()
+	region := firstNonEmpty(query.Get("region"), os.Getenv("DAVD_S3_REGION"), os.Getenv("AWS_REGION"), "us-east-1")
+	endpoint := firstNonEmpty(query.Get("endpoint"), os.Getenv("DAVD_S3_ENDPOINT"), fmt.Sprintf("https://s3.%v.amazonaws.com", region))
+	ep, err := url.Parse(endpoint)
+	if err != nil || (ep.Scheme != "http" && ep.Scheme != "https") {
+		return nil, fmt.Errorf("%w: invalid s3 endpoint %q", ErrInvalidLocation, endpoint)
+	}
+	client := &s3Client{
+		endpoint:  ep,
+		region:    region,
+		bucket:    u.Host,
+		accessKey: firstNonEmpty(os.Getenv("DAVD_S3_ACCESS_KEY_ID"), os.Getenv("AWS_ACCESS_KEY_ID")),
+		secretKey: firstNonEmpty(os.Getenv("DAVD_S3_SECRET_ACCESS_KEY"), os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		http:      &http.Client{Timeout: 5 * time.Minute},
+		partSize:  s3DefaultPartSize,
+	}
+	if client.accessKey == "" || client.secretKey == "" {
+		return nil, fmt.Errorf("%w: missing s3 credentials for bucket %v", ErrInvalidLocation, u.Host)
+	}
+	return &s3FS{client: client, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// key returns the object key for name, the root of the file system has an empty key
+func (s *s3FS) key(name string) string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	switch {
+	case s.prefix == "":
+		return name
+	case name == "":
+		return s.prefix
+	}
+	return s.prefix + "/" + name
+}
+
+// dirPrefix returns the prefix shared by all objects inside the directory
+func (s *s3FS) dirPrefix(name string) string {
+	key := s.key(name)
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func (s *s3FS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return s3FileInfo{name: "/", dir: true}, nil
+	}
+	base := path.Base(name)
+	key := s.key(name)
+	obj, err := s.client.head(ctx, key)
+	if err == nil {
+		return s3FileInfo{name: base, size: obj.Size, modTime: obj.LastModified}, nil
+	} else if !isNotExist(err) {
+		return nil, err
+	}
+	found := false
+	err = s.client.list(ctx, key+"/", "", 1, func(page *s3ListResult) error {
+		found = len(page.Contents) > 0 || len(page.CommonPrefixes) > 0
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return s3FileInfo{name: base, dir: true}, nil
+}
+
+func (s *s3FS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if _, err := s.Stat(ctx, name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := s.checkParent(ctx, name); err != nil {
+		return err
+	}
+	return s.client.put(ctx, s.dirPrefix(name), strings.NewReader(""), 0)
+}
+
+func (s *s3FS) checkParent(ctx context.Context, name string) error {
+	parent, err := s.Stat(ctx, path.Dir(path.Clean("/"+name)))
+	if err != nil {
+		return err
+	} else if !parent.IsDir() {
+		return &fs.PathError{Op: "open", Path: name, Err: errors.New("parent is not a directory")}
+	}
+	return nil
+}
+
+func (s *s3FS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	info, err := s.Stat(ctx, name)
+	if err != nil && !isNotExist(err) {
+		return nil, err
+	}
+	exists := err == nil
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		if !exists {
+			return nil, err
+		}
+		if info.IsDir() {
+			return &s3Dir{fs: s, ctx: ctx, name: name, info: info.(s3FileInfo)}, nil
+		}
+		return &s3ReadFile{fs: s, ctx: ctx, info: info.(s3FileInfo), key: s.key(name)}, nil
+	}
+	switch {
+	case exists && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case exists && info.IsDir():
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, err
+	case !exists:
+		if err := s.checkParent(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	tmp, err := os.CreateTemp("", "davd-s3-*")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tmp.Name())
+	f := &s3WriteFile{File: tmp, fs: s, ctx: ctx, name: path.Base(path.Clean("/" + name)), key: s.key(name)}
+	if exists && flag&os.O_TRUNC == 0 {
+		// keep the current content, eg.: O_APPEND or partial writes
+		body, err := s.client.get(ctx, f.key, 0)
+		if err == nil {
+			_, err = io.Copy(tmp, body)
+			body.Close()
+		}
+		if err == nil && flag&os.O_APPEND == 0 {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			tmp.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (s *s3FS) RemoveAll(ctx context.Context, name string) error {
+	if path.Clean("/"+name) == "/" {
+		return &fs.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	key := s.key(name)
+	err := s.client.list(ctx, key+"/", "", 0, func(page *s3ListResult) error {
+		for _, obj := range page.Contents {
+			if err := s.client.delete(ctx, obj.Key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = s.client.delete(ctx, key)
+	if isNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *s3FS) Rename(ctx context.Context, oldName, newName string) error {
+	info, err := s.Stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if err := s.checkParent(ctx, newName); err != nil {
+		return err
+	}
+	oldKey, newKey := s.key(oldName), s.key(newName)
+	if path.Clean("/"+oldName) == "/" || path.Clean("/"+newName) == "/" || strings.HasPrefix(newKey+"/", oldKey+"/") {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: os.ErrInvalid}
+	}
+	if !info.IsDir() {
+		if err := s.client.copy(ctx, oldKey, newKey, info.Size()); err != nil {
+			return err
+		}
+		return s.client.delete(ctx, oldKey)
+	}
+	var moved []string
+	err = s.client.list(ctx, oldKey+"/", "", 0, func(page *s3ListResult) error {
+		for _, obj := range page.Contents {
+			if err := s.client.copy(ctx, obj.Key, newKey+"/"+strings.TrimPrefix(obj.Key, oldKey+"/"), obj.Size); err != nil {
+				return err
+			}
+			moved = append(moved, obj.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range moved {
+		if err := s.client.delete(ctx, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i s3FileInfo) Name() string { return i.name }
+func (i s3FileInfo) Size() int64  { return i.size }
+func (i s3FileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+func (i s3FileInfo) ModTime() time.Time { return i.modTime }
+func (i s3FileInfo) IsDir() bool        { return i.dir }
+func (i s3FileInfo) Sys() any           { return nil }
+
+func (f *s3ReadFile) Read(buf []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.fs.client.get(f.ctx, f.key, f.offset)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(buf)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3ReadFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3ReadFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+func (f *s3ReadFile) Write([]byte) (int, error)           { return 0, os.ErrPermission }
+func (f *s3ReadFile) Readdir(int) ([]os.FileInfo, error)  { return nil, os.ErrInvalid }
+func (f *s3ReadFile) Stat() (os.FileInfo, error)          { return f.info, nil }
+func (f *s3WriteFile) Readdir(int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+func (d *s3Dir) Read([]byte) (int, error)                 { return 0, os.ErrInvalid }
+func (d *s3Dir) Write([]byte) (int, error)                { return 0, os.ErrInvalid }
+func (d *s3Dir) Seek(int64, int) (int64, error)           { return 0, nil }
+func (d *s3Dir) Stat() (os.FileInfo, error)               { return d.info, nil }
+func (d *s3Dir) Close() error                             { return nil }
+
+func (f *s3WriteFile) Stat() (os.FileInfo, error) {
+	st, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return s3FileInfo{name: f.name, size: st.Size(), modTime: st.ModTime()}, nil
+}
+
+// Close uploads the content of the file
+func (f *s3WriteFile) Close() error {
+	defer f.File.Close()
+	size, err := f.File.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = f.File.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+	return f.fs.client.put(f.ctx, f.key, f.File, size)
+}
+
+// Readdir lists the directory one page at a time, so only the entries
+// which were not returned yet are kept in memory
+func (d *s3Dir) Readdir(count int) ([]os.FileInfo, error) {
+	if count <= 0 {
+		for !d.done {
+			if err := d.nextPage(); err != nil {
+				return nil, err
+			}
+		}
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	for len(d.entries) == 0 && !d.done {
+		if err := d.nextPage(); err != nil {
+			return nil, err
+		}
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *s3Dir) nextPage() error {
+	prefix := d.fs.dirPrefix(d.name)
+	page, err := d.fs.client.listPage(d.ctx, prefix, "/", d.token, 0)
+	if err != nil {
+		return err
+	}
+	for _, p := range page.CommonPrefixes {
+		d.entries = append(d.entries, s3FileInfo{name: path.Base(strings.TrimSuffix(p.Prefix, "/")), dir: true})
+	}
+	for _, obj := range page.Contents {
+		if obj.Key == prefix {
+			// directory marker
+			continue
+		}
+		d.entries = append(d.entries, s3FileInfo{name: path.Base(obj.Key), size: obj.Size, modTime: obj.LastModified})
+	}
+	d.token, d.done = page.NextContinuationToken, !page.more()
+	return nil
+}
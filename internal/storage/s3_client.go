@@ -0,0 +1,416 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// s3Client implements the subset of the S3 API used by s3FS,
+	// using path style URLs (endpoint/bucket/key) and AWS Signature Version 4
+	s3Client struct {
+		endpoint  *url.URL
+		region    string
+		bucket    string
+		accessKey string
+		secretKey string
+		http      *http.Client
+		// partSize is the size of the parts of multipart uploads and copies,
+		// smaller objects are written by a single request
+		partSize int64
+	}
+
+	s3Object struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	}
+
+	s3ListResult struct {
+		IsTruncated           bool       `xml:"IsTruncated"`
+		NextContinuationToken string     `xml:"NextContinuationToken"`
+		Contents              []s3Object `xml:"Contents"`
+		CommonPrefixes        []struct {
+			Prefix string `xml:"Prefix"`
+		} `xml:"CommonPrefixes"`
+	}
+
+	s3Part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+)
+
+const (
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// s3DefaultPartSize is used by OpenS3, objects larger than
+	// the part size are written by multipart uploads (and copies)
+	s3DefaultPartSize = 64 << 20
+	// s3MaxParts and s3MaxObjectSize are limits of the S3 API
+	s3MaxParts      = 10000
+	s3MaxObjectSize = 5 << 40
+)
+
+// ErrTooLarge is returned when a file is larger than the storage accepts
+var ErrTooLarge = errors.New("file is too large")
+
+// head returns the size and modification time of the object
+func (c *s3Client) head(ctx context.Context, key string) (s3Object, error) {
+	res, err := c.do(ctx, http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return s3Object{}, err
+	}
+	res.Body.Close()
+	obj := s3Object{Key: key, Size: res.ContentLength}
+	obj.LastModified, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	return obj, nil
+}
+
+// get returns the content of the object, starting at offset
+func (c *s3Client) get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	hdr := http.Header{}
+	if offset > 0 {
+		hdr.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := c.do(ctx, http.MethodGet, key, nil, hdr, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// put writes the size bytes of body to key, objects larger than the
+// part size are sent in parts, since a single PUT is limited to 5 GiB
+func (c *s3Client) put(ctx context.Context, key string, body io.ReaderAt, size int64) error {
+	if err := checkObjectSize(key, size); err != nil {
+		return err
+	}
+	if size <= c.partSize {
+		res, err := c.do(ctx, http.MethodPut, key, nil, nil, io.NewSectionReader(body, 0, size), size)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+	return c.multipart(ctx, key, size, func(query url.Values, offset, length int64) (string, error) {
+		res, err := c.do(ctx, http.MethodPut, key, query, nil, io.NewSectionReader(body, offset, length), length)
+		if err != nil {
+			return "", err
+		}
+		res.Body.Close()
+		return res.Header.Get("ETag"), nil
+	})
+}
+
+// copy copies the object src of the given size to dst, objects larger
+// than the part size are copied in parts (see put)
+func (c *s3Client) copy(ctx context.Context, src, dst string, size int64) error {
+	if err := checkObjectSize(src, size); err != nil {
+		return err
+	}
+	hdr := http.Header{}
+	hdr.Set("X-Amz-Copy-Source", uriEncode("/"+c.bucket+"/"+src, false))
+	if size <= c.partSize {
+		res, err := c.do(ctx, http.MethodPut, dst, nil, hdr, nil, 0)
+		if err != nil {
+			return err
+		}
+		return c.checkResult(res)
+	}
+	return c.multipart(ctx, dst, size, func(query url.Values, offset, length int64) (string, error) {
+		hdr := hdr.Clone()
+		hdr.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		res, err := c.do(ctx, http.MethodPut, dst, query, hdr, nil, 0)
+		if err != nil {
+			return "", err
+		}
+		var result struct {
+			ETag string `xml:"ETag"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("unable to decode copy part response: %w", err)
+		}
+		return result.ETag, nil
+	})
+}
+
+// multipart writes key in parts of up to partSize bytes, sendPart sends the part
+// identified by query (which contains its number and the upload id) and returns its ETag.
+// The upload is aborted if any part fails.
+func (c *s3Client) multipart(ctx context.Context, key string, size int64, sendPart func(query url.Values, offset, length int64) (string, error)) error {
+	res, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+	if err == nil && created.UploadID == "" {
+		err = errors.New("missing upload id")
+	}
+	if err != nil {
+		return fmt.Errorf("unable to start multipart upload of %v: %w", key, err)
+	}
+
+	// parts must be larger as the object grows, S3 accepts at most s3MaxParts
+	partSize := max(c.partSize, (size+s3MaxParts-1)/s3MaxParts)
+	var parts []s3Part
+	for offset := int64(0); offset < size && err == nil; offset += partSize {
+		query := url.Values{"partNumber": {strconv.Itoa(len(parts) + 1)}, "uploadId": {created.UploadID}}
+		var etag string
+		etag, err = sendPart(query, offset, min(partSize, size-offset))
+		parts = append(parts, s3Part{PartNumber: len(parts) + 1, ETag: etag})
+	}
+	if err == nil {
+		err = c.completeMultipart(ctx, key, created.UploadID, parts)
+	}
+	if err != nil {
+		// use a new context, the upload must be aborted even if ctx was canceled
+		abort, abortErr := c.do(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {created.UploadID}}, nil, nil, 0)
+		if abortErr == nil {
+			abort.Body.Close()
+		}
+	}
+	return err
+}
+
+func (c *s3Client) completeMultipart(ctx context.Context, key, uploadID string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	res, err := c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	return c.checkResult(res)
+}
+
+// checkResult closes the response of copies and completed multipart uploads,
+// which can fail after the 200 OK status was sent, returning the error in the body
+func (c *s3Client) checkResult(res *http.Response) error {
+	defer res.Body.Close()
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&result); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("unable to decode s3 response: %w", err)
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("s3 %v %v: %v: %v", res.Request.Method, res.Request.URL.Path, result.Code, result.Message)
+	}
+	return nil
+}
+
+// checkObjectSize returns an error wrapping ErrTooLarge if S3 cannot store an object of size bytes
+func checkObjectSize(key string, size int64) error {
+	if size > s3MaxObjectSize {
+		return fmt.Errorf("%v: %w, s3 objects are limited to %d bytes", key, ErrTooLarge, int64(s3MaxObjectSize))
+	}
+	return nil
+}
+
+func (c *s3Client) delete(ctx context.Context, key string) error {
+	res, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// list calls fn for every page of objects under prefix, if delimiter is not empty
+// only the direct children are listed (see s3ListResult.CommonPrefixes)
+func (c *s3Client) list(ctx context.Context, prefix, delimiter string, maxKeys int, fn func(*s3ListResult) error) error {
+	token := ""
+	for {
+		page, err := c.listPage(ctx, prefix, delimiter, token, maxKeys)
+		if err != nil {
+			return err
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+		if !page.more() || maxKeys > 0 {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// listPage returns a single page of the objects under prefix, token is the
+// NextContinuationToken of the previous page (empty for the first one)
+func (c *s3Client) listPage(ctx context.Context, prefix, delimiter, token string, maxKeys int) (*s3ListResult, error) {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	res, err := c.do(ctx, http.MethodGet, "", query, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var page s3ListResult
+	if err := xml.NewDecoder(res.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("unable to decode list response: %w", err)
+	}
+	return &page, nil
+}
+
+// more returns true if there are more pages after p
+func (p *s3ListResult) more() bool {
+	return p.IsTruncated && p.NextContinuationToken != ""
+}
+
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, hdr http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	c.sign(req, time.Now())
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%v: %w", key, os.ErrNotExist)
+	}
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	return nil, fmt.Errorf("s3 %v %v: unexpected status %v: %s", method, key, res.Status, msg)
+}
+
+// sign adds the AWS Signature Version 4 headers to req, the payload is not signed
+func (c *s3Client) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	names := []string{"host"}
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			names = append(names, lk)
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, n := range names {
+		v := req.Host
+		if n != "host" {
+			v = strings.TrimSpace(req.Header.Get(n))
+		}
+		fmt.Fprintf(&canonicalHeaders, "%v:%v\n", n, v)
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", date, c.region)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hexSHA256(canonicalRequest)}, "\n")
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", c.accessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode encodes everything except the unreserved characters,
+// slashes are kept unless encodeSlash is true
+func uriEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			sb.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func hexSHA256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func isNotExist(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
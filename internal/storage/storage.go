@@ -0,0 +1,218 @@
+// Package storage provides the file systems used by binds.
+//
+// All binds are exposed as a webdav.FileSystem, which is shared by the
+// WebDAV, browser and drive handlers. The backend is selected by the bind
+// location:
+//
+//   - /abs/path or file:///abs/path: a local directory
+//   - mem://name: an in-memory file system, lost when the process exits
+//   - s3://bucket/prefix: an S3-compatible object store, files are limited to 5 TiB (see OpenS3)
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/webdav"
+)
+
+var (
+	ErrInvalidLocation = errors.New("invalid storage location")
+
+	// SkipDir can be returned by a WalkFunc to skip the contents of a directory
+	SkipDir = errors.New("skip this directory")
+
+	memFS sync.Map
+)
+
+type (
+	// WalkFunc is called for every file and directory visited by Walk,
+	// name is relative to the root of the file system
+	WalkFunc func(name string, info os.FileInfo) error
+
+	httpFS struct {
+		fs webdav.FileSystem
+	}
+)
+
+// Validate checks if location is a supported storage location,
+// without opening it
+func Validate(location string) error {
+	_, err := parse(location)
+	return err
+}
+
+// LocalPath returns the local directory of the location,
+// ok is false for locations which are not backed by the local disk
+func LocalPath(location string) (string, bool) {
+	u, err := parse(location)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return filepath.FromSlash(u.Path), true
+}
+
+// Open returns the file system for location
+func Open(location string) (webdav.FileSystem, error) {
+	u, err := parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return webdav.Dir(filepath.FromSlash(u.Path)), nil
+	case "mem":
+		// the same name always returns the same file system,
+		// so its content survives a reload of the binds
+		fs, _ := memFS.LoadOrStore(u.Host, webdav.NewMemFS())
+		return fs.(webdav.FileSystem), nil
+	case "s3":
+		return OpenS3(u)
+	}
+	return nil, fmt.Errorf("%w: %v", ErrInvalidLocation, location)
+}
+
+func parse(location string) (*url.URL, error) {
+	if !strings.Contains(location, "://") {
+		if !filepath.IsAbs(location) {
+			return nil, fmt.Errorf("%w: %q must be an absolute path or URL", ErrInvalidLocation, location)
+		}
+		return &url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Clean(location))}, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidLocation, err)
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Host != "" || !path.IsAbs(u.Path) {
+			return nil, fmt.Errorf("%w: %q must be in the form file:///absolute/path", ErrInvalidLocation, location)
+		}
+		u.Path = path.Clean(u.Path)
+	case "mem", "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("%w: %q must be in the form %v://name/", ErrInvalidLocation, location, u.Scheme)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported scheme %q (use file, mem or s3)", ErrInvalidLocation, u.Scheme)
+	}
+	return u, nil
+}
+
+// ReadDir returns the entries of the directory, sorted by name
+func ReadDir(ctx context.Context, fsys webdav.FileSystem, name string) ([]os.FileInfo, error) {
+	f, err := fsys.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Walk calls fn for root and every file and directory under it
+func Walk(ctx context.Context, fsys webdav.FileSystem, root string, fn WalkFunc) error {
+	root = path.Clean("/" + root)
+	info, err := fsys.Stat(ctx, root)
+	if err != nil {
+		return err
+	}
+	err = walk(ctx, fsys, root, info, fn)
+	if errors.Is(err, SkipDir) {
+		return nil
+	}
+	return err
+}
+
+func walk(ctx context.Context, fsys webdav.FileSystem, name string, info os.FileInfo, fn WalkFunc) error {
+	if err := fn(name, info); err != nil || !info.IsDir() {
+		return err
+	}
+	entries, err := ReadDir(ctx, fsys, name)
+	if errors.Is(err, os.ErrNotExist) {
+		// removed while walking
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err := walk(ctx, fsys, path.Join(name, e.Name()), e, fn)
+		if errors.Is(err, SkipDir) {
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MkdirAll creates the directory and any missing parent
+func MkdirAll(ctx context.Context, fsys webdav.FileSystem, name string, perm os.FileMode) error {
+	name = path.Clean("/" + name)
+	if st, err := fsys.Stat(ctx, name); err == nil {
+		if !st.IsDir() {
+			return fmt.Errorf("%v: %w", name, os.ErrExist)
+		}
+		return nil
+	}
+	if name != "/" {
+		if err := MkdirAll(ctx, fsys, path.Dir(name), perm); err != nil {
+			return err
+		}
+	}
+	err := fsys.Mkdir(ctx, name, perm)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	return err
+}
+
+// Create truncates or creates the file, including any missing parent directory
+func Create(ctx context.Context, fsys webdav.FileSystem, name string) (webdav.File, error) {
+	if err := MkdirAll(ctx, fsys, path.Dir(path.Clean("/"+name)), 0755); err != nil {
+		return nil, err
+	}
+	return fsys.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// CopyFile copies the content of src into a new file at dst
+func CopyFile(ctx context.Context, fsys webdav.FileSystem, src, dst string) error {
+	in, err := fsys.OpenFile(ctx, src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := Create(ctx, fsys, dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// HTTPFileSystem adapts fsys to be used with http.FileServer
+func HTTPFileSystem(fsys webdav.FileSystem) http.FileSystem {
+	return httpFS{fs: fsys}
+}
+
+func (h httpFS) Open(name string) (http.File, error) {
+	return h.fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+}
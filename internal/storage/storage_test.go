@@ -0,0 +1,607 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// fakeS3 is a minimal S3 server which keeps the objects of a single bucket in memory
+	// and rejects requests whose signature does not match its credentials
+	fakeS3 struct {
+		bucket    string
+		region    string
+		accessKey string
+		secretKey string
+		// pageSize limits the number of keys returned by each list request
+		pageSize int
+
+		mu      sync.Mutex
+		objects map[string][]byte
+		// continued counts the list requests with a continuation token
+		continued int
+		// uploads holds the parts of multipart uploads in progress, completed counts the finished ones
+		uploads   map[string]map[int][]byte
+		completed int
+	}
+
+	fakeListResult struct {
+		XMLName               xml.Name   `xml:"ListBucketResult"`
+		IsTruncated           bool       `xml:"IsTruncated"`
+		NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+		Contents              []s3Object `xml:"Contents"`
+		CommonPrefixes        []struct {
+			Prefix string `xml:"Prefix"`
+		} `xml:"CommonPrefixes"`
+	}
+)
+
+var fakeModTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		bucket:    "bucket",
+		region:    "test-region",
+		accessKey: "test-access",
+		secretKey: "test-secret",
+		pageSize:  2,
+		objects:   map[string][]byte{},
+		uploads:   map[string]map[int][]byte{},
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	t.Setenv("DAVD_S3_ACCESS_KEY_ID", f.accessKey)
+	t.Setenv("DAVD_S3_SECRET_ACCESS_KEY", f.secretKey)
+	return f, srv
+}
+
+func openFakeS3(t *testing.T, srv *httptest.Server, prefix string) webdav.FileSystem {
+	t.Helper()
+	fsys, err := Open("s3://bucket/" + prefix + "?region=test-region&endpoint=" + url.QueryEscape(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// verify recomputes the signature of the request from what was received
+func (f *fakeS3) verify(r *http.Request) error {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return errors.New("missing authorization")
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(auth, ", ") {
+		k, v, _ := strings.Cut(field, "=")
+		fields[k] = v
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) != len("20060102T150405Z") {
+		return fmt.Errorf("invalid date %q", amzDate)
+	}
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", amzDate[:8], f.region)
+	if fields["Credential"] != f.accessKey+"/"+scope {
+		return fmt.Errorf("unexpected credential %q", fields["Credential"])
+	}
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	if !slices.Contains(signed, "host") || !slices.Contains(signed, "x-amz-date") || !slices.Contains(signed, "x-amz-content-sha256") {
+		return fmt.Errorf("required headers are not signed: %v", signed)
+	}
+	var headers strings.Builder
+	for _, name := range signed {
+		v := r.Host
+		if name != "host" {
+			v = strings.TrimSpace(r.Header.Get(name))
+		}
+		fmt.Fprintf(&headers, "%v:%v\n", name, v)
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		uriEncode(r.URL.Path, false),
+		canonicalQuery(r.URL.Query()),
+		headers.String(),
+		fields["SignedHeaders"],
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	key := []byte("AWS4" + f.secretKey)
+	for _, part := range []string{amzDate[:8], f.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hexSHA256(canonicalRequest)}, "\n")
+	if expected := hex.EncodeToString(hmacSHA256(key, stringToSign)); fields["Signature"] != expected {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f.verify(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.bucket)
+	if !ok {
+		http.Error(w, "unknown bucket", http.StatusNotFound)
+		return
+	}
+	key = strings.TrimPrefix(key, "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	switch {
+	case query.Has("uploads") || query.Has("uploadId"):
+		f.multipart(w, r, key, query)
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r.URL.Query())
+	case r.Method == http.MethodHead, r.Method == http.MethodGet:
+		content, found := f.objects[key]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		var offset int
+		if rng, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			offset, _ = strconv.Atoi(strings.TrimSuffix(rng, "-"))
+			offset = min(offset, len(content))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)-offset))
+		w.Header().Set("Last-Modified", fakeModTime.Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(content[offset:])
+		}
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content, found := f.objects[strings.TrimPrefix(src, "/"+f.bucket+"/")]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		f.objects[key] = content
+		fmt.Fprint(w, "<CopyObjectResult></CopyObjectResult>")
+	case r.Method == http.MethodPut:
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = content
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+// multipart implements the multipart upload API, including parts copied from other objects
+func (f *fakeS3) multipart(w http.ResponseWriter, r *http.Request, key string, query url.Values) {
+	id := query.Get("uploadId")
+	parts, found := f.uploads[id]
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		id = strconv.Itoa(len(f.uploads)+f.completed+1) + "-" + key
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%v</UploadId></InitiateMultipartUploadResult>", id)
+	case !found:
+		http.Error(w, "no such upload", http.StatusNotFound)
+	case r.Method == http.MethodPut:
+		n, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil || n < 1 {
+			http.Error(w, "invalid part number", http.StatusBadRequest)
+			return
+		}
+		etag := fmt.Sprintf("%q", "etag-"+strconv.Itoa(n))
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			src, _ = url.PathUnescape(src)
+			content, found := f.objects[strings.TrimPrefix(src, "/"+f.bucket+"/")]
+			var start, end int
+			_, err := fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end)
+			if !found || err != nil || start > end || end >= len(content) {
+				http.Error(w, "invalid copy source", http.StatusBadRequest)
+				return
+			}
+			parts[n] = content[start : end+1]
+			fmt.Fprintf(w, "<CopyPartResult><ETag>%v</ETag></CopyPartResult>", etag)
+			return
+		}
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parts[n] = content
+		w.Header().Set("ETag", etag)
+	case r.Method == http.MethodPost:
+		var complete struct {
+			Parts []s3Part `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var content []byte
+		for i, p := range complete.Parts {
+			if p.PartNumber != i+1 || p.ETag != fmt.Sprintf("%q", "etag-"+strconv.Itoa(p.PartNumber)) {
+				// S3 reports this error after the 200 OK status
+				fmt.Fprintf(w, "<Error><Code>InvalidPart</Code><Message>part %v</Message></Error>", p.PartNumber)
+				return
+			}
+			content = append(content, parts[p.PartNumber]...)
+		}
+		f.objects[key] = content
+		delete(f.uploads, id)
+		f.completed++
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete:
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+// list implements ListObjectsV2, the continuation token is the last entry returned
+// so deleting objects between pages does not skip any entry
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	if query.Get("list-type") != "2" {
+		http.Error(w, "only list-type=2 is supported", http.StatusBadRequest)
+		return
+	}
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	// entries are keys or common prefixes (which end with the delimiter)
+	var entries []string
+	for k := range f.objects {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if i := strings.Index(k[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			k = k[:len(prefix)+i+len(delimiter)]
+		}
+		if !slices.Contains(entries, k) {
+			entries = append(entries, k)
+		}
+	}
+	sort.Strings(entries)
+
+	start := 0
+	if token := query.Get("continuation-token"); token != "" {
+		f.continued++
+		start, _ = slices.BinarySearch(entries, token)
+		if start < len(entries) && entries[start] == token {
+			start++
+		}
+	}
+	size := f.pageSize
+	if maxKeys, err := strconv.Atoi(query.Get("max-keys")); err == nil && maxKeys < size {
+		size = maxKeys
+	}
+	end := min(start+size, len(entries))
+	res := fakeListResult{IsTruncated: end < len(entries)}
+	if res.IsTruncated {
+		res.NextContinuationToken = entries[end-1]
+	}
+	for _, e := range entries[start:end] {
+		if delimiter != "" && strings.HasSuffix(e, delimiter) && e != prefix {
+			res.CommonPrefixes = append(res.CommonPrefixes, struct {
+				Prefix string `xml:"Prefix"`
+			}{e})
+			continue
+		}
+		res.Contents = append(res.Contents, s3Object{Key: e, Size: int64(len(f.objects[e])), LastModified: fakeModTime})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+// testFileSystem runs the operations used by the binds against fsys
+func randomContent(t *testing.T, size int) []byte {
+	t.Helper()
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func writeFile(t *testing.T, fsys webdav.FileSystem, name string, content []byte) {
+	t.Helper()
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(fsys webdav.FileSystem, name string) ([]byte, error) {
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func mustReadFile(t *testing.T, fsys webdav.FileSystem, name string) []byte {
+	t.Helper()
+	content, err := readFile(fsys, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func testFileSystem(t *testing.T, fsys webdav.FileSystem) {
+	ctx := context.Background()
+	for _, dir := range []string{"/dir", "/dir/sub dir"} {
+		if err := fsys.Mkdir(ctx, dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"/dir/a+b.txt":        "first file",
+		"/dir/c.txt":          "second file",
+		"/dir/d.txt":          "third file",
+		"/dir/sub dir/ü.txt":  "nested file",
+		"/dir/sub dir/.other": "hidden file",
+	}
+	for name, content := range files {
+		writeFile(t, fsys, name, []byte(content))
+	}
+
+	st, err := fsys.Stat(ctx, "/dir/a+b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Name() != "a+b.txt" || st.Size() != int64(len(files["/dir/a+b.txt"])) || st.IsDir() {
+		t.Fatalf("unexpected stat: %v %v %v", st.Name(), st.Size(), st.IsDir())
+	}
+	if st, err := fsys.Stat(ctx, "/dir/sub dir"); err != nil || !st.IsDir() {
+		t.Fatalf("expected a directory: %v", err)
+	}
+	if _, err := fsys.Stat(ctx, "/dir/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	if _, err := fsys.OpenFile(ctx, "/missing/file", os.O_RDWR|os.O_CREATE, 0644); err == nil {
+		t.Fatal("created a file without a parent directory")
+	}
+
+	f, err := fsys.OpenFile(ctx, "/dir/c.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(7, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if rest, err := io.ReadAll(f); err != nil || string(rest) != "file" {
+		t.Fatalf("read %q after seek: %v", rest, err)
+	}
+	f.Close()
+
+	d, err := fsys.OpenFile(ctx, "/dir", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		batch, err := d.Readdir(2)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch) == 0 || len(batch) > 2 {
+			t.Fatalf("readdir returned %d entries", len(batch))
+		}
+		for _, e := range batch {
+			names = append(names, e.Name())
+		}
+	}
+	d.Close()
+	sort.Strings(names)
+	if expected := []string{"a+b.txt", "c.txt", "d.txt", "sub dir"}; !slices.Equal(names, expected) {
+		t.Fatalf("readdir returned %v, expected %v", names, expected)
+	}
+
+	var walked []string
+	err = Walk(ctx, fsys, "/dir", func(name string, info os.FileInfo) error {
+		walked = append(walked, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) != len(files)+2 {
+		t.Fatalf("walk visited %v", walked)
+	}
+
+	if err := fsys.Rename(ctx, "/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat(ctx, "/dir"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("renamed directory still exists: %v", err)
+	}
+	for name, content := range files {
+		moved := path.Join("/moved", strings.TrimPrefix(name, "/dir/"))
+		if got := mustReadFile(t, fsys, moved); string(got) != content {
+			t.Fatalf("%v has %q, expected %q", moved, got, content)
+		}
+	}
+
+	if err := fsys.RemoveAll(ctx, "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat(ctx, "/moved/sub dir"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("removed directory still exists: %v", err)
+	}
+}
+
+func TestMemStorage(t *testing.T) {
+	fsys, err := Open("mem://storage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFileSystem(t, fsys)
+
+	writeFile(t, fsys, "/kept", []byte("kept"))
+	again, err := Open("mem://storage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mustReadFile(t, again, "/kept"); string(got) != "kept" {
+		t.Fatalf("mem storage was not shared, read %q", got)
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	fsys := openFakeS3(t, srv, "some/prefix")
+	testFileSystem(t, fsys)
+
+	if fake.continued == 0 {
+		t.Fatal("list was never continued")
+	}
+	writeFile(t, fsys, "/file", []byte("content"))
+	if keys := fake.keys(); !slices.Equal(keys, []string{"some/prefix/file"}) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
+
+func TestS3Rename(t *testing.T) {
+	ctx := context.Background()
+	fake, srv := newFakeS3(t)
+	fsys := openFakeS3(t, srv, "prefix")
+	if err := fsys.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5 {
+		writeFile(t, fsys, fmt.Sprintf("/dir/%d", i), []byte(strconv.Itoa(i)))
+	}
+	if err := fsys.Rename(ctx, "/dir", "/dir2"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"prefix/dir2/", "prefix/dir2/0", "prefix/dir2/1", "prefix/dir2/2", "prefix/dir2/3", "prefix/dir2/4"}
+	if keys := fake.keys(); !slices.Equal(keys, expected) {
+		t.Fatalf("unexpected keys after rename: %v", keys)
+	}
+	if err := fsys.Rename(ctx, "/dir2", "/dir2/inside"); err == nil {
+		t.Fatal("moved a directory inside itself")
+	}
+	if got := mustReadFile(t, fsys, "/dir2/4"); !bytes.Equal(got, []byte("4")) {
+		t.Fatalf("read %q", got)
+	}
+}
+
+func TestS3ReaddirPages(t *testing.T) {
+	ctx := context.Background()
+	fake, srv := newFakeS3(t)
+	fsys := openFakeS3(t, srv, "prefix")
+	for i := range 5 {
+		writeFile(t, fsys, fmt.Sprintf("/%d", i), []byte(strconv.Itoa(i)))
+	}
+	dir, err := fsys.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	if infos, err := dir.Readdir(1); err != nil || len(infos) != 1 {
+		t.Fatalf("unexpected first entry %v: %v", infos, err)
+	}
+	if fake.continued != 0 {
+		t.Fatal("the first entry should only read the first page")
+	}
+	var names []string
+	for {
+		infos, err := dir.Readdir(1)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, infos[0].Name())
+	}
+	if !slices.Equal(names, []string{"1", "2", "3", "4"}) || fake.continued != 2 {
+		t.Fatalf("unexpected entries %v after %v pages", names, fake.continued+1)
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	ctx := context.Background()
+	fake, srv := newFakeS3(t)
+	fsys := openFakeS3(t, srv, "prefix")
+	fsys.(*s3FS).client.partSize = 10
+
+	content := randomContent(t, 95)
+	writeFile(t, fsys, "/file", content)
+	if err := fsys.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Rename(ctx, "/file", "/dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Rename(ctx, "/dir", "/dir2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustReadFile(t, fsys, "/dir2/file"); !bytes.Equal(got, content) {
+		t.Fatal("content changed after being copied in parts")
+	}
+	if fake.completed != 3 || len(fake.uploads) != 0 {
+		t.Fatalf("expected 3 multipart uploads, got %v (%v in progress)", fake.completed, len(fake.uploads))
+	}
+	if keys := fake.keys(); !slices.Equal(keys, []string{"prefix/dir2/", "prefix/dir2/file"}) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if err := checkObjectSize("key", s3MaxObjectSize+1); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}
+
+func TestS3Signature(t *testing.T) {
+	_, srv := newFakeS3(t)
+	t.Setenv("DAVD_S3_SECRET_ACCESS_KEY", "wrong-secret")
+	fsys := openFakeS3(t, srv, "")
+	_, err := fsys.Stat(context.Background(), "/file")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected the request to be rejected, got %v", err)
+	}
+}
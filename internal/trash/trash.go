@@ -0,0 +1,218 @@
+// Package trash keeps deleted and overwritten files of a bind, so they can be
+// restored until they are purged.
+//
+// Items are moved to storage.HiddenDir/trash inside the bind storage, next to
+// a JSON file with their metadata. Since the content is renamed and not copied,
+// moving to the trash is cheap and files do not leave the bind (encrypted
+// binds keep their trash encrypted).
+package trash
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"time"
+
+	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/storage"
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// Reason explains why an item was moved to the trash
+	Reason string
+
+	// Item is a file or directory in the trash
+	Item struct {
+		ID        string    `json:"id"`
+		Path      string    `json:"path"`
+		User      string    `json:"user,omitempty"`
+		DeletedAt time.Time `json:"deleted_at"`
+		Reason    Reason    `json:"reason"`
+		Dir       bool      `json:"dir,omitempty"`
+		Size      int64     `json:"size"`
+	}
+
+	// Bin is the trash of a single bind, kept in Dir
+	Bin struct {
+		fs webdav.FileSystem
+	}
+
+	// trashFS moves files to the trash instead of removing
+	// or truncating them
+	trashFS struct {
+		webdav.FileSystem
+		bin *Bin
+	}
+)
+
+const (
+	ReasonDelete    = Reason("delete")
+	ReasonOverwrite = Reason("overwrite")
+
+	// Dir contains the items in the trash
+	Dir = storage.HiddenDir + "/trash"
+)
+
+var (
+	ErrNoSuchItem = errors.New("no such item in the trash")
+)
+
+func NewBin(fsys webdav.FileSystem) *Bin {
+	return &Bin{fs: fsys}
+}
+
+// FS returns a file system which moves files to bin when they are removed
+// or truncated, fsys and bin must share the same storage.
+func FS(fsys webdav.FileSystem, bin *Bin) webdav.FileSystem {
+	return &trashFS{FileSystem: fsys, bin: bin}
+}
+
+// Put moves name to the trash, the user is taken from ctx
+func (b *Bin) Put(ctx context.Context, name string, reason Reason) (Item, error) {
+	name = path.Clean("/" + name)
+	if name == "/" || storage.IsHidden(name) {
+		return Item{}, &fs.PathError{Op: "trash", Path: name, Err: os.ErrPermission}
+	}
+	info, err := b.fs.Stat(ctx, name)
+	if err != nil {
+		return Item{}, err
+	}
+	item := Item{
+		ID:        storage.NewID(),
+		Path:      name,
+		User:      config.UserNameFromContext(ctx),
+		DeletedAt: time.Now().UTC(),
+		Reason:    reason,
+		Dir:       info.IsDir(),
+		Size:      info.Size(),
+	}
+	if item.Dir {
+		item.Size = 0
+		storage.Walk(ctx, b.fs, name, func(_ string, fi os.FileInfo) error {
+			if !fi.IsDir() {
+				item.Size += fi.Size()
+			}
+			return nil
+		})
+	}
+	if err := storage.MkdirAll(ctx, b.fs, Dir, 0755); err != nil {
+		return Item{}, err
+	}
+	if err := storage.WriteRecord(ctx, b.fs, b.metaName(item.ID), item); err != nil {
+		return Item{}, err
+	}
+	if err := b.fs.Rename(ctx, name, b.dataName(item.ID)); err != nil {
+		b.fs.RemoveAll(ctx, b.metaName(item.ID))
+		return Item{}, err
+	}
+	slog.Info("Moved to trash", "path", name, "id", item.ID, "reason", reason, "user", item.User)
+	return item, nil
+}
+
+// List returns all items in the trash, the most recent first
+func (b *Bin) List(ctx context.Context) ([]Item, error) {
+	ids, err := storage.RecordIDs(ctx, b.fs, Dir)
+	if err != nil {
+		return nil, err
+	}
+	var items []Item
+	for _, id := range ids {
+		item, err := b.Get(ctx, id)
+		if err != nil {
+			slog.Warn("Ignoring invalid trash item", "id", id, "error", err)
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (b *Bin) Get(ctx context.Context, id string) (Item, error) {
+	var item Item
+	if !storage.ValidID(id) {
+		return item, ErrNoSuchItem
+	}
+	err := storage.ReadRecord(ctx, b.fs, b.metaName(id), &item)
+	if errors.Is(err, os.ErrNotExist) {
+		return item, ErrNoSuchItem
+	}
+	return item, err
+}
+
+// Restore moves the item back to its original path,
+// which must not exist
+func (b *Bin) Restore(ctx context.Context, id string) (Item, error) {
+	item, err := b.Get(ctx, id)
+	if err != nil {
+		return item, err
+	}
+	if _, err := b.fs.Stat(ctx, item.Path); err == nil {
+		return item, &fs.PathError{Op: "restore", Path: item.Path, Err: os.ErrExist}
+	}
+	if err := storage.MkdirAll(ctx, b.fs, path.Dir(item.Path), 0755); err != nil {
+		return item, err
+	}
+	if err := b.fs.Rename(ctx, b.dataName(id), item.Path); err != nil {
+		return item, err
+	}
+	slog.Info("Restored from trash", "path", item.Path, "id", id, "user", config.UserNameFromContext(ctx))
+	return item, b.fs.RemoveAll(ctx, b.metaName(id))
+}
+
+// Purge removes the item permanently
+func (b *Bin) Purge(ctx context.Context, id string) error {
+	if _, err := b.Get(ctx, id); err != nil {
+		return err
+	}
+	if err := b.fs.RemoveAll(ctx, b.dataName(id)); err != nil {
+		return err
+	}
+	return b.fs.RemoveAll(ctx, b.metaName(id))
+}
+
+// PurgeBefore removes all items deleted before t,
+// returning how many were removed
+func (b *Bin) PurgeBefore(ctx context.Context, t time.Time) (int, error) {
+	items, err := b.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, item := range items {
+		if !item.DeletedAt.Before(t) {
+			continue
+		}
+		if err := b.Purge(ctx, item.ID); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (b *Bin) dataName(id string) string { return path.Join(Dir, id) }
+func (b *Bin) metaName(id string) string { return path.Join(Dir, id+".json") }
+
+func (t *trashFS) RemoveAll(ctx context.Context, name string) error {
+	if _, err := t.FileSystem.Stat(ctx, name); errors.Is(err, os.ErrNotExist) {
+		return t.FileSystem.RemoveAll(ctx, name)
+	}
+	_, err := t.bin.Put(ctx, name, ReasonDelete)
+	return err
+}
+
+func (t *trashFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&os.O_TRUNC != 0 {
+		if st, err := t.FileSystem.Stat(ctx, name); err == nil && st.Mode().IsRegular() && st.Size() > 0 {
+			if _, err := t.bin.Put(ctx, name, ReasonOverwrite); err != nil {
+				return nil, err
+			}
+			flag |= os.O_CREATE
+		}
+	}
+	return t.FileSystem.OpenFile(ctx, name, flag, perm)
+}
@@ -0,0 +1,177 @@
+package trash
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/storage"
+	"golang.org/x/net/webdav"
+)
+
+func writeFile(t *testing.T, fsys webdav.FileSystem, name, content string) {
+	t.Helper()
+	f, err := fsys.OpenFile(context.Background(), name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.WriteString(f, content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fsys webdav.FileSystem, name string) string {
+	t.Helper()
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestMoveOnDelete(t *testing.T) {
+	ctx := config.WithUser(context.Background(), &config.User{Name: "alice"})
+	mem := webdav.NewMemFS()
+	bin := NewBin(mem)
+	fsys := FS(mem, bin)
+	if err := fsys.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fsys, "/dir/a", "hello")
+	writeFile(t, fsys, "/dir/b", "world!")
+
+	if err := fsys.RemoveAll(ctx, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat(ctx, "/dir"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("directory was not removed: %v", err)
+	}
+	if err := fsys.RemoveAll(ctx, "/missing"); err != nil {
+		t.Fatalf("removing a missing file failed: %v", err)
+	}
+	items, err := bin.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("unexpected items: %+v", items)
+	}
+	item := items[0]
+	if item.Path != "/dir" || !item.Dir || item.Size != 11 || item.User != "alice" || item.Reason != ReasonDelete {
+		t.Fatalf("unexpected item: %+v", item)
+	}
+
+	if _, err := bin.Restore(ctx, item.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fsys, "/dir/b"); got != "world!" {
+		t.Fatalf("restored content is %q", got)
+	}
+	if _, err := bin.Get(ctx, item.ID); !errors.Is(err, ErrNoSuchItem) {
+		t.Fatalf("restored item is still in the trash: %v", err)
+	}
+	if _, err := bin.Put(ctx, storage.HiddenDir, ReasonDelete); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("hidden files moved to the trash: %v", err)
+	}
+}
+
+func TestMoveOnOverwrite(t *testing.T) {
+	ctx := context.Background()
+	mem := webdav.NewMemFS()
+	bin := NewBin(mem)
+	fsys := FS(mem, bin)
+	writeFile(t, fsys, "/empty", "")
+	writeFile(t, fsys, "/empty", "not trashed")
+	writeFile(t, fsys, "/file", "old")
+	writeFile(t, fsys, "/file", "new")
+
+	items, err := bin.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Path != "/file" || items[0].Reason != ReasonOverwrite || items[0].Size != 3 {
+		t.Fatalf("unexpected items: %+v", items)
+	}
+	if got := readFile(t, fsys, "/file"); got != "new" {
+		t.Fatalf("content is %q", got)
+	}
+
+	// restoring over an existing path must not replace it
+	if _, err := bin.Restore(ctx, items[0].ID); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("restored over an existing file: %v", err)
+	}
+	if got := readFile(t, fsys, "/file"); got != "new" {
+		t.Fatalf("content changed to %q", got)
+	}
+	if err := mem.RemoveAll(ctx, "/file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bin.Restore(ctx, items[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fsys, "/file"); got != "old" {
+		t.Fatalf("restored content is %q", got)
+	}
+}
+
+func TestPurgeBefore(t *testing.T) {
+	ctx := context.Background()
+	mem := webdav.NewMemFS()
+	bin := NewBin(mem)
+	fsys := FS(mem, bin)
+	writeFile(t, fsys, "/old", "old")
+	writeFile(t, fsys, "/recent", "recent")
+	for _, name := range []string{"/old", "/recent"} {
+		if err := fsys.RemoveAll(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items, err := bin.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var old Item
+	for _, item := range items {
+		if item.Path == "/old" {
+			old = item
+		}
+	}
+	old.DeletedAt = old.DeletedAt.Add(-48 * time.Hour)
+	if err := mem.RemoveAll(ctx, bin.metaName(old.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.WriteRecord(ctx, mem, bin.metaName(old.ID), old); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := bin.PurgeBefore(ctx, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Fatalf("purged %v items", purged)
+	}
+	items, err = bin.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Path != "/recent" {
+		t.Fatalf("unexpected items: %+v", items)
+	}
+	if _, err := mem.Stat(ctx, bin.dataName(old.ID)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("purged content was kept: %v", err)
+	}
+	if err := bin.Purge(ctx, old.ID); !errors.Is(err, ErrNoSuchItem) {
+		t.Fatalf("purged item still exists: %v", err)
+	}
+}
@@ -0,0 +1,527 @@
+// Package uploads implements resumable uploads: files are sent in chunks,
+// in any order, which are staged inside the bind and only moved into place
+// once every chunk was received and the complete file was verified.
+//
+// Sessions are stored in storage.HiddenDir/uploads/<id>/, next to a JSON
+// file with their metadata. Each chunk is written to a temporary file and
+// renamed once its checksum is verified, so partial chunks are never
+// considered received.
+//
+// Stream sessions receive the file sequentially instead (see Append),
+// each request is stored as the next chunk.
+//
+// Sessions which are not updated for a while are considered abandoned
+// and removed by PurgeBefore.
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/storage"
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// Session is an upload in progress
+	Session struct {
+		ID        string `json:"id"`
+		Path      string `json:"path"`
+		User      string `json:"user,omitempty"`
+		Size      int64  `json:"size"`
+		ChunkSize int64  `json:"chunk_size"`
+		// SHA256 is the hex encoded hash of the complete file, if empty
+		// it is computed (but not verified) when the upload is assembled
+		SHA256 string `json:"sha256,omitempty"`
+		// Parts is set for uploads without a known size (see OpenParts),
+		// parts can have any size and are not verified
+		Parts int `json:"parts,omitempty"`
+		// Stream is set for sessions created by CreateStream
+		Stream    bool              `json:"stream,omitempty"`
+		Metadata  map[string]string `json:"metadata,omitempty"`
+		CreatedAt time.Time         `json:"created_at"`
+		// Received, Offset (bytes received by stream sessions) and UpdatedAt
+		// (when the last chunk was received) are not persisted, they are computed by Get
+		Received  []int     `json:"received"`
+		Offset    int64     `json:"offset,omitempty"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+
+	// Store keeps the upload sessions of a single bind
+	Store struct {
+		fs webdav.FileSystem
+		// busy contains the stream sessions being appended to
+		busy sync.Map
+	}
+)
+
+const (
+	// Dir contains the upload sessions
+	Dir = storage.HiddenDir + "/uploads"
+
+	DefaultChunkSize = 8 << 20
+	MaxChunkSize     = 64 << 20
+	// MaxChunks limits how many chunks (or parts) a session can expect,
+	// larger files must use larger chunks
+	MaxChunks = 10000
+
+	metaFile = "session.json"
+	dataFile = "data"
+)
+
+var (
+	ErrNoSuchSession = errors.New("no such upload session")
+	ErrInvalidChunk  = errors.New("invalid chunk")
+	ErrChecksum      = errors.New("checksum mismatch")
+	ErrIncomplete    = errors.New("upload is incomplete")
+	ErrOffset        = errors.New("offset mismatch")
+	ErrBusy          = errors.New("upload is busy")
+)
+
+func NewStore(fsys webdav.FileSystem) *Store {
+	return &Store{fs: fsys}
+}
+
+// Chunks returns how many chunks are needed to upload the file,
+// stream sessions need as many chunks as they received
+func (s Session) Chunks() int {
+	switch {
+	case s.Stream:
+		return len(s.Received)
+	case s.Parts > 0:
+		return s.Parts
+	}
+	return int((s.Size + s.ChunkSize - 1) / s.ChunkSize)
+}
+
+// ChunkLen returns the size of chunk n, only the last chunk can be shorter than ChunkSize
+func (s Session) ChunkLen(n int) int64 {
+	return min(s.ChunkSize, s.Size-int64(n)*s.ChunkSize)
+}
+
+// Missing returns up to limit chunks which were not received yet, the lowest first.
+// It only walks the received chunks, so it is cheap even for sessions with many chunks.
+func (s Session) Missing(limit int) []int {
+	var missing []int
+	// next is the first chunk which may be missing, Received is sorted
+	next := 0
+	gap := func(end int) {
+		for ; next < end && len(missing) < limit; next++ {
+			missing = append(missing, next)
+		}
+	}
+	for _, n := range s.Received {
+		gap(n)
+		next = max(next, n+1)
+	}
+	gap(s.Chunks())
+	return missing
+}
+
+// MissingCount returns how many chunks were not received yet
+func (s Session) MissingCount() int {
+	return max(s.Chunks()-len(s.Received), 0)
+}
+
+// Create starts a new upload of sess.Path, the user is taken from ctx
+func (s *Store) Create(ctx context.Context, sess Session) (Session, error) {
+	if sess.ChunkSize == 0 {
+		sess.ChunkSize = DefaultChunkSize
+	}
+	switch {
+	case sess.Size < 0:
+		return Session{}, fmt.Errorf("invalid size %v", sess.Size)
+	case sess.ChunkSize < 0 || sess.ChunkSize > MaxChunkSize:
+		return Session{}, fmt.Errorf("chunk size must be between 1 and %v bytes", MaxChunkSize)
+	case sess.Size > MaxChunks*sess.ChunkSize:
+		return Session{}, fmt.Errorf("a file of %v bytes needs more than %v chunks of %v bytes", sess.Size, MaxChunks, sess.ChunkSize)
+	case sess.SHA256 != "" && !validSum(sess.SHA256):
+		return Session{}, fmt.Errorf("invalid sha256 %q", sess.SHA256)
+	}
+	sess.SHA256 = strings.ToLower(sess.SHA256)
+	sess.Parts, sess.Stream = 0, false
+	return s.create(ctx, sess)
+}
+
+// CreateStream starts a new upload of name, which receives size bytes
+// sequentially (see Append), metadata is kept with the session
+func (s *Store) CreateStream(ctx context.Context, name string, size int64, metadata map[string]string) (Session, error) {
+	if size < 0 {
+		return Session{}, fmt.Errorf("invalid size %v", size)
+	}
+	return s.create(ctx, Session{Path: name, Size: size, Stream: true, Metadata: metadata})
+}
+
+func (s *Store) create(ctx context.Context, sess Session) (Session, error) {
+	sess.Path = path.Clean("/" + sess.Path)
+	if sess.Path == "/" || storage.IsHidden(sess.Path) {
+		return Session{}, &fs.PathError{Op: "upload", Path: sess.Path, Err: os.ErrPermission}
+	}
+	sess.ID = storage.NewID()
+	sess.User = config.UserNameFromContext(ctx)
+	sess.CreatedAt = time.Now().UTC()
+	sess.Received = []int{}
+	if err := storage.MkdirAll(ctx, s.fs, s.dir(sess.ID), 0755); err != nil {
+		return Session{}, err
+	}
+	if err := s.storeSession(ctx, sess); err != nil {
+		s.fs.RemoveAll(ctx, s.dir(sess.ID))
+		return Session{}, err
+	}
+	slog.Info("Upload started", "path", sess.Path, "id", sess.ID, "size", sess.Size, "user", sess.User)
+	return sess, nil
+}
+
+// Get returns the session, including the chunks received so far
+func (s *Store) Get(ctx context.Context, id string) (Session, error) {
+	var sess Session
+	if !storage.ValidID(id) {
+		return sess, ErrNoSuchSession
+	}
+	err := storage.ReadRecord(ctx, s.fs, path.Join(s.dir(id), metaFile), &sess)
+	if errors.Is(err, os.ErrNotExist) {
+		return sess, ErrNoSuchSession
+	} else if err != nil {
+		return sess, err
+	}
+	entries, err := storage.ReadDir(ctx, s.fs, s.dir(id))
+	if err != nil {
+		return sess, err
+	}
+	sess.Received = []int{}
+	sess.UpdatedAt = sess.CreatedAt
+	sizes := map[int]int64{}
+	for _, e := range entries {
+		if e.ModTime().After(sess.UpdatedAt) {
+			sess.UpdatedAt = e.ModTime().UTC()
+		}
+		// only the names written by the store are chunks, so each chunk is counted once
+		if n, err := strconv.Atoi(e.Name()); err == nil && n >= 0 && e.Name() == strconv.Itoa(n) && (sess.Stream || n < sess.Chunks()) {
+			sess.Received = append(sess.Received, n)
+			sizes[n] = e.Size()
+		}
+	}
+	sort.Ints(sess.Received)
+	if sess.Stream {
+		// chunks are appended in order, anything after a gap is ignored
+		for n, received := range sess.Received {
+			if n != received {
+				sess.Received = sess.Received[:n]
+				break
+			}
+			sess.Offset += sizes[n]
+		}
+	}
+	return sess, nil
+}
+
+// PutChunk stores chunk n, sum is the hex encoded sha256 of its content.
+// Chunks can be sent in any order and sent again (eg.: after a failure).
+func (s *Store) PutChunk(ctx context.Context, id string, n int, r io.Reader, sum string) error {
+	sess, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if sess.Parts > 0 || sess.Stream {
+		return fmt.Errorf("%w: upload %v does not expect chunks", ErrInvalidChunk, id)
+	}
+	if n < 0 || n >= sess.Chunks() {
+		return fmt.Errorf("%w: %v is not between 0 and %v", ErrInvalidChunk, n, sess.Chunks()-1)
+	}
+	if !validSum(sum) {
+		return fmt.Errorf("%w: invalid sha256 %q", ErrInvalidChunk, sum)
+	}
+	tmp := path.Join(s.dir(id), fmt.Sprintf("%v.%v.part", n, storage.NewID()))
+	f, err := s.fs.OpenFile(ctx, tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	written, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, sess.ChunkLen(n)+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	switch {
+	case err != nil:
+	case written != sess.ChunkLen(n):
+		err = fmt.Errorf("%w: chunk %v has %v bytes, expected %v", ErrInvalidChunk, n, written, sess.ChunkLen(n))
+	case hex.EncodeToString(h.Sum(nil)) != strings.ToLower(sum):
+		err = fmt.Errorf("%w: chunk %v", ErrChecksum, n)
+	}
+	if err != nil {
+		s.fs.RemoveAll(ctx, tmp)
+		return err
+	}
+	return s.fs.Rename(ctx, tmp, path.Join(s.dir(id), strconv.Itoa(n)))
+}
+
+// Assemble concatenates the chunks into the staged file, verifying the hash
+// of the complete file. The returned session contains the computed hash.
+func (s *Store) Assemble(ctx context.Context, id string) (Session, error) {
+	sess, err := s.Get(ctx, id)
+	if err != nil {
+		return sess, err
+	}
+	if sess.Stream && sess.Offset != sess.Size {
+		return sess, fmt.Errorf("%w: %v of %v bytes received", ErrIncomplete, sess.Offset, sess.Size)
+	}
+	if missing := sess.MissingCount(); missing > 0 {
+		return sess, fmt.Errorf("%w: %v chunks missing", ErrIncomplete, missing)
+	}
+	data := path.Join(s.dir(id), dataFile)
+	out, err := s.fs.OpenFile(ctx, data, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return sess, err
+	}
+	h := sha256.New()
+	size, err := s.appendChunks(ctx, io.MultiWriter(out, h), sess)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err == nil && sess.SHA256 != "" && sess.SHA256 != sum {
+		err = fmt.Errorf("%w: file hash is %v, expected %v", ErrChecksum, sum, sess.SHA256)
+	}
+	if err != nil {
+		s.fs.RemoveAll(ctx, data)
+		return sess, err
+	}
+	sess.SHA256 = sum
+	sess.Size = size
+	return sess, nil
+}
+
+func (s *Store) appendChunks(ctx context.Context, out io.Writer, sess Session) (int64, error) {
+	var size int64
+	for n := range sess.Chunks() {
+		f, err := s.fs.OpenFile(ctx, path.Join(s.dir(sess.ID), strconv.Itoa(n)), os.O_RDONLY, 0)
+		if err != nil {
+			return size, fmt.Errorf("open chunk %d: %w", n, err)
+		}
+		written, err := io.Copy(out, f)
+		f.Close()
+		size += written
+		if err != nil {
+			return size, fmt.Errorf("copy chunk %d: %w", n, err)
+		}
+	}
+	return size, nil
+}
+
+// Finish moves the file staged by Assemble to its destination
+// and removes the session
+func (s *Store) Finish(ctx context.Context, id string) error {
+	sess, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := storage.MkdirAll(ctx, s.fs, path.Dir(sess.Path), 0755); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(ctx, path.Join(s.dir(id), dataFile), sess.Path); err != nil {
+		return err
+	}
+	slog.Info("Upload finished", "path", sess.Path, "id", id, "size", sess.Size, "user", config.UserNameFromContext(ctx))
+	return s.fs.RemoveAll(ctx, s.dir(id))
+}
+
+// OpenParts returns the session used to upload name in the given number of parts,
+// it is created by the first call with the same name, clientID and user.
+// This supports clients which do not know the size of the file or their chunks
+// upfront (eg.: the legacy uploader-* headers of drive.handlePut).
+func (s *Store) OpenParts(ctx context.Context, name, clientID string, parts int) (Session, error) {
+	name = path.Clean("/" + name)
+	if name == "/" || storage.IsHidden(name) {
+		return Session{}, &fs.PathError{Op: "upload", Path: name, Err: os.ErrPermission}
+	}
+	if parts <= 0 || parts > MaxChunks {
+		return Session{}, fmt.Errorf("%w: number of parts must be between 1 and %v", ErrInvalidChunk, MaxChunks)
+	}
+	user := config.UserNameFromContext(ctx)
+	h := sha256.Sum256([]byte(user + "\x00" + name + "\x00" + clientID))
+	id := "parts-" + hex.EncodeToString(h[:16])
+	sess, err := s.Get(ctx, id)
+	if err == nil || !errors.Is(err, ErrNoSuchSession) {
+		if err == nil && sess.Parts != parts {
+			err = fmt.Errorf("%w: upload %v expects %v parts", ErrInvalidChunk, id, sess.Parts)
+		}
+		return sess, err
+	}
+	sess = Session{ID: id, Path: name, User: user, Parts: parts, CreatedAt: time.Now().UTC(), Received: []int{}}
+	if err := storage.MkdirAll(ctx, s.fs, s.dir(id), 0755); err != nil {
+		return Session{}, err
+	}
+	if err := s.storeSession(ctx, sess); errors.Is(err, os.ErrExist) {
+		// created by a concurrent request
+		return s.Get(ctx, id)
+	} else if err != nil {
+		return Session{}, err
+	}
+	sess.UpdatedAt = sess.CreatedAt
+	return sess, nil
+}
+
+// PutPart stores part n of a session created by OpenParts,
+// returning its size
+func (s *Store) PutPart(ctx context.Context, id string, n int, r io.Reader) (int64, error) {
+	sess, err := s.Get(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if sess.Parts == 0 || n < 0 || n >= sess.Parts {
+		return 0, fmt.Errorf("%w: part %v of upload %v", ErrInvalidChunk, n, id)
+	}
+	tmp := path.Join(s.dir(id), fmt.Sprintf("%v.%v.part", n, storage.NewID()))
+	f, err := s.fs.OpenFile(ctx, tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(f, io.LimitReader(r, MaxChunkSize+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && written > MaxChunkSize {
+		err = fmt.Errorf("%w: part %v is larger than %v bytes", ErrInvalidChunk, n, MaxChunkSize)
+	}
+	if err != nil {
+		s.fs.RemoveAll(ctx, tmp)
+		return 0, err
+	}
+	return written, s.fs.Rename(ctx, tmp, path.Join(s.dir(id), strconv.Itoa(n)))
+}
+
+// Append stores the bytes sent to a stream session, offset must match the bytes
+// received so far. If h is not nil the bytes are kept only if their hash is sum,
+// otherwise the bytes read before r fails are kept, so the client can resume
+// from the returned offset.
+func (s *Store) Append(ctx context.Context, id string, offset int64, r io.Reader, h hash.Hash, sum []byte) (int64, error) {
+	if _, busy := s.busy.LoadOrStore(id, true); busy {
+		return 0, ErrBusy
+	}
+	defer s.busy.Delete(id)
+	sess, err := s.Get(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if !sess.Stream {
+		return 0, fmt.Errorf("%w: upload %v expects chunks", ErrInvalidChunk, id)
+	}
+	if offset != sess.Offset {
+		return sess.Offset, fmt.Errorf("%w: upload %v is at offset %v", ErrOffset, id, sess.Offset)
+	}
+	n := len(sess.Received)
+	tmp := path.Join(s.dir(id), fmt.Sprintf("%v.%v.part", n, storage.NewID()))
+	f, err := s.fs.OpenFile(ctx, tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return offset, err
+	}
+	var w io.Writer = f
+	if h != nil {
+		w = io.MultiWriter(f, h)
+	}
+	written, err := io.Copy(w, io.LimitReader(r, sess.Size-offset+1))
+	keep := written > 0
+	switch closeErr := f.Close(); {
+	case closeErr != nil:
+		err, keep = closeErr, false
+	case written > sess.Size-offset:
+		err, keep = fmt.Errorf("%w: upload %v is larger than %v bytes", ErrInvalidChunk, id, sess.Size), false
+	case h != nil && err != nil:
+		keep = false
+	case h != nil && !bytes.Equal(h.Sum(nil), sum):
+		err, keep = fmt.Errorf("%w: bytes at offset %v", ErrChecksum, offset), false
+	}
+	if !keep {
+		s.fs.RemoveAll(ctx, tmp)
+		return offset, err
+	}
+	if renameErr := s.fs.Rename(ctx, tmp, path.Join(s.dir(id), strconv.Itoa(n))); renameErr != nil {
+		s.fs.RemoveAll(ctx, tmp)
+		return offset, renameErr
+	}
+	return offset + written, err
+}
+
+// List returns all sessions, the oldest first
+func (s *Store) List(ctx context.Context) ([]Session, error) {
+	entries, err := storage.ReadDir(ctx, s.fs, Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var list []Session
+	for _, e := range entries {
+		sess, err := s.Get(ctx, e.Name())
+		if err != nil {
+			slog.Warn("Ignoring invalid upload session", "id", e.Name(), "error", err)
+			continue
+		}
+		list = append(list, sess)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+// PurgeBefore removes the sessions which were not updated since t,
+// including invalid sessions, returning how many were removed
+func (s *Store) PurgeBefore(ctx context.Context, t time.Time) (int, error) {
+	entries, err := storage.ReadDir(ctx, s.fs, Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, e := range entries {
+		updated := e.ModTime()
+		if sess, err := s.Get(ctx, e.Name()); err == nil {
+			updated = sess.UpdatedAt
+		}
+		if !updated.Before(t) {
+			continue
+		}
+		if err := s.fs.RemoveAll(ctx, s.dir(e.Name())); err != nil {
+			return purged, err
+		}
+		slog.Info("Removed stale upload", "id", e.Name(), "updated", updated)
+		purged++
+	}
+	return purged, nil
+}
+
+// Abort removes the session and any chunk received so far
+func (s *Store) Abort(ctx context.Context, id string) error {
+	if _, err := s.Get(ctx, id); err != nil {
+		return err
+	}
+	return s.fs.RemoveAll(ctx, s.dir(id))
+}
+
+func (s *Store) storeSession(ctx context.Context, sess Session) error {
+	sess.Received = nil
+	return storage.WriteRecord(ctx, s.fs, path.Join(s.dir(sess.ID), metaFile), sess)
+}
+
+func (s *Store) dir(id string) string { return path.Join(Dir, id) }
+
+func validSum(sum string) bool {
+	b, err := hex.DecodeString(sum)
+	return err == nil && len(b) == sha256.Size
+}
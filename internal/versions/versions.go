@@ -0,0 +1,254 @@
+// Package versions keeps the previous content of overwritten files.
+//
+// Versions of a file are stored in storage.HiddenDir/versions/<file path>/,
+// one entry per version next to a JSON file with its metadata. Versions are
+// not moved with their file, and are kept when the file is deleted (so they
+// are still available if the file is restored from the trash).
+package versions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/storage"
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// Version is the content of a file before it was overwritten
+	Version struct {
+		ID   string `json:"id"`
+		Path string `json:"path"`
+		Size int64  `json:"size"`
+		// ModTime is when the content was written and ReplacedAt when it was overwritten
+		ModTime    time.Time `json:"mod_time"`
+		ReplacedAt time.Time `json:"replaced_at"`
+		// User that replaced the content
+		User string `json:"user,omitempty"`
+	}
+
+	// Policy defines which versions are kept, zero values do not limit versions
+	Policy struct {
+		Keep   int
+		Window time.Duration
+	}
+
+	// Store keeps the versions of the files of a single bind
+	Store struct {
+		fs     webdav.FileSystem
+		policy Policy
+	}
+
+	// versionsFS saves the current content of files before they are truncated
+	versionsFS struct {
+		webdav.FileSystem
+		store *Store
+	}
+)
+
+const (
+	// Dir contains the versions of all files
+	Dir = storage.HiddenDir + "/versions"
+)
+
+var (
+	ErrNoSuchVersion = errors.New("no such version")
+)
+
+func NewStore(fsys webdav.FileSystem, policy Policy) *Store {
+	return &Store{fs: fsys, policy: policy}
+}
+
+// FS returns a file system which saves a version of files before
+// they are truncated, fsys and store must share the same storage.
+func FS(fsys webdav.FileSystem, store *Store) webdav.FileSystem {
+	return &versionsFS{FileSystem: fsys, store: store}
+}
+
+// Save moves the current content of name to a new version,
+// empty files and directories are ignored
+func (s *Store) Save(ctx context.Context, name string) (*Version, error) {
+	v, err := s.save(ctx, name)
+	if v != nil {
+		if err := s.Prune(ctx, v.Path); err != nil {
+			slog.Warn("Unable to prune versions", "path", v.Path, "error", err)
+		}
+	}
+	return v, err
+}
+
+func (s *Store) save(ctx context.Context, name string) (*Version, error) {
+	name = path.Clean("/" + name)
+	if name == "/" || storage.IsHidden(name) {
+		return nil, &fs.PathError{Op: "save version", Path: name, Err: os.ErrPermission}
+	}
+	info, err := s.fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return nil, nil
+	}
+	v := Version{
+		ID:         storage.NewID(),
+		Path:       name,
+		Size:       info.Size(),
+		ModTime:    info.ModTime().UTC(),
+		ReplacedAt: time.Now().UTC(),
+		User:       config.UserNameFromContext(ctx),
+	}
+	if err := storage.MkdirAll(ctx, s.fs, s.dir(name), 0755); err != nil {
+		return nil, err
+	}
+	if err := storage.WriteRecord(ctx, s.fs, s.metaName(name, v.ID), v); err != nil {
+		return nil, err
+	}
+	if err := s.fs.Rename(ctx, name, s.dataName(name, v.ID)); err != nil {
+		s.fs.RemoveAll(ctx, s.metaName(name, v.ID))
+		return nil, err
+	}
+	return &v, nil
+}
+
+// List returns the versions of name, the most recent first
+func (s *Store) List(ctx context.Context, name string) ([]Version, error) {
+	name = path.Clean("/" + name)
+	ids, err := storage.RecordIDs(ctx, s.fs, s.dir(name))
+	if err != nil {
+		return nil, err
+	}
+	var list []Version
+	for _, id := range ids {
+		v, err := s.Get(ctx, name, id)
+		if err != nil {
+			slog.Warn("Ignoring invalid version", "path", name, "id", id, "error", err)
+			continue
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func (s *Store) Get(ctx context.Context, name, id string) (Version, error) {
+	var v Version
+	if !storage.ValidID(id) {
+		return v, ErrNoSuchVersion
+	}
+	err := storage.ReadRecord(ctx, s.fs, s.metaName(name, id), &v)
+	if errors.Is(err, os.ErrNotExist) {
+		return v, ErrNoSuchVersion
+	}
+	return v, err
+}
+
+// Open returns the content of the version
+func (s *Store) Open(ctx context.Context, name, id string) (webdav.File, error) {
+	if _, err := s.Get(ctx, name, id); err != nil {
+		return nil, err
+	}
+	return s.fs.OpenFile(ctx, s.dataName(name, id), os.O_RDONLY, 0)
+}
+
+// Restore replaces the content of name with the version,
+// the current content is saved as a new version first
+func (s *Store) Restore(ctx context.Context, name, id string) error {
+	name = path.Clean("/" + name)
+	if _, err := s.Get(ctx, name, id); err != nil {
+		return err
+	}
+	if _, err := s.fs.Stat(ctx, name); err == nil {
+		// pruned only after the copy, otherwise the version might be removed
+		if _, err := s.save(ctx, name); err != nil {
+			return err
+		}
+	}
+	if err := storage.CopyFile(ctx, s.fs, s.dataName(name, id), name); err != nil {
+		return fmt.Errorf("unable to restore version %v of %v: %w", id, name, err)
+	}
+	slog.Info("Version restored", "path", name, "id", id, "user", config.UserNameFromContext(ctx))
+	return s.Prune(ctx, name)
+}
+
+// Prune removes the versions of name which are not allowed by the policy
+func (s *Store) Prune(ctx context.Context, name string) error {
+	list, err := s.List(ctx, name)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	kept := 0
+	for i, v := range list {
+		keep := (s.policy.Keep <= 0 || i < s.policy.Keep) &&
+			(s.policy.Window <= 0 || now.Sub(v.ReplacedAt) < s.policy.Window)
+		if keep {
+			kept++
+			continue
+		}
+		if err := s.fs.RemoveAll(ctx, s.dataName(name, v.ID)); err != nil {
+			return err
+		}
+		if err := s.fs.RemoveAll(ctx, s.metaName(name, v.ID)); err != nil {
+			return err
+		}
+	}
+	if kept == 0 && len(list) > 0 {
+		if entries, err := storage.ReadDir(ctx, s.fs, s.dir(name)); err == nil && len(entries) == 0 {
+			return s.fs.RemoveAll(ctx, s.dir(name))
+		}
+	}
+	return nil
+}
+
+// PruneAll prunes the versions of every file, returning how many files had versions
+func (s *Store) PruneAll(ctx context.Context) (int, error) {
+	var names []string
+	err := storage.Walk(ctx, s.fs, Dir, func(name string, info os.FileInfo) error {
+		if !info.IsDir() && strings.HasSuffix(name, ".json") {
+			file := strings.TrimPrefix(path.Dir(name), Dir)
+			if len(names) == 0 || names[len(names)-1] != file {
+				names = append(names, file)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		if err := s.Prune(ctx, name); err != nil {
+			return 0, err
+		}
+	}
+	return len(names), nil
+}
+
+func (s *Store) dir(name string) string { return path.Join(Dir, path.Clean("/"+name)) }
+func (s *Store) dataName(name, id string) string {
+	return path.Join(s.dir(name), id)
+}
+func (s *Store) metaName(name, id string) string {
+	return path.Join(s.dir(name), id+".json")
+}
+
+func (v *versionsFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&os.O_TRUNC != 0 {
+		saved, err := v.store.Save(ctx, name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if saved != nil {
+			flag |= os.O_CREATE
+		}
+	}
+	return v.FileSystem.OpenFile(ctx, name, flag, perm)
+}
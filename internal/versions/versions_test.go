@@ -0,0 +1,185 @@
+package versions
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/andrebq/davd/internal/storage"
+	"golang.org/x/net/webdav"
+)
+
+func writeFile(t *testing.T, fsys webdav.FileSystem, name, content string) {
+	t.Helper()
+	f, err := fsys.OpenFile(context.Background(), name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.WriteString(f, content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fsys webdav.FileSystem, name string) string {
+	t.Helper()
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func contents(t *testing.T, s *Store, name string) []string {
+	t.Helper()
+	list, err := s.List(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []string
+	for _, v := range list {
+		all = append(all, readFile(t, s.fs, s.dataName(name, v.ID)))
+	}
+	return all
+}
+
+func TestSaveOnOverwrite(t *testing.T) {
+	ctx := context.Background()
+	mem := webdav.NewMemFS()
+	store := NewStore(mem, Policy{})
+	fsys := FS(mem, store)
+	writeFile(t, fsys, "/empty", "")
+	writeFile(t, fsys, "/empty", "empty files have no versions")
+	for _, content := range []string{"v1", "v2", "v3"} {
+		writeFile(t, fsys, "/file", content)
+	}
+
+	if got := contents(t, store, "/file"); len(got) != 2 || got[0] != "v2" || got[1] != "v1" {
+		t.Fatalf("unexpected versions: %v", got)
+	}
+	if got := contents(t, store, "/empty"); len(got) != 0 {
+		t.Fatalf("unexpected versions: %v", got)
+	}
+	if got := readFile(t, fsys, "/file"); got != "v3" {
+		t.Fatalf("content is %q", got)
+	}
+
+	// versions are kept when the file is removed
+	if err := fsys.RemoveAll(ctx, "/file"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := store.List(ctx, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("versions were removed with the file: %+v", list)
+	}
+	if _, err := store.Save(ctx, storage.HiddenDir+"/file"); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("saved a version of a hidden file: %v", err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+	mem := webdav.NewMemFS()
+	store := NewStore(mem, Policy{Keep: 2})
+	fsys := FS(mem, store)
+	writeFile(t, fsys, "/file", "old")
+	writeFile(t, fsys, "/file", "current")
+	list, err := store.List(ctx, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("unexpected versions: %+v", list)
+	}
+
+	if err := store.Restore(ctx, "/file", list[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fsys, "/file"); got != "old" {
+		t.Fatalf("restored content is %q", got)
+	}
+	if got := contents(t, store, "/file"); len(got) != 2 || got[0] != "current" || got[1] != "old" {
+		t.Fatalf("unexpected versions after restore: %v", got)
+	}
+	f, err := store.Open(ctx, "/file", list[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got, _ := io.ReadAll(f); string(got) != "old" {
+		t.Fatalf("version content is %q", got)
+	}
+	if err := store.Restore(ctx, "/file", "missing"); !errors.Is(err, ErrNoSuchVersion) {
+		t.Fatalf("restored a missing version: %v", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	mem := webdav.NewMemFS()
+	fsys := FS(mem, NewStore(mem, Policy{}))
+	for _, content := range []string{"v1", "v2", "v3", "v4", "v5"} {
+		writeFile(t, fsys, "/file", content)
+	}
+	writeFile(t, fsys, "/other", "o1")
+	writeFile(t, fsys, "/other", "o2")
+
+	// versions replaced more than an hour ago are moved out of the window
+	unlimited := NewStore(mem, Policy{})
+	list, err := unlimited.List(ctx, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range list[2:] {
+		v.ReplacedAt = v.ReplacedAt.Add(-2 * time.Hour)
+		if err := mem.RemoveAll(ctx, unlimited.metaName(v.Path, v.ID)); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.WriteRecord(ctx, mem, unlimited.metaName(v.Path, v.ID), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	windowed := NewStore(mem, Policy{Window: time.Hour})
+	if err := windowed.Prune(ctx, "/file"); err != nil {
+		t.Fatal(err)
+	}
+	if got := contents(t, windowed, "/file"); len(got) != 2 || got[0] != "v4" || got[1] != "v3" {
+		t.Fatalf("unexpected versions in the window: %v", got)
+	}
+
+	kept := NewStore(mem, Policy{Keep: 1})
+	files, err := kept.PruneAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 2 {
+		t.Fatalf("pruned %v files", files)
+	}
+	if got := contents(t, kept, "/file"); len(got) != 1 || got[0] != "v4" {
+		t.Fatalf("unexpected versions after pruning: %v", got)
+	}
+	if got := contents(t, kept, "/other"); len(got) != 1 || got[0] != "o1" {
+		t.Fatalf("unexpected versions after pruning: %v", got)
+	}
+
+	// the directory of a file is removed with its last version
+	expired := NewStore(mem, Policy{Window: time.Nanosecond})
+	if err := expired.Prune(ctx, "/file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat(ctx, expired.dir("/file")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("empty version directory was kept: %v", err)
+	}
+}
@@ -4,16 +4,25 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"path"
+	"sort"
 	"strconv"
+	"time"
 
+	"github.com/andrebq/davd/internal/audit"
 	"github.com/andrebq/davd/internal/config"
+	"github.com/andrebq/davd/internal/locks"
 	"github.com/andrebq/davd/internal/server"
+	"github.com/andrebq/davd/internal/uploads"
+	"github.com/andrebq/davd/internal/versions"
 	"github.com/urfave/cli/v2"
 )
 
@@ -59,6 +68,12 @@ func main() {
 		Commands: []*cli.Command{
 			serverCmd(&configdb),
 			authCmd(&configdb),
+			bindCmd(&configdb),
+			quotaCmd(&configdb),
+			auditCmd(&configdb),
+			versionsCmd(&configdb),
+			uploadsCmd(&configdb),
+			dbCmd(&configdb),
 		},
 	}
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
@@ -73,6 +88,81 @@ func authCmd(db **config.DB) *cli.Command {
 		Name: "auth",
 		Subcommands: []*cli.Command{
 			authUserCmd(db),
+			authAPIKeyCmd(db),
+			authGroupCmd(db),
+			authMigratePermissionsCmd(db),
+		},
+	}
+}
+
+func authAPIKeyCmd(db **config.DB) *cli.Command {
+	var username string
+	var ttl time.Duration
+	var keyID string
+	var purge bool
+	return &cli.Command{
+		Name: "apikey",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "create",
+				Description: "Create a new API key for the given user, the key is printed only once and cannot be recovered!",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "name", Usage: "username", Required: true, Destination: &username},
+					&cli.DurationFlag{Name: "ttl", Usage: "How long the key remains valid", Value: 90 * 24 * time.Hour, Destination: &ttl},
+				},
+				Action: func(ctx *cli.Context) error {
+					key, token, err := (*db).CreateAPIKey(username, ttl)
+					if err != nil {
+						return err
+					}
+					enc := json.NewEncoder(ctx.App.Writer)
+					enc.SetIndent("", "  ")
+					return enc.Encode(struct {
+						ID        string    `json:"id"`
+						Username  string    `json:"username"`
+						APIKey    string    `json:"api_key"`
+						Token     string    `json:"bearer_token"`
+						ExpiresAt time.Time `json:"expires_at"`
+					}{
+						ID:        token.ID(),
+						Username:  username,
+						APIKey:    config.FormatAPIKey(key),
+						Token:     token.Raw(),
+						ExpiresAt: token.ExpiresAt(),
+					})
+				},
+			},
+			{
+				Name:        "list",
+				Description: "List API keys (without the key itself), optionally filtered by user",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "name", Usage: "username", Destination: &username},
+				},
+				Action: func(ctx *cli.Context) error {
+					keys, err := (*db).ListAPIKeys(username)
+					if err != nil {
+						return err
+					}
+					enc := json.NewEncoder(ctx.App.Writer)
+					for _, k := range keys {
+						if err := enc.Encode(k); err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+			},
+			{
+				Name:        "revoke",
+				Description: "Revoke an API key, revoked keys are rejected by the server",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "id", Usage: "id of the key (as returned by list)", Required: true, Destination: &keyID},
+					&cli.BoolFlag{Name: "delete", Usage: "Remove the key from the database instead of marking it as revoked", Destination: &purge},
+				},
+				Action: func(ctx *cli.Context) error {
+					return (*db).RevokeAPIKey(keyID, purge)
+				},
+			},
 		},
 	}
 }
@@ -80,7 +170,10 @@ func authCmd(db **config.DB) *cli.Command {
 func authUserCmd(db **config.DB) *cli.Command {
 	var username string
 	var permissions cli.StringSlice
+	var verbs cli.StringSlice
 	var canWrite bool
+	var deny bool
+	var effective bool
 	return &cli.Command{
 		Name: "user",
 		Subcommands: []*cli.Command{
@@ -106,16 +199,13 @@ func authUserCmd(db **config.DB) *cli.Command {
 					&cli.StringFlag{Name: "name", Usage: "username", Required: true, Destination: &username},
 					&cli.StringSliceFlag{Name: "prefix", Aliases: []string{"p"}, Usage: "One or more prefixes that the user can access", Destination: &permissions},
 					&cli.BoolFlag{Name: "can-write", Aliases: []string{"w"}, Usage: "Indicates if the user can write (applies to previous paths as well)", Destination: &canWrite},
+					&cli.StringSliceFlag{Name: "verb", Aliases: []string{"v"}, Usage: "Verbs to grant (read, list, create, overwrite, delete, move, lock, propset or *), defaults to read and list (or * when denying)", Destination: &verbs},
+					&cli.BoolFlag{Name: "deny", Usage: "Deny the given verbs instead of granting them", Destination: &deny},
 				},
 				Action: func(ctx *cli.Context) error {
-					var perms []config.Permission
-					for _, p := range permissions.Value() {
-						perms = append(perms, config.Permission{
-							Prefix:  p,
-							Reader:  true,
-							Writer:  canWrite,
-							Execute: false,
-						})
+					perms, err := permissionsFromFlags(permissions.Value(), verbs.Value(), canWrite, deny)
+					if err != nil {
+						return err
 					}
 					return (*db).UpdatePermissions(username, perms)
 				},
@@ -125,12 +215,16 @@ func authUserCmd(db **config.DB) *cli.Command {
 				Description: "Return the list of paths that a given user can acces",
 				Flags: []cli.Flag{
 					&cli.StringFlag{Name: "name", Usage: "username", Required: true, Destination: &username},
+					&cli.BoolFlag{Name: "effective", Usage: "Include permissions inherited from groups", Destination: &effective},
 				},
 				Action: func(ctx *cli.Context) error {
-					user, err := (*db).FindUser(username)
+					user, err := (*db).FindEffectiveUser(username)
 					if err != nil {
 						return err
 					}
+					if effective {
+						return json.NewEncoder(ctx.App.Writer).Encode(user.EffectivePermissions())
+					}
 					return json.NewEncoder(ctx.App.Writer).Encode(user.Permissions)
 				},
 			},
@@ -138,6 +232,585 @@ func authUserCmd(db **config.DB) *cli.Command {
 	}
 }
 
+func authGroupCmd(db **config.DB) *cli.Command {
+	var group string
+	var description string
+	var username string
+	var permissions cli.StringSlice
+	var verbs cli.StringSlice
+	var canWrite bool
+	var deny bool
+	nameFlag := &cli.StringFlag{Name: "name", Usage: "group name", Required: true, Destination: &group}
+	userFlag := &cli.StringFlag{Name: "user", Usage: "username", Required: true, Destination: &username}
+	return &cli.Command{
+		Name: "group",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "create",
+				Description: "Create a new group without any permission",
+				Flags: []cli.Flag{
+					nameFlag,
+					&cli.StringFlag{Name: "description", Usage: "What the group is used for", Destination: &description},
+				},
+				Action: func(ctx *cli.Context) error {
+					return (*db).CreateGroup(group, description)
+				},
+			},
+			{
+				Name:        "delete",
+				Description: "Delete a group, all members lose the permissions granted by it",
+				Flags:       []cli.Flag{nameFlag},
+				Action: func(ctx *cli.Context) error {
+					return (*db).DeleteGroup(group)
+				},
+			},
+			{
+				Name:        "list",
+				Description: "List all groups",
+				Action: func(ctx *cli.Context) error {
+					groups, err := (*db).ListGroups()
+					if err != nil {
+						return err
+					}
+					return json.NewEncoder(ctx.App.Writer).Encode(groups)
+				},
+			},
+			{
+				Name:        "add-member",
+				Description: "Add a user to the group",
+				Flags:       []cli.Flag{nameFlag, userFlag},
+				Action: func(ctx *cli.Context) error {
+					return (*db).AddGroupMember(group, username)
+				},
+			},
+			{
+				Name:        "remove-member",
+				Description: "Remove a user from the group",
+				Flags:       []cli.Flag{nameFlag, userFlag},
+				Action: func(ctx *cli.Context) error {
+					return (*db).RemoveGroupMember(group, username)
+				},
+			},
+			{
+				Name:        "members",
+				Description: "List the members of the group",
+				Flags:       []cli.Flag{nameFlag},
+				Action: func(ctx *cli.Context) error {
+					members, err := (*db).GroupMembers(group)
+					if err != nil {
+						return err
+					}
+					return json.NewEncoder(ctx.App.Writer).Encode(members)
+				},
+			},
+			{
+				Name:        "update-permission",
+				Description: "Update the given group with a new set of permissions",
+				Flags: []cli.Flag{
+					nameFlag,
+					&cli.StringSliceFlag{Name: "prefix", Aliases: []string{"p"}, Usage: "One or more prefixes that the group can access", Destination: &permissions},
+					&cli.BoolFlag{Name: "can-write", Aliases: []string{"w"}, Usage: "Indicates if the group can write (applies to previous paths as well)", Destination: &canWrite},
+					&cli.StringSliceFlag{Name: "verb", Aliases: []string{"v"}, Usage: "Verbs to grant (read, list, create, overwrite, delete, move, lock, propset or *), defaults to read and list (or * when denying)", Destination: &verbs},
+					&cli.BoolFlag{Name: "deny", Usage: "Deny the given verbs instead of granting them", Destination: &deny},
+				},
+				Action: func(ctx *cli.Context) error {
+					perms, err := permissionsFromFlags(permissions.Value(), verbs.Value(), canWrite, deny)
+					if err != nil {
+						return err
+					}
+					return (*db).UpdateGroupPermissions(group, perms)
+				},
+			},
+			{
+				Name:        "list-permissions",
+				Description: "Return the permissions granted by the group",
+				Flags:       []cli.Flag{nameFlag},
+				Action: func(ctx *cli.Context) error {
+					g, err := (*db).FindGroup(group)
+					if err != nil {
+						return err
+					}
+					return json.NewEncoder(ctx.App.Writer).Encode(g.Permissions)
+				},
+			},
+		},
+	}
+}
+
+func authMigratePermissionsCmd(db **config.DB) *cli.Command {
+	return &cli.Command{
+		Name:        "migrate-permissions",
+		Description: "Convert legacy reader/writer/execute permissions to verbs (also done when the server starts)",
+		Action: func(ctx *cli.Context) error {
+			migrated, err := (*db).MigratePermissions()
+			if err != nil {
+				return err
+			}
+			return json.NewEncoder(ctx.App.Writer).Encode(migrated)
+		},
+	}
+}
+
+func permissionsFromFlags(prefixes, verbNames []string, canWrite, deny bool) ([]config.Permission, error) {
+	var verbs []config.Verb
+	for _, v := range verbNames {
+		if !config.ValidVerb(config.Verb(v)) {
+			return nil, fmt.Errorf("invalid verb: %v", v)
+		}
+		verbs = append(verbs, config.Verb(v))
+	}
+	if len(verbs) == 0 && deny {
+		verbs = append(verbs, config.VerbAll)
+	} else if len(verbs) == 0 {
+		verbs = append(verbs, config.ReadVerbs...)
+	}
+	if canWrite {
+		verbs = append(verbs, config.WriteVerbs...)
+	}
+	var perms []config.Permission
+	for _, p := range prefixes {
+		perms = append(perms, config.Permission{
+			Prefix: p,
+			Verbs:  verbs,
+			Deny:   deny,
+		})
+	}
+	return perms, nil
+}
+
+func bindCmd(db **config.DB) *cli.Command {
+	var bind config.Bind
+	var mode, encryption string
+	var versionsWindow time.Duration
+	modeUsage := fmt.Sprintf("One of %v, %v (no changes allowed) or %v (new files only)", config.BindModeNormal, config.BindModeReadOnly, config.BindModeWriteOnce)
+	encryptionUsage := fmt.Sprintf("One of %v, %v (file content) or %v (content and names), cannot be changed later", config.BindEncryptionNone, config.BindEncryptionContent, config.BindEncryptionNames)
+	nameFlag := &cli.StringFlag{Name: "name", Usage: "bind name, served under /binds/<name>/", Required: true, Destination: &bind.Name}
+	return &cli.Command{
+		Name: "bind",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "add",
+				Description: "Expose a local directory under /binds/<name>/, running servers reload binds automatically",
+				Flags: []cli.Flag{
+					nameFlag,
+					&cli.StringFlag{Name: "path", Usage: "Local directory (must exist), mem://name or s3://bucket/prefix", Required: true, Destination: &bind.Path},
+					&cli.StringFlag{Name: "owner", Usage: "User responsible for the bind", Destination: &bind.Owner},
+					&cli.StringFlag{Name: "description", Usage: "What the bind is used for", Destination: &bind.Description},
+					&cli.StringFlag{Name: "mode", Usage: modeUsage, Value: string(config.BindModeNormal), Destination: &mode},
+					&cli.StringFlag{Name: "encryption", Usage: encryptionUsage, Value: string(config.BindEncryptionNone), Destination: &encryption},
+					&cli.IntFlag{Name: "keep-versions", Usage: "How many previous versions of overwritten files are kept", Destination: &bind.KeepVersions},
+					&cli.DurationFlag{Name: "versions-window", Usage: "How long previous versions of overwritten files are kept", Destination: &versionsWindow},
+				},
+				Action: func(ctx *cli.Context) error {
+					bind.Mode = config.BindMode(mode)
+					bind.Encryption = config.BindEncryption(encryption)
+					bind.VersionsWindow = config.Duration(versionsWindow)
+					return (*db).AddBind(bind)
+				},
+			},
+			{
+				Name:        "set-versions",
+				Description: "Change how many versions of overwritten files are kept (zero for both disables versioning), running servers reload binds automatically",
+				Flags: []cli.Flag{
+					nameFlag,
+					&cli.IntFlag{Name: "keep-versions", Usage: "How many previous versions of overwritten files are kept", Destination: &bind.KeepVersions},
+					&cli.DurationFlag{Name: "versions-window", Usage: "How long previous versions of overwritten files are kept", Destination: &versionsWindow},
+				},
+				Action: func(ctx *cli.Context) error {
+					return (*db).SetBindVersions(bind.Name, bind.KeepVersions, versionsWindow)
+				},
+			},
+			{
+				Name:        "set-mode",
+				Description: "Change the mode of an existing bind, running servers reload binds automatically",
+				Flags: []cli.Flag{
+					nameFlag,
+					&cli.StringFlag{Name: "mode", Usage: modeUsage, Required: true, Destination: &mode},
+				},
+				Action: func(ctx *cli.Context) error {
+					return (*db).SetBindMode(bind.Name, config.BindMode(mode))
+				},
+			},
+			{
+				Name:        "remove",
+				Description: "Stop serving the bind, files are kept in the local directory",
+				Flags:       []cli.Flag{nameFlag},
+				Action: func(ctx *cli.Context) error {
+					return (*db).RemoveBind(bind.Name)
+				},
+			},
+			{
+				Name:        "list",
+				Description: "List all binds",
+				Action: func(ctx *cli.Context) error {
+					binds, err := (*db).LoadBinds()
+					if err != nil {
+						return err
+					}
+					if binds == nil {
+						binds = []config.Bind{}
+					}
+					return json.NewEncoder(ctx.App.Writer).Encode(binds)
+				},
+			},
+			{
+				Name:        "show",
+				Description: "Show the bind, its quota and the permissions (from users and groups) which reach it",
+				Flags:       []cli.Flag{nameFlag},
+				Action: func(ctx *cli.Context) error {
+					found, err := (*db).FindBind(bind.Name)
+					if err != nil {
+						return err
+					}
+					quota, err := (*db).BindQuota(path.Join("binds", found.Name))
+					if err != nil {
+						return err
+					}
+					access, err := (*db).BindAccess(found.Name)
+					if err != nil {
+						return err
+					}
+					return json.NewEncoder(ctx.App.Writer).Encode(struct {
+						Bind   *config.Bind        `json:"bind"`
+						Quota  config.Quota        `json:"quota"`
+						Access []config.BindAccess `json:"access"`
+					}{found, quota, access})
+				},
+			},
+		},
+	}
+}
+
+func quotaCmd(db **config.DB) *cli.Command {
+	var username string
+	var bind string
+	var limit config.Quota
+	targetFlags := []cli.Flag{
+		&cli.StringFlag{Name: "user", Usage: "Quota applied to the user, it counts their home directory and the files they write to binds", Destination: &username},
+		&cli.StringFlag{Name: "bind", Usage: "Quota applied to the bind URL prefix (eg.: binds/scratch or home)", Destination: &bind},
+	}
+	checkTarget := func(ctx *cli.Context) error {
+		if (username == "") == (bind == "") {
+			return errors.New("exactly one of --user or --bind must be provided")
+		}
+		return nil
+	}
+	return &cli.Command{
+		Name: "quota",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "set",
+				Description: "Limit how many bytes and files can be stored, zero removes the limit. User quotas count the home directory of the user and every file they write elsewhere (including uploads in progress), bind quotas count everything stored in the bind (including its trash and versions). Running servers apply the change within a minute, or when binds are reloaded.",
+				Flags: append(targetFlags,
+					&cli.Int64Flag{Name: "max-bytes", Usage: "Maximum number of bytes", Destination: &limit.MaxBytes},
+					&cli.Int64Flag{Name: "max-files", Usage: "Maximum number of files and directories", Destination: &limit.MaxFiles},
+				),
+				Before: checkTarget,
+				Action: func(ctx *cli.Context) error {
+					if username != "" {
+						return (*db).SetUserQuota(username, limit)
+					}
+					return (*db).SetBindQuota(bind, limit)
+				},
+			},
+			{
+				Name:        "show",
+				Description: "Show the quota of a user or bind",
+				Flags:       targetFlags,
+				Before:      checkTarget,
+				Action: func(ctx *cli.Context) error {
+					var q config.Quota
+					var err error
+					if username != "" {
+						q, err = (*db).UserQuota(username)
+					} else {
+						q, err = (*db).BindQuota(bind)
+					}
+					if err != nil {
+						return err
+					}
+					return json.NewEncoder(ctx.App.Writer).Encode(q)
+				},
+			},
+		},
+	}
+}
+
+func versionsCmd(db **config.DB) *cli.Command {
+	var bindName, name, id string
+	openStore := func() (*versions.Store, error) {
+		bind, err := (*db).FindBind(bindName)
+		if err != nil {
+			return nil, err
+		}
+		if !bind.Versioned() {
+			return nil, fmt.Errorf("bind %v is not versioned", bind.Name)
+		}
+		fsys, err := (*db).OpenBindStorage(*bind)
+		if err != nil {
+			return nil, err
+		}
+		return versions.NewStore(fsys, versions.Policy{Keep: bind.KeepVersions, Window: time.Duration(bind.VersionsWindow)}), nil
+	}
+	targetFlags := []cli.Flag{
+		&cli.StringFlag{Name: "bind", Usage: "bind name", Required: true, Destination: &bindName},
+		&cli.StringFlag{Name: "path", Usage: "Path of the file, relative to the bind (eg.: /docs/report.txt)", Required: true, Destination: &name},
+	}
+	return &cli.Command{
+		Name: "versions",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "list",
+				Description: "List the previous versions of a file, the most recent first",
+				Flags:       targetFlags,
+				Action: func(ctx *cli.Context) error {
+					store, err := openStore()
+					if err != nil {
+						return err
+					}
+					list, err := store.List(ctx.Context, name)
+					if err != nil {
+						return err
+					}
+					if list == nil {
+						list = []versions.Version{}
+					}
+					return json.NewEncoder(ctx.App.Writer).Encode(list)
+				},
+			},
+			{
+				Name:        "restore",
+				Description: "Replace the content of a file with a previous version, the current content is kept as a new version",
+				Flags: append(targetFlags,
+					&cli.StringFlag{Name: "id", Usage: "Version to restore (see versions list)", Required: true, Destination: &id},
+				),
+				Action: func(ctx *cli.Context) error {
+					store, err := openStore()
+					if err != nil {
+						return err
+					}
+					return store.Restore(ctx.Context, name, id)
+				},
+			},
+		},
+	}
+}
+
+func uploadsCmd(db **config.DB) *cli.Command {
+	type bindUpload struct {
+		Bind string `json:"bind"`
+		uploads.Session
+	}
+	var bindName, id string
+	var olderThan time.Duration
+	// openStores returns the stores of the selected bind, or of every bind
+	openStores := func() (map[string]*uploads.Store, error) {
+		binds, err := (*db).LoadBinds()
+		if err != nil {
+			return nil, err
+		}
+		stores := map[string]*uploads.Store{}
+		for _, bind := range binds {
+			if bindName != "" && bind.Name != bindName {
+				continue
+			}
+			fsys, err := (*db).OpenBindStorage(bind)
+			if err != nil {
+				return nil, err
+			}
+			stores[bind.Name] = uploads.NewStore(fsys)
+		}
+		if bindName != "" && len(stores) == 0 {
+			return nil, fmt.Errorf("%w: %v", config.ErrNoSuchBind, bindName)
+		}
+		return stores, nil
+	}
+	return &cli.Command{
+		Name:        "uploads",
+		Description: "Manage unfinished uploads of binds, uploads to home directories are only purged by the server",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "list",
+				Description: "List unfinished uploads, the oldest first",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "bind", Usage: "Only uploads to this bind", Destination: &bindName},
+				},
+				Action: func(ctx *cli.Context) error {
+					stores, err := openStores()
+					if err != nil {
+						return err
+					}
+					list := []bindUpload{}
+					for name, store := range stores {
+						sessions, err := store.List(ctx.Context)
+						if err != nil {
+							return fmt.Errorf("unable to list uploads of %v: %w", name, err)
+						}
+						for _, sess := range sessions {
+							list = append(list, bindUpload{Bind: name, Session: sess})
+						}
+					}
+					sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+					return json.NewEncoder(ctx.App.Writer).Encode(list)
+				},
+			},
+			{
+				Name:        "purge",
+				Description: "Remove a single upload (--bind and --id) or every upload idle for longer than --older-than",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "bind", Usage: "Only uploads to this bind", Destination: &bindName},
+					&cli.StringFlag{Name: "id", Usage: "Upload to remove (see uploads list)", Destination: &id},
+					&cli.DurationFlag{Name: "older-than", Usage: "Remove uploads which did not receive data for this long", Value: 24 * time.Hour, Destination: &olderThan},
+				},
+				Action: func(ctx *cli.Context) error {
+					if id != "" && bindName == "" {
+						return errors.New("--id requires --bind")
+					}
+					stores, err := openStores()
+					if err != nil {
+						return err
+					}
+					purged := map[string]int{}
+					for name, store := range stores {
+						if id != "" {
+							if err := store.Abort(ctx.Context, id); err != nil {
+								return err
+							}
+							purged[name] = 1
+							continue
+						}
+						n, err := store.PurgeBefore(ctx.Context, time.Now().Add(-olderThan))
+						if err != nil {
+							return fmt.Errorf("unable to purge uploads of %v: %w", name, err)
+						}
+						purged[name] = n
+					}
+					return json.NewEncoder(ctx.App.Writer).Encode(purged)
+				},
+			},
+		},
+	}
+}
+
+func dbCmd(db **config.DB) *cli.Command {
+	var repair bool
+	return &cli.Command{
+		Name: "db",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "check",
+				Description: "Find records which can not be read (eg.: truncated by a crash), with --repair they are moved aside and must be created again",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "repair", Usage: "Move corrupted records aside and remove temporary files", Destination: &repair},
+				},
+				Action: func(ctx *cli.Context) error {
+					problems, err := (*db).Check(repair)
+					if err != nil {
+						return err
+					}
+					enc := json.NewEncoder(ctx.App.Writer)
+					enc.SetIndent("", "  ")
+					if problems == nil {
+						problems = []config.Problem{}
+					}
+					return enc.Encode(problems)
+				},
+			},
+		},
+	}
+}
+
+func auditCmd(db **config.DB) *cli.Command {
+	var filter audit.Filter
+	var since, until string
+	var lines int
+	var follow bool
+	filterFlags := []cli.Flag{
+		&cli.StringFlag{Name: "user", Usage: "Only operations performed by this user", Destination: &filter.User},
+		&cli.StringFlag{Name: "bind", Usage: "Only operations on this bind (eg.: binds/scratch or home)", Destination: &filter.Bind},
+		&cli.StringFlag{Name: "method", Usage: "Only operations using this method (eg.: PUT, DELETE)", Destination: &filter.Method},
+		&cli.StringFlag{Name: "path", Usage: "Only operations where the source or destination are under this path", Destination: &filter.PathPrefix},
+		&cli.StringFlag{Name: "since", Usage: "Only operations after this time (RFC3339 or a duration, eg.: 24h)", Destination: &since},
+		&cli.StringFlag{Name: "until", Usage: "Only operations before this time (RFC3339 or a duration, eg.: 1h)", Destination: &until},
+		&cli.IntFlag{Name: "min-status", Usage: "Only operations with a result code greater or equal than this", Destination: &filter.MinStatus},
+		&cli.IntFlag{Name: "max-status", Usage: "Only operations with a result code less or equal than this", Destination: &filter.MaxStatus},
+	}
+	parseFilter := func(ctx *cli.Context) error {
+		var err error
+		if filter.Since, err = parseTimeFlag(since); err != nil {
+			return fmt.Errorf("invalid since: %w", err)
+		}
+		if filter.Until, err = parseTimeFlag(until); err != nil {
+			return fmt.Errorf("invalid until: %w", err)
+		}
+		return nil
+	}
+	return &cli.Command{
+		Name: "audit",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "tail",
+				Description: "Print the most recent entries of the audit log",
+				Flags: append(filterFlags,
+					&cli.IntFlag{Name: "lines", Aliases: []string{"n"}, Usage: "How many entries to print", Value: 20, Destination: &lines},
+					&cli.BoolFlag{Name: "follow", Aliases: []string{"f"}, Usage: "Keep printing new entries as they are recorded", Destination: &follow},
+				),
+				Before: parseFilter,
+				Action: func(ctx *cli.Context) error {
+					file, err := (*db).StatePath(audit.FileName)
+					if err != nil {
+						return err
+					}
+					entries, err := audit.Tail(file, lines, filter)
+					if err != nil {
+						return err
+					}
+					enc := json.NewEncoder(ctx.App.Writer)
+					for _, e := range entries {
+						if err := enc.Encode(e); err != nil {
+							return err
+						}
+					}
+					if !follow {
+						return nil
+					}
+					return audit.Follow(ctx.Context, file, filter, time.Second, func(e audit.Entry) error {
+						return enc.Encode(e)
+					})
+				},
+			},
+			{
+				Name:        "query",
+				Description: "Print all entries of the audit log which match the given filters",
+				Flags:       filterFlags,
+				Before:      parseFilter,
+				Action: func(ctx *cli.Context) error {
+					file, err := (*db).StatePath(audit.FileName)
+					if err != nil {
+						return err
+					}
+					enc := json.NewEncoder(ctx.App.Writer)
+					return audit.Query(file, filter, func(e audit.Entry) error {
+						return enc.Encode(e)
+					})
+				},
+			},
+		},
+	}
+}
+
+// parseTimeFlag accepts either an absolute time (RFC3339)
+// or a duration, which is subtracted from the current time
+func parseTimeFlag(val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(val); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, val)
+}
+
 func serverCmd(db **config.DB) *cli.Command {
 	return &cli.Command{
 		Name:  "server",
@@ -154,6 +827,8 @@ func serverRunCmd(db **config.DB) *cli.Command {
 	var rootDir string
 	var adminToken string
 	var hostAndPort string
+	var opts server.Options
+	opts.Locks = locks.DefaultLimits
 	return &cli.Command{
 		Name:  "run",
 		Usage: "Run the HTTP server",
@@ -190,13 +865,82 @@ func serverRunCmd(db **config.DB) *cli.Command {
 				DefaultText: "<redacted>",
 				Destination: &adminToken,
 			},
+			&cli.IntFlag{
+				Name:        "max-locks",
+				Usage:       "Maximum number of WebDAV locks across all users",
+				EnvVars:     []string{"DAVD_MAX_LOCKS"},
+				Value:       opts.Locks.Global,
+				Destination: &opts.Locks.Global,
+			},
+			&cli.IntFlag{
+				Name:        "max-locks-per-user",
+				Usage:       "Maximum number of WebDAV locks a single user can hold",
+				EnvVars:     []string{"DAVD_MAX_LOCKS_PER_USER"},
+				Value:       opts.Locks.PerUser,
+				Destination: &opts.Locks.PerUser,
+			},
+			&cli.DurationFlag{
+				Name:        "max-lock-timeout",
+				Usage:       "Maximum duration of a WebDAV lock, infinite locks are capped to this value",
+				EnvVars:     []string{"DAVD_MAX_LOCK_TIMEOUT"},
+				Value:       opts.Locks.MaxTimeout,
+				Destination: &opts.Locks.MaxTimeout,
+			},
+			&cli.DurationFlag{
+				Name:        "binds-poll-interval",
+				Usage:       "How often the binds file is checked for changes, zero disables the check (binds are still reloaded on SIGHUP)",
+				EnvVars:     []string{"DAVD_BINDS_POLL_INTERVAL"},
+				Value:       5 * time.Second,
+				Destination: &opts.BindsPollInterval,
+			},
+			&cli.DurationFlag{
+				Name:        "trash-retention",
+				Usage:       "How long deleted or overwritten files are kept in the trash of each bind, zero keeps them until a user purges them",
+				EnvVars:     []string{"DAVD_TRASH_RETENTION"},
+				Value:       30 * 24 * time.Hour,
+				Destination: &opts.TrashRetention,
+			},
+			&cli.DurationFlag{
+				Name:        "upload-expiry",
+				Usage:       "How long unfinished uploads are kept without receiving any data, zero keeps them until they are completed or aborted",
+				EnvVars:     []string{"DAVD_UPLOAD_EXPIRY"},
+				Value:       24 * time.Hour,
+				Destination: &opts.UploadExpiry,
+			},
+			&cli.Int64Flag{
+				Name:        "max-request-size",
+				Usage:       "Maximum size in bytes of a request body (eg.: a WebDAV PUT or an upload chunk), zero removes the limit",
+				EnvVars:     []string{"DAVD_MAX_REQUEST_SIZE"},
+				Destination: &opts.MaxRequestSize,
+			},
+			&cli.Int64Flag{
+				Name:        "max-request-memory",
+				Usage:       "Maximum size in bytes of the forms parsed in memory, uploads are streamed to the binds and not affected, zero removes the limit",
+				EnvVars:     []string{"DAVD_MAX_REQUEST_MEMORY"},
+				Value:       10 << 20,
+				Destination: &opts.MaxRequestMemory,
+			},
 		},
 		Before: func(ctx *cli.Context) error {
 			hostAndPort = net.JoinHostPort(addr, strconv.FormatUint(uint64(port), 10))
 			return nil
 		},
 		Action: func(ctx *cli.Context) error {
-			created, err := (*db).InitialSetup()
+			problems, err := (*db).Check(false)
+			if err != nil {
+				return err
+			}
+			for _, p := range problems {
+				slog.Warn("Corrupted configuration record, run 'db check --repair'", "key", p.Key, "error", p.Error)
+			}
+			migrated, err := (*db).MigratePermissions()
+			if err != nil {
+				return err
+			}
+			if len(migrated) > 0 {
+				slog.Info("Migrated legacy permissions", "users", migrated)
+			}
+			created, err := (*db).InitialSetup(adminToken)
 			if err != nil {
 				return err
 			}
@@ -205,10 +949,10 @@ func serverRunCmd(db **config.DB) *cli.Command {
 			} else {
 				slog.Info("Root user already present, DAVD_ADMIN_TOKEN was ignored")
 			}
-			return server.Run(ctx.Context, *db, hostAndPort, server.Environ{
+			return server.Run(ctx.Context, *db, hostAndPort, rootDir, server.Environ{
 				Entries: os.Environ,
 				Expand:  os.ExpandEnv,
-			})
+			}, opts)
 		},
 	}
 }